@@ -0,0 +1,190 @@
+// Package blob stores recording files. Files are addressed by keys - slash separated paths
+// relative to the root of the store, like "2024-01-10/<record id>/<file name>"
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+var (
+	ErrNotFound   = errors.New("blob not found")
+	ErrInvalidKey = errors.New("invalid blob key")
+)
+
+// Info describes the stored file
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Store keeps files by keys
+type Store interface {
+	// Put saves size bytes of r with the key, replacing the existing file
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Stat returns the file info, ErrNotFound if there is no such file
+	Stat(ctx context.Context, key string) (Info, error)
+	// Open returns length bytes of the file starting at offset, the rest of the file if length < 0
+	Open(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// Delete deletes the file, ErrNotFound if there is no such file
+	Delete(ctx context.Context, key string) error
+	// List returns all the files with keys starting with prefix
+	List(ctx context.Context, prefix string) ([]Info, error)
+}
+
+// Mover is implemented by the stores which can take over a local file without copying it
+type Mover interface {
+	// Move moves the local file to the store with the key
+	Move(ctx context.Context, key string, localPath string) error
+}
+
+// checkKey returns ErrInvalidKey if the key is empty, absolute or has "." or ".." elements
+func checkKey(key string) error {
+	if !fs.ValidPath(key) || key == "." {
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	return nil
+}
+
+// PutFile moves the local file to the store. Stores implementing Mover take the file over,
+// for the rest it's uploaded and removed
+func PutFile(ctx context.Context, store Store, key string, localPath string) error {
+	if m, ok := store.(Mover); ok {
+		return m.Move(ctx, key, localPath)
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := store.Put(ctx, key, f, info.Size()); err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(localPath)
+}
+
+// Transfer moves the file with the key from one store to another. Local file is moved
+// without copying if the destination store implements Mover
+func Transfer(ctx context.Context, from, to Store, key string) error {
+	if src, ok := from.(*Local); ok {
+		if m, ok := to.(Mover); ok {
+			if err := checkKey(key); err != nil {
+				return err
+			}
+			if err := m.Move(ctx, key, src.Path(key)); err != nil {
+				return err
+			}
+			src.prune(path.Dir(key))
+			return nil
+		}
+	}
+
+	info, err := from.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	rc, err := from.Open(ctx, key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := to.Put(ctx, key, rc, info.Size); err != nil {
+		return err
+	}
+	return from.Delete(ctx, key)
+}
+
+// readSeeker reads the stored file from the current offset, the file is reopened after Seek
+type readSeeker struct {
+	ctx    context.Context
+	store  Store
+	key    string
+	size   int64
+	offset int64
+	rc     io.ReadCloser
+}
+
+func (r *readSeeker) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.rc == nil {
+		rc, err := r.store.Open(r.ctx, r.key, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.rc = rc
+	}
+	n, err := r.rc.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *readSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *readSeeker) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
+
+// Handler serves the files of the store, the key is the request path. Range requests are
+// supported, only the requested part of the file is read from the store
+func Handler(store Store) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		key := path.Clean("/" + r.URL.Path)[1:]
+		if checkKey(key) != nil {
+			http.NotFound(rw, r)
+			return
+		}
+		ServeFile(rw, r, store, key)
+	})
+}
+
+// ServeFile serves the file with the key from the store with http.ServeContent, so Range and
+// conditional requests are supported. Set ETag header before the call to use it in the conditions
+func ServeFile(rw http.ResponseWriter, r *http.Request, store Store, key string) {
+	info, err := store.Stat(r.Context(), key)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("[ERROR] failed to stat %s, %v", key, err)
+		}
+		http.NotFound(rw, r)
+		return
+	}
+	content := &readSeeker{ctx: r.Context(), store: store, key: key, size: info.Size}
+	defer content.Close()
+	http.ServeContent(rw, r, path.Base(key), info.ModTime, content)
+}
@@ -0,0 +1,226 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Local keeps files in the local folder, keys are paths relative to the folder
+type Local struct {
+	root string
+}
+
+// NewLocal creates the store in the root folder
+func NewLocal(root string) *Local {
+	return &Local{root: root}
+}
+
+// Root returns the folder of the store
+func (l *Local) Root() string {
+	return l.root
+}
+
+// Path returns the local path of the file with the key
+func (l *Local) Path(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(key))
+}
+
+// Put writes the file to a temporary file next to it, syncs and renames it
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	target := l.Path(key)
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := target + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(target))
+}
+
+// Move renames the local file into the store. Files on other devices are copied and removed
+func (l *Local) Move(ctx context.Context, key string, localPath string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	target := l.Path(key)
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(localPath, target); err != nil {
+		f, err := os.Open(localPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if err := l.Put(ctx, key, f, info.Size()); err != nil {
+			return err
+		}
+		f.Close()
+		return os.Remove(localPath)
+	}
+	return syncDir(filepath.Dir(target))
+}
+
+// Rename moves the file to another key of the store, the folders left empty are removed
+func (l *Local) Rename(ctx context.Context, from, to string) error {
+	if err := checkKey(from); err != nil {
+		return err
+	}
+	if _, err := l.Stat(ctx, from); err != nil {
+		return err
+	}
+	if err := l.Move(ctx, to, l.Path(from)); err != nil {
+		return err
+	}
+	l.prune(path.Dir(from))
+	return nil
+}
+
+// Stat returns the file info
+func (l *Local) Stat(ctx context.Context, key string) (Info, error) {
+	if err := checkKey(key); err != nil {
+		return Info{}, err
+	}
+	info, err := os.Stat(l.Path(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return Info{}, ErrNotFound
+		}
+		return Info{}, err
+	}
+	if info.IsDir() {
+		return Info{}, ErrNotFound
+	}
+	return Info{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Open opens the file and seeks to offset
+func (l *Local) Open(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(l.Path(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+// Delete removes the file and the folders left empty
+func (l *Local) Delete(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if err := os.Remove(l.Path(key)); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrNotFound
+		}
+		return err
+	}
+	l.prune(path.Dir(key))
+	return nil
+}
+
+// prune removes the folder with the key and its parents while they are empty, the root is kept
+func (l *Local) prune(dir string) {
+	for ; dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if err := os.Remove(l.Path(dir)); err != nil {
+			return
+		}
+	}
+}
+
+// List walks the folder of the prefix and returns the files with keys starting with prefix
+func (l *Local) List(ctx context.Context, prefix string) ([]Info, error) {
+	dir := prefix[:strings.LastIndex(prefix, "/")+1]
+	start := l.root
+	if dir != "" {
+		start = l.Path(dir)
+	}
+	var res []Info
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && p == start {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		res = append(res, Info{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return res, err
+}
+
+// syncDir makes the changes of the folder entries durable
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -19,6 +19,9 @@ import (
 	"github.com/parMaster/zoomrs/storage/model"
 )
 
+// ErrMeetingNotFound is returned when the meeting recordings are not in the cloud anymore
+var ErrMeetingNotFound = errors.New("meeting recordings not found")
+
 type AccessToken struct {
 	AccessToken string    `json:"access_token"`
 	ExpiresIn   int       `json:"expires_in"`
@@ -28,15 +31,26 @@ type AccessToken struct {
 }
 
 type ZoomClient struct {
-	cfg    *config.Client
-	client http.Client
-	token  *AccessToken
+	cfg      *config.Client
+	client   http.Client
+	mx       sync.Mutex // guards token
+	token    *AccessToken
+	ownerMx  sync.Mutex // guards owner
+	owner    *string    // email of the app owner, empty if the lookup failed, nil if not looked up yet
+	apiURL   string
+	limiters map[Category]*limiter
 }
 
 func NewZoomClient(cfg config.Client) *ZoomClient {
 	client := http.Client{}
 
-	return &ZoomClient{cfg: &cfg, client: client}
+	limiters := map[Category]*limiter{
+		Light:  newLimiter(cfg.RateLimitingDelay.Light, cfg.RateLimitingDelay.Burst),
+		Medium: newLimiter(cfg.RateLimitingDelay.Medium, cfg.RateLimitingDelay.Burst),
+		Heavy:  newLimiter(cfg.RateLimitingDelay.Heavy, cfg.RateLimitingDelay.Burst),
+	}
+
+	return &ZoomClient{cfg: &cfg, client: client, apiURL: "https://api.zoom.us/v2", limiters: limiters}
 }
 
 // Authorize - get access token
@@ -89,10 +103,8 @@ func (z *ZoomClient) Authorize() error {
 
 // GetToken - get token, if token is expired, re-authorize
 func (z *ZoomClient) GetToken() (*AccessToken, error) {
-	var mx sync.Mutex
-
-	mx.Lock()
-	defer mx.Unlock()
+	z.mx.Lock()
+	defer z.mx.Unlock()
 
 	if z.token == nil || z.token.ExpiresAt.Before(time.Now()) {
 		if err := z.Authorize(); err != nil {
@@ -111,9 +123,75 @@ func (z *ZoomClient) GetMeetings(ctx context.Context, daysAgo int) ([]model.Meet
 	return z.GetIntervalMeetings(ctx, from, to)
 }
 
-// GetIntervalMeetings - get meetings for a from-to interval
+// GetIntervalMeetings - get meetings for a from-to interval. Recordings of the app owner (users/me)
+// are returned, or recordings of every user of the account if cfg.AccountWide is set.
+// Meetings are marked with the host id and email
 // Medium rate limit API
 func (z *ZoomClient) GetIntervalMeetings(ctx context.Context, from, to time.Time) ([]model.Meeting, error) {
+	if !z.cfg.AccountWide {
+		// host id and email come with the recordings, the owner lookup only fills the missing emails
+		meetings, err := z.getUserRecordings(ctx, "me", from, to, false)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("unable to get recordings"), err)
+		}
+		for i := range meetings {
+			if meetings[i].HostEmail == "" {
+				meetings[i].HostEmail = z.ownerEmail(ctx)
+			}
+		}
+		return meetings, nil
+	}
+
+	users, err := z.GetUsers(ctx)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to get users"), err)
+	}
+
+	meetings := []model.Meeting{}
+	for _, user := range users {
+		m, err := z.getUserRecordings(ctx, user.Id, from, to, false)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("unable to get recordings of user %s", user.Email), err)
+		}
+		for i := range m {
+			if m[i].HostId == "" {
+				m[i].HostId = user.Id
+			}
+			m[i].HostEmail = user.Email
+		}
+		meetings = append(meetings, m...)
+	}
+
+	return meetings, nil
+}
+
+// ownerEmail returns the email of the app owner (users/me), looked up once. The lookup is best-effort:
+// apps installed before the account-wide sync may not have the user read scope, empty email is returned then
+func (z *ZoomClient) ownerEmail(ctx context.Context) string {
+	z.ownerMx.Lock()
+	defer z.ownerMx.Unlock()
+	if z.owner != nil {
+		return *z.owner
+	}
+
+	users, err := z.GetUsers(ctx)
+	if err != nil || len(users) == 0 {
+		log.Printf("[WARN] unable to get the app owner email, host email of the meetings is not set: %v", err)
+		if ctx.Err() == nil {
+			z.owner = new(string)
+		}
+		return ""
+	}
+	z.owner = &users[0].Email
+	return *z.owner
+}
+
+// getUserRecordings - get recordings of the user for a from-to interval, all pages.
+// Meeting recordings in the trash are returned instead if trash is set
+// https://developers.zoom.us/docs/api/rest/reference/zoom-api/methods/#operation/recordingsList
+// GET /users/{userId}/recordings
+// Medium rate limit API
+func (z *ZoomClient) getUserRecordings(ctx context.Context, userId string, from, to time.Time, trash bool) ([]model.Meeting, error) {
 	_, err := z.GetToken()
 	if err != nil {
 		return nil, errors.Join(fmt.Errorf("unable to get token"), err)
@@ -123,9 +201,13 @@ func (z *ZoomClient) GetIntervalMeetings(ctx context.Context, from, to time.Time
 	params.Add(`page_size`, "300")
 	params.Add(`from`, from.Format("2006-01-02"))
 	params.Add(`to`, to.Format("2006-01-02"))
+	if trash {
+		params.Add(`trash`, "true")
+		params.Add(`trash_type`, "meeting_recordings")
+	}
 	log.Printf("[DEBUG] initial params = %s", params.Encode())
 	req, err := http.NewRequest(http.MethodGet,
-		"https://api.zoom.us/v2/users/me/recordings?"+params.Encode(), nil)
+		z.apiURL+"/users/"+url.PathEscape(userId)+"/recordings?"+params.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -139,7 +221,7 @@ func (z *ZoomClient) GetIntervalMeetings(ctx context.Context, from, to time.Time
 	for {
 		log.Printf("[DEBUG] params = %s", params.Encode())
 		req.URL.RawQuery = params.Encode()
-		resp, err := z.client.Do(req)
+		resp, err := z.do(ctx, Medium, req)
 		if err != nil {
 			return nil, err
 		}
@@ -167,16 +249,144 @@ func (z *ZoomClient) GetIntervalMeetings(ctx context.Context, from, to time.Time
 		}
 		log.Printf("[DEBUG] recordings.NextPageToken = %v", recordings.NextPageToken)
 		params.Set(`next_page_token`, recordings.NextPageToken)
+	}
+
+	return meetings, nil
+}
+
+// GetUsers - get users whose recordings are synced: the app owner (users/me, requires the user read scope),
+// or all active and inactive users of the account if cfg.AccountWide is set
+// https://developers.zoom.us/docs/api/rest/reference/user/methods/#operation/users
+// GET /users, GET /users/me
+// Medium rate limit API
+func (z *ZoomClient) GetUsers(ctx context.Context) ([]model.User, error) {
+	_, err := z.GetToken()
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to get token"), err)
+	}
 
-		select {
-		case <-time.After(z.cfg.RateLimitingDelay.Medium):
-			continue
-		case <-ctx.Done():
-			return nil, ctx.Err()
+	get := func(q string, v any) error {
+		req, err := http.NewRequest(http.MethodGet, z.apiURL+q, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Add(`Authorization`, fmt.Sprintf("Bearer %s", z.token.AccessToken))
+		req.Header.Add(`Host`, "zoom.us")
+		req.Header.Add(`Content-Type`, "application/json")
+
+		resp, err := z.do(ctx, Medium, req)
+		if err != nil {
+			return err
 		}
+		defer func() {
+			if err := resp.Body.Close(); err != nil {
+				log.Printf("[ERROR] failed to close response: %v", err)
+			}
+		}()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unable to get %s, status %d", q, resp.StatusCode)
+		}
+		return json.NewDecoder(resp.Body).Decode(v)
 	}
 
-	return meetings, nil
+	if !z.cfg.AccountWide {
+		me := model.User{}
+		if err := get("/users/me", &me); err != nil {
+			return nil, err
+		}
+		return []model.User{me}, nil
+	}
+
+	users := []model.User{}
+	// deactivated users still can have recordings in the cloud
+	for _, status := range []string{"active", "inactive"} {
+		params := url.Values{}
+		params.Add(`page_size`, "300")
+		params.Add(`status`, status)
+		for {
+			page := model.Users{}
+			if err := get("/users?"+params.Encode(), &page); err != nil {
+				return nil, err
+			}
+			users = append(users, page.Users...)
+			if page.NextPageToken == `` {
+				break
+			}
+			params.Set(`next_page_token`, page.NextPageToken)
+		}
+	}
+	log.Printf("[DEBUG] %d users to sync", len(users))
+
+	return users, nil
+}
+
+// GetMeetingRecordings - get recordings of the meeting with fresh download urls
+// https://developers.zoom.us/docs/api/rest/reference/zoom-api/methods/#operation/recordingGet
+// GET /meetings/{meetingId}/recordings
+// - meetingId string is meeting.UUID
+// ErrMeetingNotFound is returned if the meeting recordings are deleted from the cloud
+// Light rate limit API
+func (z *ZoomClient) GetMeetingRecordings(ctx context.Context, meetingId string) (*model.Meeting, error) {
+	_, err := z.GetToken()
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to get token"), err)
+	}
+
+	// UUID starting with "/" or containing "//" must be double encoded
+	q := fmt.Sprintf("%s/meetings/%s/recordings", z.apiURL, url.QueryEscape(url.QueryEscape(meetingId)))
+	req, err := http.NewRequest(http.MethodGet, q, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add(`Authorization`, fmt.Sprintf("Bearer %s", z.token.AccessToken))
+	req.Header.Add(`Host`, "zoom.us")
+	req.Header.Add(`Content-Type`, "application/json")
+
+	resp, err := z.do(ctx, Light, req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("[ERROR] failed to close response: %v", err)
+		}
+	}()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrMeetingNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to get recordings for meeting id: %s, status %d", meetingId, resp.StatusCode)
+	}
+
+	meeting := &model.Meeting{}
+	if err := json.NewDecoder(resp.Body).Decode(meeting); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal meeting recordings: %w", err)
+	}
+	return meeting, nil
+}
+
+// GetTrashedMeetingRecordings - get recordings of the meeting from the trash of its host, with download urls.
+// Trashed recordings are not returned by GetMeetingRecordings, but can still be downloaded
+// until they are deleted permanently. The trash is listed for the day of the meeting start,
+// hostId is the user id of the host, "me" - the app owner.
+// ErrMeetingNotFound is returned if the meeting is not in the trash
+// Medium rate limit API
+func (z *ZoomClient) GetTrashedMeetingRecordings(ctx context.Context, hostId, meetingId string, start time.Time) (*model.Meeting, error) {
+	if hostId == "" {
+		hostId = "me"
+	}
+	meetings, err := z.getUserRecordings(ctx, hostId, start.AddDate(0, 0, -1), start.AddDate(0, 0, 1), true)
+	if err != nil {
+		return nil, err
+	}
+	for i := range meetings {
+		if meetings[i].UUID == meetingId {
+			return &meetings[i], nil
+		}
+	}
+	return nil, ErrMeetingNotFound
 }
 
 // GetAllMeetings - get all meetings going from today back in the past by 30 days chunks
@@ -236,7 +446,7 @@ func (z *ZoomClient) GetAllMeetingsWithRetry(ctx context.Context) ([]model.Meeti
 // - from string - start date in format yyyy-mm-dd
 // - to string - end date in format yyyy-mm-dd
 // HEAVY rate limit API
-func (z *ZoomClient) GetCloudStorageReport(from, to string) (*model.CloudRecordingReport, error) {
+func (z *ZoomClient) GetCloudStorageReport(ctx context.Context, from, to string) (*model.CloudRecordingReport, error) {
 	_, err := z.GetToken()
 	if err != nil {
 		return nil, errors.Join(fmt.Errorf("unable to get token"), err)
@@ -246,7 +456,7 @@ func (z *ZoomClient) GetCloudStorageReport(from, to string) (*model.CloudRecordi
 	params.Add(`from`, from)
 	params.Add(`to`, to)
 	log.Printf("[DEBUG] initial params = %s", params.Encode())
-	req, err := http.NewRequest(http.MethodGet, "https://api.zoom.us/v2/report/cloud_recording?"+
+	req, err := http.NewRequest(http.MethodGet, z.apiURL+"/report/cloud_recording?"+
 		params.Encode(), nil)
 	if err != nil {
 		return nil, err
@@ -256,7 +466,7 @@ func (z *ZoomClient) GetCloudStorageReport(from, to string) (*model.CloudRecordi
 	req.Header.Add(`Host`, "zoom.us")
 	req.Header.Add(`Content-Type`, "application/json")
 
-	resp, err := z.client.Do(req)
+	resp, err := z.do(ctx, Heavy, req)
 	if err != nil {
 		return nil, err
 	}
@@ -285,8 +495,7 @@ func (z *ZoomClient) GetCloudStorageReport(from, to string) (*model.CloudRecordi
 // - meetingId string is meeting.UUID
 // - delete bool - true to delete, false to trash
 // Light rate limit API
-func (z *ZoomClient) DeleteMeetingRecordings(meetingId string, delete bool) error {
-
+func (z *ZoomClient) DeleteMeetingRecordings(ctx context.Context, meetingId string, delete bool) error {
 	if !z.cfg.DeleteDownloaded && !z.cfg.TrashDownloaded && !z.cfg.DeleteSkipped {
 		return errors.New("both delete_downloaded and trash_downloaded are false")
 	}
@@ -306,8 +515,8 @@ func (z *ZoomClient) DeleteMeetingRecordings(meetingId string, delete bool) erro
 	// https://developers.zoom.us/docs/meeting-sdk/apis/#operation/recordingDelete
 	// If a UUID starts with "/" or contains "//" (example: "/ajXp112QmuoKj4854875=="),
 	// you must double encode the UUID before making an API request.
-	q := fmt.Sprintf("https://api.zoom.us/v2/meetings/%s/recordings?%s",
-		url.QueryEscape(url.QueryEscape(meetingId)), params.Encode())
+	q := fmt.Sprintf("%s/meetings/%s/recordings?%s",
+		z.apiURL, url.QueryEscape(url.QueryEscape(meetingId)), params.Encode())
 	log.Printf("[DEBUG] deleting with url = %s, params = %s", q, params.Encode())
 	req, err := http.NewRequest(http.MethodDelete, q, nil)
 	if err != nil {
@@ -318,7 +527,7 @@ func (z *ZoomClient) DeleteMeetingRecordings(meetingId string, delete bool) erro
 	req.Header.Add(`Host`, "zoom.us")
 	req.Header.Add(`Content-Type`, "application/json")
 
-	resp, err := z.client.Do(req)
+	resp, err := z.do(ctx, Light, req)
 	if err != nil {
 		return err
 	}
@@ -365,16 +574,13 @@ func (z *ZoomClient) DeleteRecordingsOverCapacity(ctx context.Context, cap model
 
 		if sizeAccum > cap {
 			log.Printf("[DEBUG] cap reached, cloud used: %s \t deleting: %s", sizeAccum, m.UUID)
-			if err := z.DeleteMeetingRecordings(m.UUID, true); err != nil {
+			if err := z.DeleteMeetingRecordings(ctx, m.UUID, true); err != nil {
 				log.Printf("[ERROR] deleting uuid: %s, %v", m.UUID, err)
 			} else {
 				deleted++
 			}
 
-			select {
-			case <-time.After(z.cfg.RateLimitingDelay.Light):
-				continue
-			case <-ctx.Done():
+			if ctx.Err() != nil {
 				return deleted, ctx.Err()
 			}
 
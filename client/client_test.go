@@ -5,8 +5,12 @@ package client
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -61,7 +65,7 @@ func Test_ZoomClient(t *testing.T) {
 	from := time.Now().AddDate(0, 0, -2).Format("2006-01-02")
 	to := time.Now().Format("2006-01-02")
 
-	storageReport, err := c.GetCloudStorageReport(from, to)
+	storageReport, err := c.GetCloudStorageReport(context.Background(), from, to)
 	assert.NoError(t, err)
 	assert.NotNil(t, storageReport)
 	log.Printf("[DEBUG] Storage report: %+v", storageReport)
@@ -144,7 +148,7 @@ func Test_CloudStorageReport(t *testing.T) {
 	from := time.Now().AddDate(0, 0, -14).Format("2006-01-02")
 	to := time.Now().Format("2006-01-02")
 
-	storageReport, err := c.GetCloudStorageReport(from, to)
+	storageReport, err := c.GetCloudStorageReport(context.Background(), from, to)
 	assert.NoError(t, err)
 	assert.NotNil(t, storageReport)
 
@@ -156,3 +160,208 @@ func Test_CloudStorageReport(t *testing.T) {
 	s, _ := json.MarshalIndent(storageReport, "", "\t")
 	log.Printf("[DEBUG] Storage report: %+v", string(s))
 }
+
+// Tests retries of rate limited and failed requests against a fake Zoom API
+func Test_RateLimitedRetry(t *testing.T) {
+	baseBackoff = 10 * time.Millisecond
+
+	var calls atomic.Int32
+	var failures int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"from":"2023-10-01","to":"2023-10-02","cloud_recording_storage":[{"date":"2023-10-02","usage":"1 GB"}]}`))
+	}))
+	defer ts.Close()
+
+	c := NewZoomClient(config.Client{
+		MaxRetries:        2,
+		RateLimitingDelay: config.RateLimitingDelay{Light: time.Millisecond, Medium: time.Millisecond, Heavy: time.Millisecond},
+	})
+	c.apiURL = ts.URL
+	c.token = &AccessToken{AccessToken: "token", ExpiresAt: time.Now().Add(time.Hour)}
+
+	// succeeds after 2 retries
+	failures = 2
+	report, err := c.GetCloudStorageReport(context.Background(), "2023-10-01", "2023-10-02")
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), calls.Load())
+	require.Len(t, report.CloudRecordingStorage, 1)
+	assert.Equal(t, model.FileSize(1024*1024*1024), report.CloudRecordingStorage[0].Usage)
+
+	// gives up after 2 retries
+	calls.Store(0)
+	failures = 10
+	_, err = c.GetCloudStorageReport(context.Background(), "2023-10-01", "2023-10-02")
+	var rateLimited *ErrRateLimited
+	require.True(t, errors.As(err, &rateLimited))
+	assert.Equal(t, http.StatusTooManyRequests, rateLimited.StatusCode)
+	assert.Equal(t, Heavy, rateLimited.Category)
+	assert.Equal(t, int32(3), calls.Load())
+
+	// waiting for Retry-After is canceled with the context
+	retryAfter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer retryAfter.Close()
+	c.apiURL = retryAfter.URL
+	c.cfg.DeleteDownloaded = true
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = c.DeleteMeetingRecordings(ctx, "uuid", true)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func Test_ParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, 5*time.Second, parseRetryAfter("5", now))
+	assert.Equal(t, time.Minute, parseRetryAfter("Sun, 01 Oct 2023 12:01:00 GMT", now))
+	assert.Equal(t, 12*time.Hour, parseRetryAfter("2023-10-02T00:00:00Z", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("garbage", now))
+}
+
+// Tests account-wide sync against a fake Zoom API: recordings of every user are collected and marked with the host
+func Test_AccountWideMeetings(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users":
+			if r.URL.Query().Get("status") == "inactive" {
+				w.Write([]byte(`{"users":[{"id":"u3","email":"former@example.com","status":"inactive"}]}`))
+				return
+			}
+			if r.URL.Query().Get("next_page_token") == "" {
+				w.Write([]byte(`{"next_page_token":"p2","users":[{"id":"u1","email":"one@example.com","status":"active"}]}`))
+				return
+			}
+			w.Write([]byte(`{"users":[{"id":"u2","email":"two@example.com","status":"active"}]}`))
+		case "/users/u1/recordings":
+			w.Write([]byte(`{"meetings":[{"uuid":"m1","topic":"first","host_id":"u1"},{"uuid":"m2","topic":"second"}]}`))
+		case "/users/u2/recordings":
+			w.Write([]byte(`{"meetings":[{"uuid":"m3","topic":"third","host_id":"u2"}]}`))
+		case "/users/u3/recordings":
+			w.Write([]byte(`{"meetings":[]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	c := NewZoomClient(config.Client{AccountWide: true})
+	c.apiURL = ts.URL
+	c.token = &AccessToken{AccessToken: "token", ExpiresAt: time.Now().Add(time.Hour)}
+
+	meetings, err := c.GetIntervalMeetings(context.Background(), time.Now(), time.Now())
+	require.NoError(t, err)
+	require.Len(t, meetings, 3)
+	assert.Equal(t, "one@example.com", meetings[0].HostEmail)
+	assert.Equal(t, "u1", meetings[1].HostId)
+	assert.Equal(t, "one@example.com", meetings[1].HostEmail)
+	assert.Equal(t, "two@example.com", meetings[2].HostEmail)
+}
+
+// Tests the app owner sync: recordings are read from users/me without the users lookup, the missing host
+// email is looked up once, and its failure doesn't fail the sync
+func Test_OwnerMeetings(t *testing.T) {
+	var meCalls atomic.Int32
+	var meStatus atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/me/recordings":
+			w.Write([]byte(`{"meetings":[{"uuid":"m1","host_id":"u1","host_email":"host@example.com"},{"uuid":"m2","host_id":"u1"}]}`))
+		case "/users/me":
+			meCalls.Add(1)
+			w.WriteHeader(int(meStatus.Load()))
+			w.Write([]byte(`{"id":"u1","email":"owner@example.com"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	// no user read scope
+	c := NewZoomClient(config.Client{})
+	c.apiURL = ts.URL
+	c.token = &AccessToken{AccessToken: "token", ExpiresAt: time.Now().Add(time.Hour)}
+	meStatus.Store(http.StatusBadRequest)
+	for i := 0; i < 2; i++ {
+		meetings, err := c.GetIntervalMeetings(context.Background(), time.Now(), time.Now())
+		require.NoError(t, err)
+		require.Len(t, meetings, 2)
+		assert.Equal(t, "host@example.com", meetings[0].HostEmail)
+		assert.Equal(t, "u1", meetings[1].HostId)
+		assert.Empty(t, meetings[1].HostEmail)
+	}
+	assert.Equal(t, int32(1), meCalls.Load(), "failed lookup is not repeated")
+
+	c = NewZoomClient(config.Client{})
+	c.apiURL = ts.URL
+	c.token = &AccessToken{AccessToken: "token", ExpiresAt: time.Now().Add(time.Hour)}
+	meStatus.Store(http.StatusOK)
+	meetings, err := c.GetIntervalMeetings(context.Background(), time.Now(), time.Now())
+	require.NoError(t, err)
+	require.Len(t, meetings, 2)
+	assert.Equal(t, "host@example.com", meetings[0].HostEmail)
+	assert.Equal(t, "owner@example.com", meetings[1].HostEmail)
+}
+
+// Tests fetching the recordings of a single meeting against a fake Zoom API
+func Test_GetMeetingRecordings(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/meetings/%252Fab%252F%252Fcd%253D%253D/recordings":
+			w.Write([]byte(`{"uuid":"/ab//cd==","topic":"topic","recording_files":[{"id":"r1","download_url":"https://zoom.us/rec/download/fresh","file_size":123}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":3301,"message":"This recording does not exist."}`))
+		}
+	}))
+	defer ts.Close()
+
+	c := NewZoomClient(config.Client{})
+	c.apiURL = ts.URL
+	c.token = &AccessToken{AccessToken: "token", ExpiresAt: time.Now().Add(time.Hour)}
+
+	meeting, err := c.GetMeetingRecordings(context.Background(), "/ab//cd==")
+	require.NoError(t, err)
+	assert.Equal(t, "/ab//cd==", meeting.UUID)
+	require.Len(t, meeting.Records, 1)
+	assert.Equal(t, "https://zoom.us/rec/download/fresh", meeting.Records[0].DownloadURL)
+	assert.Equal(t, model.FileSize(123), meeting.Records[0].FileSize)
+
+	_, err = c.GetMeetingRecordings(context.Background(), "deleted")
+	assert.ErrorIs(t, err, ErrMeetingNotFound)
+}
+
+// Tests looking up the meeting in the trash of its host
+func Test_GetTrashedMeetingRecordings(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/users/u1/recordings" || q.Get("trash") != "true" || q.Get("trash_type") != "meeting_recordings" ||
+			q.Get("from") != "2024-03-09" || q.Get("to") != "2024-03-11" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"meetings":[{"uuid":"other"},{"uuid":"trashed","recording_files":[{"id":"r1","download_url":"https://zoom.us/rec/download/trashed"}]}]}`))
+	}))
+	defer ts.Close()
+
+	c := NewZoomClient(config.Client{})
+	c.apiURL = ts.URL
+	c.token = &AccessToken{AccessToken: "token", ExpiresAt: time.Now().Add(time.Hour)}
+
+	start := time.Date(2024, 3, 10, 12, 0, 0, 0, time.Local)
+	meeting, err := c.GetTrashedMeetingRecordings(context.Background(), "u1", "trashed", start)
+	require.NoError(t, err)
+	require.Len(t, meeting.Records, 1)
+	assert.Equal(t, "https://zoom.us/rec/download/trashed", meeting.Records[0].DownloadURL)
+
+	_, err = c.GetTrashedMeetingRecordings(context.Background(), "u1", "deleted", start)
+	assert.ErrorIs(t, err, ErrMeetingNotFound)
+}
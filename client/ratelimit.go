@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Category is a Zoom API rate limit category, APIs are grouped into categories
+// with progressively lower request rates
+// https://developers.zoom.us/docs/api/rest/rate-limits/
+type Category string
+
+const (
+	Light  Category = "light"
+	Medium Category = "medium"
+	Heavy  Category = "heavy"
+)
+
+const (
+	defaultMaxRetries = 5
+	maxBackoff        = 1 * time.Minute
+	// Retry-After longer than this (daily limit hit) is not waited for, ErrRateLimited is returned right away
+	maxRetryAfter = 10 * time.Minute
+)
+
+// baseBackoff is the delay before the first retry, doubled with every next one
+var baseBackoff = 1 * time.Second
+
+// ErrRateLimited is returned when Zoom API keeps responding with 429 or 5xx status
+// and the client gives up retrying
+type ErrRateLimited struct {
+	Category   Category
+	StatusCode int
+	RetryAfter time.Duration // as requested by Zoom, 0 if not known
+}
+
+func (e *ErrRateLimited) Error() string {
+	return fmt.Sprintf("zoom api rate limited (%s), status %d, retry after %s", e.Category, e.StatusCode, e.RetryAfter)
+}
+
+// limiter is a token bucket limiter, one token is added every interval, up to burst tokens.
+// Limiter can be blocked until some moment, when Zoom tells us to slow down
+type limiter struct {
+	mx           sync.Mutex
+	interval     time.Duration
+	burst        float64
+	tokens       float64
+	last         time.Time
+	blockedUntil time.Time
+}
+
+func newLimiter(interval time.Duration, burst int) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{interval: interval, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Wait blocks until a token is available or ctx is done
+func (l *limiter) Wait(ctx context.Context) error {
+	for {
+		delay := l.reserve(time.Now())
+		if delay <= 0 {
+			return nil
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// reserve takes a token and returns 0, or returns the time to wait for the next token
+func (l *limiter) reserve(now time.Time) time.Duration {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if now.Before(l.blockedUntil) {
+		return l.blockedUntil.Sub(now)
+	}
+	if l.interval <= 0 {
+		return 0
+	}
+
+	l.tokens += float64(now.Sub(l.last)) / float64(l.interval)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) * float64(l.interval))
+}
+
+// block makes Wait hold all requests until t
+func (l *limiter) block(t time.Time) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if t.After(l.blockedUntil) {
+		l.blockedUntil = t
+	}
+}
+
+// update reads X-RateLimit-Remaining and Retry-After headers of Zoom API response.
+// Returns the delay requested with Retry-After, 0 if there is none
+func (l *limiter) update(h http.Header) time.Duration {
+	retryAfter := parseRetryAfter(h.Get("Retry-After"), time.Now())
+	if retryAfter > 0 {
+		l.block(time.Now().Add(retryAfter))
+		return retryAfter
+	}
+	// per-second quota is used up, give it a second to refill
+	if h.Get("X-RateLimit-Remaining") == "0" {
+		l.block(time.Now().Add(time.Second))
+	}
+	return 0
+}
+
+// parseRetryAfter parses Retry-After header value, which is either delay in seconds or a date
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(v); err == nil {
+		return time.Duration(sec) * time.Second
+	}
+	for _, layout := range []string{http.TimeFormat, time.RFC3339, time.DateTime} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return max(t.Sub(now), 0)
+		}
+	}
+	return 0
+}
+
+// backoff returns exponential delay with jitter for the attempt (starting with 1),
+// but not shorter than retryAfter
+func backoff(attempt int, retryAfter time.Duration) time.Duration {
+	delay := min(baseBackoff<<(attempt-1), maxBackoff)
+	delay = max(delay, retryAfter)
+	return delay + rand.N(delay/2+1)
+}
+
+// do sends the request when the limiter of the category allows it. 429 and 5xx responses are retried
+// with jittered exponential backoff, ErrRateLimited is returned when retries are exhausted.
+// Response body must be closed by the caller
+func (z *ZoomClient) do(ctx context.Context, cat Category, req *http.Request) (*http.Response, error) {
+	lim, ok := z.limiters[cat]
+	if !ok {
+		return nil, fmt.Errorf("unknown rate limit category %s", cat)
+	}
+
+	maxRetries := z.cfg.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+
+	rateLimited := &ErrRateLimited{Category: cat}
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			delay := backoff(attempt, rateLimited.RetryAfter)
+			log.Printf("[WARN] %s %s: status %d, retry %d/%d in %s", req.Method, req.URL.Path, rateLimited.StatusCode, attempt, maxRetries, delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		if err := lim.Wait(ctx); err != nil {
+			return nil, err
+		}
+		resp, err := z.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		rateLimited.RetryAfter = lim.update(resp.Header)
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < http.StatusInternalServerError {
+			return resp, nil
+		}
+		rateLimited.StatusCode = resp.StatusCode
+
+		// drain the body to reuse the connection
+		_, _ = io.Copy(io.Discard, resp.Body)
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("[ERROR] failed to close response: %v", err)
+		}
+
+		if rateLimited.RetryAfter > maxRetryAfter {
+			break
+		}
+	}
+	return nil, rateLimited
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/go-pkgz/lgr"
@@ -16,7 +21,9 @@ import (
 	"github.com/parMaster/zoomrs/config"
 	"github.com/parMaster/zoomrs/repo"
 	"github.com/parMaster/zoomrs/storage"
+	"github.com/parMaster/zoomrs/storage/model"
 	"github.com/parMaster/zoomrs/storage/sqlite"
+	"github.com/parMaster/zoomrs/webauth"
 )
 
 type Commander struct {
@@ -42,18 +49,32 @@ func (s *Commander) Run(ctx context.Context, opts Options) error {
 		return err
 	}
 
+	if err := repo.CheckLayout(s.cfg.Storage.Layout); err != nil {
+		return fmt.Errorf("bad storage layout: %w", err)
+	}
+	if err := repo.CheckHooks(s.cfg.Download.Hooks); err != nil {
+		return fmt.Errorf("bad download hooks: %w", err)
+	}
 	r := repo.NewRepository(s.store, s.client, s.cfg)
 
 	switch opts.Cmd {
 	case "check":
-		log.Printf("[INFO] starting CheckConsistency")
-		checked, err := r.CheckConsistency(ctx)
+		log.Printf("[INFO] starting Check")
+		// JSON report to stdout, repairs are applied only with '--requeue', '--mark-unrecoverable', '--remove-empty-dirs'
+		report, err := r.Check(ctx, repo.CheckOptions{VerifyHash: opts.Hash, Requeue: opts.Requeue,
+			MarkUnrecoverable: opts.Unrecov, RemoveEmptyDirs: opts.RmDirs})
 		if err != nil {
-			err := fmt.Errorf("checkConsistency: %d, %w", checked, err)
-			return err
-		} else {
-			log.Printf("[INFO] CheckConsistency: OK, %d", checked)
+			return fmt.Errorf("check: %w", err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return fmt.Errorf("check: %w", err)
+		}
+		if n := report.Unrepaired(); n > 0 {
+			return fmt.Errorf("check: %d files checked, %d problems left", report.Checked, n)
 		}
+		log.Printf("[INFO] Check: OK, %d", report.Checked)
 	case "trash":
 		log.Printf("[INFO] starting CleanupJob")
 		// Run cleanup job. crontab line example:
@@ -112,32 +133,146 @@ func (s *Commander) Run(ctx context.Context, opts Options) error {
 			break
 		}
 
-		var lastError error
-		for {
-			select {
-			case <-ctx.Done():
-				return fmt.Errorf("downloading terminated early: %w", ctx.Err())
-			default:
+		if err := r.DownloadQueued(ctx); err != nil {
+			return err
+		}
+	case "backfill":
+		// sync (and download with '--download') meetings of the '--from' - '--to' days, chunk by chunk.
+		// Every synced chunk is saved as a checkpoint, interrupted backfill of the same range resumes from it
+		if err := s.backfill(ctx, r, opts); err != nil {
+			return fmt.Errorf("backfill: %w", err)
+		}
+	case "sync-reset":
+		// move the sync cursor back to '--from' day, so the sync job of the service re-syncs the days since then.
+		// without '--from' the cursor is deleted and the sync job starts with yesterday
+		if opts.From == "" {
+			if err := s.store.DeleteCursor(ctx, repo.SyncCursor); err != nil {
+				return fmt.Errorf("sync-reset: %w", err)
 			}
-			err = r.DownloadOnce(ctx)
-			if err == repo.ErrNoQueuedRecords {
-				if err == lastError {
-					log.Printf("[DEBUG] no queued records, exiting")
-					break
-				}
-				lastError = err
-				continue
+			log.Printf("[INFO] Sync cursor deleted")
+			break
+		}
+		if _, err := time.Parse(time.DateOnly, opts.From); err != nil {
+			return fmt.Errorf("sync-reset: '--from' should be YYYY-MM-DD: %w", err)
+		}
+		if err := s.store.SetCursor(ctx, repo.SyncCursor, opts.From); err != nil {
+			return fmt.Errorf("sync-reset: %w", err)
+		}
+		log.Printf("[INFO] Sync cursor set to %s", opts.From)
+	case "requeue":
+		// put abandoned records (the one with '--id' only, if set) back to the download queue
+		requeued, err := s.store.RequeueAbandoned(ctx, opts.Id)
+		if err != nil {
+			return fmt.Errorf("requeue: %w", err)
+		}
+		log.Printf("[INFO] Requeue: OK, %d records requeued", requeued)
+	case "hooks":
+		// run the post-download hooks failed after all retries again
+		retried, err := r.RunFailedHooks(ctx)
+		if err != nil {
+			return fmt.Errorf("hooks: %d retried, %w", retried, err)
+		}
+		log.Printf("[INFO] Hooks: OK, %d retried", retried)
+	case "restore":
+		// move the archived record '--id' back from storage.archive to storage.repository
+		if opts.Id == "" {
+			return fmt.Errorf("restore: '--id' option (record id) is not set")
+		}
+		if err := r.RestoreRecord(ctx, opts.Id); err != nil {
+			return fmt.Errorf("restore: %w", err)
+		}
+		log.Printf("[INFO] Restore: OK, record %s", opts.Id)
+	case "keep", "unkeep":
+		// flag the '--meeting' so its recordings are never evicted from the local storage, or clear the flag
+		if opts.Meeting == "" {
+			return fmt.Errorf("%s: '--meeting' option (meeting UUID) is not set", opts.Cmd)
+		}
+		if err := r.SetMeetingKeep(ctx, opts.Meeting, opts.Cmd == "keep"); err != nil {
+			return fmt.Errorf("%s: meeting %s: %w", opts.Cmd, opts.Meeting, err)
+		}
+		log.Printf("[INFO] %s: OK, meeting %s", opts.Cmd, opts.Meeting)
+	case "relayout":
+		// move the downloaded files to the paths of storage.layout, '--dry-run' only prints the moves
+		moves, err := r.Relayout(ctx, opts.DryRun)
+		for _, m := range moves {
+			fmt.Printf("%s -> %s\n", m.From, m.To)
+		}
+		if opts.DryRun {
+			log.Printf("[INFO] Relayout: dry run, %d files to move", len(moves))
+		} else {
+			log.Printf("[INFO] Relayout: %d files moved", len(moves))
+		}
+		if err != nil {
+			return fmt.Errorf("relayout: %w", err)
+		}
+	case "rebuild-db":
+		// recreate the meetings and records missing in the database from the sidecars (meeting.json) in the repository and the archive
+		meetings, records, err := r.RebuildDB(ctx)
+		if err != nil {
+			return fmt.Errorf("rebuild-db: %d meetings, %d records added, %w", meetings, records, err)
+		}
+		log.Printf("[INFO] Rebuild-db: OK, %d meetings, %d records added", meetings, records)
+	case "import":
+		// add the '--path' file or folder to the catalog as one meeting
+		if opts.Path == "" {
+			return fmt.Errorf("import: '--path' option (file or folder) is not set")
+		}
+		meta := repo.ImportMeta{MeetingId: opts.Meeting, Topic: opts.Topic, Type: model.RecordType(opts.Type), Move: opts.Move}
+		if opts.Start != "" {
+			if meta.StartTime, err = time.ParseInLocation(time.DateTime, opts.Start, time.Local); err != nil {
+				return fmt.Errorf("import: '--start' should be YYYY-MM-DD HH:MM:SS: %w", err)
 			}
-			if err != nil {
-				log.Printf("[ERROR] failed to download meetings, %v, retrying in 30 sec", err)
-				lastError = err
-				select {
-				case <-ctx.Done():
-					return fmt.Errorf("downloading terminated in the process: %w", ctx.Err())
-				case <-time.After(30 * time.Second):
-					continue
-				}
+		}
+		imported, err := r.Import(ctx, opts.Path, meta)
+		for _, rec := range imported {
+			fmt.Printf("%s %s -> %s\n", rec.MeetingId, rec.Id, rec.FilePath)
+		}
+		if err != nil {
+			return fmt.Errorf("import: %d files imported, %w", len(imported), err)
+		}
+		log.Printf("[INFO] Import: OK, %d files imported", len(imported))
+	case "orphans":
+		// list the files in the repository which are not tracked by any record
+		orphans, err := r.Orphans(ctx)
+		if err != nil {
+			return fmt.Errorf("orphans: %w", err)
+		}
+		switch opts.Format {
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(orphans)
+		case "table":
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "PATH\tSIZE\tMODIFIED")
+			for _, o := range orphans {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", o.Path, model.FileSize(o.Size), o.ModTime.Format(time.DateTime))
 			}
+			err = w.Flush()
+		default:
+			return fmt.Errorf("orphans: '--format' should be table or json, got %q", opts.Format)
+		}
+		if err != nil {
+			return fmt.Errorf("orphans: %w", err)
+		}
+	case "reconcile":
+		// compare the Zoom cloud recordings with the local catalog, '--queue' queues the missing ones
+		report, err := r.Reconcile(ctx, opts.Queue)
+		if err != nil {
+			return fmt.Errorf("reconcile: %w", err)
+		}
+		switch opts.Format {
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(report)
+		case "table":
+			err = report.WriteTable(os.Stdout)
+		default:
+			return fmt.Errorf("reconcile: '--format' should be table or json, got %q", opts.Format)
+		}
+		if err != nil {
+			return fmt.Errorf("reconcile: %w", err)
 		}
 	default:
 		s.ShowUI()
@@ -147,6 +282,68 @@ func (s *Commander) Run(ctx context.Context, opts Options) error {
 	return nil
 }
 
+// backfill syncs meetings of opts.From - opts.To days in chunks of opts.Chunk days,
+// the last synced day is saved to the "backfill:<from>:<to>" cursor, <to> is "open" if '--to' is not set,
+// so the open-ended backfill resumes on another day too
+func (s *Commander) backfill(ctx context.Context, r *repo.Repository, opts Options) error {
+	from, err := time.ParseInLocation(time.DateOnly, opts.From, time.Local)
+	if err != nil {
+		return fmt.Errorf("'--from' should be YYYY-MM-DD: %w", err)
+	}
+	to := time.Now()
+	if opts.To != "" {
+		if to, err = time.ParseInLocation(time.DateOnly, opts.To, time.Local); err != nil {
+			return fmt.Errorf("'--to' should be YYYY-MM-DD: %w", err)
+		}
+	}
+	if to.Before(from) {
+		return fmt.Errorf("'--to' %s is before '--from' %s", to.Format(time.DateOnly), opts.From)
+	}
+	if opts.Chunk <= 0 {
+		return fmt.Errorf("'--chunk' should be positive")
+	}
+	if len(r.Syncable.Important)+len(r.Syncable.Alternative)+len(r.Syncable.Optional) == 0 {
+		return fmt.Errorf("no sync types configured")
+	}
+
+	toKey := "open"
+	if opts.To != "" {
+		toKey = to.Format(time.DateOnly)
+	}
+	cursor := fmt.Sprintf("backfill:%s:%s", from.Format(time.DateOnly), toKey)
+	checkpoint, err := s.store.GetCursor(ctx, cursor)
+	if err != nil && err != storage.ErrNoRows {
+		return err
+	}
+	if err == nil {
+		last, err := time.ParseInLocation(time.DateOnly, checkpoint, time.Local)
+		if err != nil {
+			return fmt.Errorf("failed to parse checkpoint %q: %w", checkpoint, err)
+		}
+		from = last.AddDate(0, 0, 1)
+		log.Printf("[INFO] resuming backfill from checkpoint %s", checkpoint)
+	}
+
+	for start := from; !start.After(to); start = start.AddDate(0, 0, opts.Chunk) {
+		end := start.AddDate(0, 0, opts.Chunk-1)
+		if end.After(to) {
+			end = to
+		}
+		log.Printf("[INFO] backfill %s - %s", start.Format(time.DateOnly), end.Format(time.DateOnly))
+		if err := r.SyncRange(ctx, start, end, cursor); err != nil {
+			return err
+		}
+		if opts.Download {
+			if err := r.DownloadQueued(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Printf("[INFO] backfill %s - %s done", opts.From, to.Format(time.DateOnly))
+	return s.store.DeleteCursor(ctx, cursor)
+}
+
 func LoadStorage(ctx context.Context, cfg config.Storage, s *storage.Storer) error {
 	var err error
 	switch cfg.Type {
@@ -164,11 +361,29 @@ func LoadStorage(ctx context.Context, cfg config.Storage, s *storage.Storer) err
 }
 
 type Options struct {
-	Config string `long:"config" env:"CONFIG" default:"config_cli.yml" description:"yaml config file name"`
-	Days   int    `long:"days" env:"DEBUG" description:"(today - 'days') day to sync. Default is 1 (yesterday)" default:"1"`
-	Dbg    bool   `long:"dbg" env:"DEBUG" description:"show debug info"`
-	Trash  int    `long:"trash" description:"trash old meetings after N days. Required when '--cmd=trash'" default:"-1"`
-	Cmd    string `long:"cmd" description:"run command"`
+	Config   string `long:"config" env:"CONFIG" default:"config_cli.yml" description:"yaml config file name"`
+	Days     int    `long:"days" env:"DEBUG" description:"(today - 'days') day to sync. Default is 1 (yesterday)" default:"1"`
+	Dbg      bool   `long:"dbg" env:"DEBUG" description:"show debug info"`
+	Trash    int    `long:"trash" description:"trash old meetings after N days. Required when '--cmd=trash'" default:"-1"`
+	Cmd      string `long:"cmd" description:"run command"`
+	Hash     bool   `long:"hash" description:"verify SHA-256 of the downloaded files. Used with '--cmd=check'"`
+	Requeue  bool   `long:"requeue" description:"requeue the records with broken files still in the cloud. Used with '--cmd=check'"`
+	Unrecov  bool   `long:"mark-unrecoverable" description:"mark the records with broken files not in the cloud anymore as unrecoverable. Used with '--cmd=check'"`
+	RmDirs   bool   `long:"remove-empty-dirs" description:"remove empty folders from the repository. Used with '--cmd=check'"`
+	Id       string `long:"id" description:"record id. '--cmd=requeue': record to requeue, all abandoned records are requeued if not set. '--cmd=restore': archived record to restore"`
+	From     string `long:"from" description:"YYYY-MM-DD day. '--cmd=sync-reset': day to move the sync cursor to, the cursor is deleted if not set. '--cmd=backfill': first day to sync"`
+	To       string `long:"to" description:"YYYY-MM-DD last day to sync. Used with '--cmd=backfill', today if not set"`
+	Chunk    int    `long:"chunk" description:"days synced at once. Used with '--cmd=backfill'" default:"30"`
+	Download bool   `long:"download" description:"download queued recordings after every synced chunk. Used with '--cmd=backfill'"`
+	Format   string `long:"format" description:"report format: table or json. Used with '--cmd=reconcile' and '--cmd=orphans'" default:"table"`
+	Queue    bool   `long:"queue" description:"queue recordings missing in the local catalog. Used with '--cmd=reconcile'"`
+	Meeting  string `long:"meeting" description:"meeting UUID. Required when '--cmd=keep' or '--cmd=unkeep'. '--cmd=import': meeting to add the files to"`
+	Path     string `long:"path" description:"file or folder to import. Required when '--cmd=import'"`
+	Topic    string `long:"topic" description:"topic of the imported meeting. Used with '--cmd=import'"`
+	Start    string `long:"start" description:"'YYYY-MM-DD HH:MM:SS' start time of the imported meeting, modification time of the file if not set. Used with '--cmd=import'"`
+	Type     string `long:"type" description:"recording type of the imported files, guessed by the extension if not set (mp4, m4a, txt). Used with '--cmd=import'"`
+	Move     bool   `long:"move" description:"move the imported files instead of copying. Used with '--cmd=import'"`
+	DryRun   bool   `long:"dry-run" description:"print the planned moves without moving the files. Used with '--cmd=relayout'"`
 }
 
 func main() {
@@ -184,6 +399,24 @@ func main() {
 		os.Exit(2)
 	}
 
+	// hash of the password read from stdin, for server.dev_auth.users, doesn't need the config
+	if opts.Cmd == "hash-password" {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			log.Fatalf("[ERROR] can't read password, %s", err)
+		}
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			log.Fatalf("[ERROR] password is empty")
+		}
+		hash, err := webauth.HashPassword(password)
+		if err != nil {
+			log.Fatalf("[ERROR] can't hash password, %s", err)
+		}
+		fmt.Println(hash)
+		os.Exit(0)
+	}
+
 	var conf *config.Parameters
 	if opts.Config != "" {
 		var err error
@@ -202,6 +435,9 @@ func main() {
 		lgr.StackTraceOnError,
 		lgr.Secret(conf.Client.AccountId, conf.Client.Id, conf.Client.Secret, conf.Server.OAuthClientId, conf.Server.OAuthClientSecret, conf.Server.JWTSecret),
 	}
+	if conf.Storage.ArchiveS3.SecretKey != "" {
+		logOpts = append(logOpts, lgr.Secret(conf.Storage.ArchiveS3.SecretKey))
+	}
 	if conf.Server.Dbg {
 		logOpts = append(logOpts, lgr.Debug)
 	}
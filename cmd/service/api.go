@@ -2,19 +2,27 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-pkgz/auth/token"
 	"github.com/go-pkgz/rest"
+	"github.com/parMaster/zoomrs/blob"
+	"github.com/parMaster/zoomrs/repo"
 	"github.com/parMaster/zoomrs/storage"
 	"github.com/parMaster/zoomrs/storage/model"
 	"github.com/parMaster/zoomrs/web"
@@ -30,25 +38,57 @@ func (s *Server) router(ctx context.Context) http.Handler {
 	router.Mount("/auth", authRoutes)
 	router.Mount("/avatar", avaRoutes)
 
-	// Private routes
+	// Private routes, allowed to the users with the role (see userRole) or a higher one
 	m := s.authService.Middleware()
+	manager, admin := s.requireRole(model.RoleManager), s.requireRole(model.RoleAdmin)
+
+	// viewers list all the meetings, hosts without a role - their own meetings
 	router.With(m.Auth).Get("/listMeetings", s.listMeetings(ctx))
 
+	// the page redirects to the login if the user is not logged in, the token is valid for the users with a role only
 	router.With(m.Trace).Get("/", s.indexPageHandler)
 
-	router.With(m.Auth).Route("/stats", func(r chi.Router) {
+	router.With(m.Auth, manager).Route("/stats", func(r chi.Router) {
 		r.Get("/{divider}", s.statsHandler(ctx))
 		r.Get("/", s.statsHandler(ctx))
 	})
 
 	router.Post("/meetingsLoaded/{accessKey}", s.meetingsLoadedHandler(ctx))
 
-	router.With(m.Auth).Get("/check", s.checkConsistencyHandler(ctx))
+	router.Post("/webhook", s.webhookHandler(ctx))
+
+	// reports are for managers, repairs - for admins
+	router.With(m.Auth, manager).Route("/check", func(r chi.Router) {
+		r.Get("/", s.checkConsistencyHandler(ctx, false))
+		r.With(admin).Post("/", s.checkConsistencyHandler(ctx, true))
+	})
+
+	router.With(m.Auth, manager).Route("/reconcile", func(r chi.Router) {
+		r.Get("/", s.reconcileHandler(ctx, false))
+		r.With(admin).Post("/", s.reconcileHandler(ctx, true))
+	})
+
+	router.With(m.Auth, manager).Get("/orphans", s.orphansHandler(ctx))
+	router.With(m.Auth, manager).Get("/abandoned", s.abandonedHandler(ctx))
+	router.With(m.Auth, manager).Post("/import", s.importHandler(ctx))
+
+	// managers share any meeting, hosts - their own meetings
+	router.With(m.Auth).Route("/shareLinks", func(r chi.Router) {
+		r.Get("/", s.listShareLinksHandler(ctx))
+		r.Post("/", s.createShareLinkHandler(ctx))
+		r.Delete("/{id}", s.revokeShareLinkHandler(ctx))
+	})
+
+	router.With(m.Auth, admin).Route("/roles", func(r chi.Router) {
+		r.Get("/", s.listRolesHandler(ctx))
+		r.Put("/{email}", s.setRoleHandler(ctx))
+		r.Delete("/{email}", s.deleteRoleHandler(ctx))
+	})
 
 	// Public routes
 	router.Get("/status", s.statusHandler(ctx))
 
-	router.Get("/watchMeeting/{accessKey}", s.watchMeetingHandler(ctx))
+	router.With(m.Trace).Get("/watchMeeting/{accessKey}", s.watchMeetingHandler(ctx))
 	router.Get("/watch/{accessKey}", s.watchHandler)
 
 	router.Get("/login", func(rw http.ResponseWriter, r *http.Request) {
@@ -60,8 +100,8 @@ func (s *Server) router(ctx context.Context) http.Handler {
 		s.respondWithFile("web/favicon.ico", rw)
 	})
 
-	fs := http.FileServer(http.Dir(s.cfg.Storage.Repository))
-	router.Handle("/"+s.cfg.Storage.Repository+"/*", http.StripPrefix("/"+s.cfg.Storage.Repository, filesOnly(fs)))
+	// recordings, downloaded and archived, are served by the signed urls given to the watch page
+	router.Get("/media/{id}", s.mediaHandler(ctx))
 
 	return router
 }
@@ -118,12 +158,14 @@ func (s *Server) statusHandler(ctx context.Context) func(rw http.ResponseWriter,
 
 		_, qok := stats[model.StatusQueued]
 		_, fok := stats[model.StatusFailed]
+		_, cok := stats[model.StatusCorrupt]
 		_, dok := stats[model.StatusDownloading]
+		_, aok := stats[model.StatusAbandoned]
 
 		var status string
 		if qok || dok {
 			status = "LOADING"
-		} else if fok && !dok && !qok {
+		} else if (fok || cok || aok) && !dok && !qok {
 			status = "FAILED"
 		} else {
 			status = "OK"
@@ -134,6 +176,11 @@ func (s *Server) statusHandler(ctx context.Context) func(rw http.ResponseWriter,
 			"stats":  stats,
 		}
 
+		// the last day synced by the sync job
+		if cursor, err := s.store.GetCursor(ctx, repo.SyncCursor); err == nil {
+			resp["sync_cursor"] = cursor
+		}
+
 		var lastDownloadedMeeting model.Meeting
 		cachedLast, err := s.cache.Get("lastDownloadedMeeting")
 		if err != nil {
@@ -158,7 +205,7 @@ func (s *Server) statusHandler(ctx context.Context) func(rw http.ResponseWriter,
 		if err != nil {
 			log.Printf("[DEBUG] miss")
 
-			cloudStorageReport, err = s.client.GetCloudStorageReport(time.Now().AddDate(0, 0, -7).Format("2006-01-02"), time.Now().Format("2006-01-02"))
+			cloudStorageReport, err = s.client.GetCloudStorageReport(r.Context(), time.Now().AddDate(0, 0, -7).Format("2006-01-02"), time.Now().Format("2006-01-02"))
 			if err != nil {
 				log.Printf("[ERROR] failed to get cloud storage report, %v", err)
 				rw.WriteHeader(http.StatusInternalServerError)
@@ -188,19 +235,57 @@ func (s *Server) statusHandler(ctx context.Context) func(rw http.ResponseWriter,
 			resp["cloud"] = cloud
 		}
 
-		// disk storage stats
-		diskStorageReport, err := disk.Usage(s.cfg.Storage.Repository)
-		if err != nil {
-			log.Printf("[ERROR] failed to get disk storage report, %v", err)
-			rw.WriteHeader(http.StatusInternalServerError)
-			return
+		// disk storage stats, totals of all the roots, drives shared by several roots are counted once
+		var total, free, used uint64
+		drives := map[[3]uint64]bool{}
+		roots := map[string]any{}
+		for _, root := range s.cfg.Storage.Roots() {
+			diskStorageReport, err := disk.Usage(root)
+			if err != nil {
+				log.Printf("[ERROR] failed to get disk storage report of %s, %v", root, err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			roots[root] = map[string]any{
+				"total":         model.FileSize(diskStorageReport.Total),
+				"free":          model.FileSize(diskStorageReport.Free),
+				"used":          model.FileSize(diskStorageReport.Used),
+				"usage_percent": int(diskStorageReport.UsedPercent),
+			}
+			drive := [3]uint64{diskStorageReport.Total, diskStorageReport.Free, diskStorageReport.Used}
+			if !drives[drive] {
+				drives[drive] = true
+				total, free, used = total+diskStorageReport.Total, free+diskStorageReport.Free, used+diskStorageReport.Used
+			}
 		}
 
+		usagePercent := 0
+		if used+free > 0 {
+			usagePercent = int(float64(used) / float64(used+free) * 100)
+		}
 		resp["storage"] = map[string]any{
-			"total":         model.FileSize(diskStorageReport.Total),
-			"free":          model.FileSize(diskStorageReport.Free),
-			"used":          model.FileSize(diskStorageReport.Used),
-			"usage_percent": int(diskStorageReport.UsedPercent),
+			"total":         model.FileSize(total),
+			"free":          model.FileSize(free),
+			"used":          model.FileSize(used),
+			"usage_percent": usagePercent,
+		}
+		if len(roots) > 1 {
+			resp["roots"] = roots
+		}
+
+		if archive, ok := s.repo.Archive.(*blob.Local); ok {
+			archiveReport, err := disk.Usage(archive.Root())
+			if err != nil {
+				log.Printf("[ERROR] failed to get archive storage report, %v", err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			resp["archive"] = map[string]any{
+				"total":         model.FileSize(archiveReport.Total),
+				"free":          model.FileSize(archiveReport.Free),
+				"used":          model.FileSize(archiveReport.Used),
+				"usage_percent": int(archiveReport.UsedPercent),
+			}
 		}
 
 		rw.Header().Set("Content-Type", "application/json")
@@ -229,14 +314,32 @@ func (s *Server) listMeetings(ctx context.Context) func(rw http.ResponseWriter,
 			return
 		}
 
-		// mix in an accessKey for each meeting to be used in watchMeeting
-		for i := range m {
+		// users without viewer role see the meetings they hosted only
+		role, err := s.userRole(ctx, userInfo)
+		if err != nil {
+			log.Printf("[ERROR] failed to get role of %s, %v", userInfo.Email, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !role.Allows(model.RoleViewer) {
+			m = slices.DeleteFunc(m, func(meeting model.Meeting) bool {
+				return !isHost(userInfo, &meeting)
+			})
+		}
 
-			s := fmt.Sprintf("%s%s", m[i].UUID, s.cfg.Server.AccessKeySalt)
-			h := md5.New()
-			io.WriteString(h, s)
-			m[i].AccessKey = fmt.Sprintf("%x", h.Sum(nil))
-			// log.Printf("[DEBUG] salted uuid: %s, accessKey: %s", s, m[i].AccessKey)
+		// optional filter by host email
+		if host := r.URL.Query().Get("host"); host != "" {
+			m = slices.DeleteFunc(m, func(meeting model.Meeting) bool {
+				return !strings.EqualFold(meeting.HostEmail, host)
+			})
+		}
+
+		// mix in the legacy accessKey for each meeting to be used in watchMeeting, share links are created in /shareLinks otherwise.
+		// Sharing is for managers and the host of the meeting
+		for i := range m {
+			if s.cfg.Server.LegacyShareLinks && (role.Allows(model.RoleManager) || isHost(userInfo, &m[i])) {
+				m[i].AccessKey = fmt.Sprintf("%x", md5.Sum([]byte(m[i].UUID+s.cfg.Server.AccessKeySalt)))
+			}
 		}
 
 		resp := map[string]any{
@@ -248,25 +351,20 @@ func (s *Server) listMeetings(ctx context.Context) func(rw http.ResponseWriter,
 
 func (s *Server) watchMeetingHandler(ctx context.Context) func(rw http.ResponseWriter, r *http.Request) {
 	return func(rw http.ResponseWriter, r *http.Request) {
-		// uuid is get parameter
+		// accessKey is the share link token, or the legacy key with uuid get parameter
 		accessKey := chi.URLParam(r, "accessKey")
 		uuid := r.URL.Query().Get("uuid")
 		log.Printf("[INFO] /watchMeeting/%s?uuid=%s (%s)", accessKey, uuid, r.Header.Get("X-Real-Ip"))
 
-		if accessKey == "" || uuid == "" {
+		if accessKey == "" {
 			rw.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
 		// check accessKey
-		h := md5.New()
-		saltedUUID := uuid + s.cfg.Server.AccessKeySalt
-		log.Printf("[DEBUG] salted uuid: %s", saltedUUID)
-		io.WriteString(h, saltedUUID)
-		key := fmt.Sprintf("%x", h.Sum(nil))
-		log.Printf("[DEBUG] accessKey: %s, key: %s", accessKey, key)
-		if accessKey != key {
-			rw.WriteHeader(http.StatusForbidden)
+		uuid, link, status := s.sharedMeeting(ctx, rw, r, accessKey)
+		if status != http.StatusOK {
+			rw.WriteHeader(status)
 			return
 		}
 
@@ -288,14 +386,24 @@ func (s *Server) watchMeetingHandler(ctx context.Context) func(rw http.ResponseW
 			rw.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		// cleanup records of columns FileExtension, DownloadURL, PlayURL
+		// cleanup records of columns FileExtension, DownloadURL, PlayURL and the repository paths,
+		// the files are served by the signed urls only
+		now := time.Now()
 		for i := range records {
+			if records[i].Status == model.StatusDownloaded || records[i].Status == model.StatusArchived {
+				records[i].MediaURL = s.mediaURL(records[i].Id, link, now)
+			}
 			records[i].FileExtension = ""
 			records[i].DownloadURL = ""
 			records[i].PlayURL = ""
+			records[i].FilePath = ""
+			records[i].Root = ""
 		}
 
 		log.Printf("[INFO] /watchMeeting granted")
+		if err := s.store.SetMeetingWatched(ctx, meeting.UUID, time.Now()); err != nil {
+			log.Printf("[WARN] failed to save meeting %s watched, %v", meeting.UUID, err)
+		}
 
 		resp := map[string]any{
 			"meeting": meeting,
@@ -332,18 +440,6 @@ func (s *Server) statsHandler(ctx context.Context) func(rw http.ResponseWriter,
 	}
 }
 
-// filesOnly is a middleware to allow only files to be served, no directory listings allowed
-func filesOnly(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasSuffix(r.URL.Path, "/") {
-			http.NotFound(w, r)
-			return
-		}
-		log.Printf("[INFO] %s (%s)", r.URL.Path, r.Header.Get("X-Real-Ip"))
-		next.ServeHTTP(w, r)
-	})
-}
-
 // meetingsLoadedHandler is called to ask if every meeting from the list is loaded
 // list is passed as a JSON array of UUIDs in the request body
 // response is result:ok or result:pending
@@ -357,7 +453,8 @@ func (s *Server) meetingsLoadedHandler(ctx context.Context) func(rw http.Respons
 		}
 
 		type req struct {
-			Meetings []string `json:"meetings"`
+			Meetings   []string `json:"meetings"`
+			VerifyHash bool     `json:"verify_hash"` // check SHA-256 of the files, not only the size
 		}
 		var uuids req
 		r.Body = http.MaxBytesReader(rw, r.Body, int64(1<<22)) // 4MB
@@ -389,20 +486,18 @@ func (s *Server) meetingsLoadedHandler(ctx context.Context) func(rw http.Respons
 			log.Printf("[DEBUG] Checking recs: \r\n %+v", recs)
 			for _, rec := range recs {
 
-				if rec.Status != model.StatusDownloaded {
+				if rec.Status != model.StatusDownloaded && rec.Status != model.StatusArchived {
 					resp["result"] = "pending"
 					log.Printf("[DEBUG] Pending caused by status %s - %s", rec.Id, rec.Status)
 					json.NewEncoder(rw).Encode(resp)
 					return
 				}
 
-				if info, err := os.Stat(rec.FilePath); err == nil {
-					if info.Size() != int64(rec.FileSize) {
-						resp["result"] = "pending"
-						log.Printf("[DEBUG] Pending caused by filesize %s - %d", rec.Id, rec.FileSize)
-						json.NewEncoder(rw).Encode(resp)
-						return
-					}
+				if err := s.repo.VerifyFile(ctx, rec, uuids.VerifyHash); err != nil {
+					resp["result"] = "pending"
+					log.Printf("[DEBUG] Pending caused by failed verification %s - %v", rec.Id, err)
+					json.NewEncoder(rw).Encode(resp)
+					return
 				}
 			}
 		}
@@ -413,12 +508,267 @@ func (s *Server) meetingsLoadedHandler(ctx context.Context) func(rw http.Respons
 	}
 }
 
-// checkConsistencyHandler is called to check if every record has a corresponding file and file size is correct
-func (s *Server) checkConsistencyHandler(ctx context.Context) func(rw http.ResponseWriter, r *http.Request) {
+// checkConsistencyHandler checks if every record has a corresponding file with correct size and looks for
+// the folders without records, '?hash=true' verifies SHA-256 as well. POST applies the repairs enabled by
+// '?requeue=true', '?mark_unrecoverable=true' and '?remove_empty_dirs=true'. Responds with the JSON report
+func (s *Server) checkConsistencyHandler(ctx context.Context, repair bool) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		// hashing every file takes longer than the server WriteTimeout
+		if err := http.NewResponseController(rw).SetWriteDeadline(time.Now().Add(30 * time.Minute)); err != nil {
+			log.Printf("[WARN] failed to extend write deadline, %v", err)
+		}
+		q := r.URL.Query()
+		opts := repo.CheckOptions{}
+		opts.VerifyHash, _ = strconv.ParseBool(q.Get("hash"))
+		if repair {
+			opts.Requeue, _ = strconv.ParseBool(q.Get("requeue"))
+			opts.MarkUnrecoverable, _ = strconv.ParseBool(q.Get("mark_unrecoverable"))
+			opts.RemoveEmptyDirs, _ = strconv.ParseBool(q.Get("remove_empty_dirs"))
+		}
+		report, err := s.repo.Check(ctx, opts)
+		if err != nil {
+			log.Printf("[ERROR] Check failed, %v", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(report)
+	}
+}
+
+// reconcileHandler compares the Zoom cloud recordings with the local catalog, POST queues the missing ones.
+// The report is JSON, or a text table with '?format=table'
+func (s *Server) reconcileHandler(ctx context.Context, queue bool) func(rw http.ResponseWriter, r *http.Request) {
 	return func(rw http.ResponseWriter, r *http.Request) {
-		checked, err := s.repo.CheckConsistency(ctx)
-		response := map[string]any{"checked": checked, "error": err}
+		// listing all the cloud meetings takes longer than the server WriteTimeout
+		if err := http.NewResponseController(rw).SetWriteDeadline(time.Now().Add(10 * time.Minute)); err != nil {
+			log.Printf("[WARN] failed to extend write deadline, %v", err)
+		}
+		report, err := s.repo.Reconcile(ctx, queue)
+		if err != nil {
+			log.Printf("[ERROR] Reconcile failed, %v", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Query().Get("format") == "table" {
+			rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			report.WriteTable(rw)
+			return
+		}
 		rw.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(rw).Encode(response)
+		json.NewEncoder(rw).Encode(report)
+	}
+}
+
+// orphansHandler lists the files in the repository which are not tracked by any record
+func (s *Server) orphansHandler(ctx context.Context) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		orphans, err := s.repo.Orphans(ctx)
+		if err != nil {
+			log.Printf("[ERROR] Orphans failed, %v", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]any{"orphans": orphans})
+	}
+}
+
+// abandonedHandler lists the records that failed too many times, waiting to be requeued manually.
+// Last errors contain the download urls, so the list is for managers, /status shows the number only
+func (s *Server) abandonedHandler(ctx context.Context) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		abandoned, err := s.store.GetRecordsByStatus(ctx, model.StatusAbandoned)
+		if err != nil {
+			log.Printf("[ERROR] failed to get abandoned records, %v", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		type abandonedRecord struct {
+			Id        string `json:"id"`
+			MeetingId string `json:"meeting_id"`
+			DateTime  string `json:"date_time"`
+			Attempts  int    `json:"attempts"`
+			LastError string `json:"last_error"`
+		}
+		list := []abandonedRecord{}
+		for _, rec := range abandoned {
+			list = append(list, abandonedRecord{rec.Id, rec.MeetingId, rec.DateTime, rec.Attempts, rec.LastError})
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]any{"abandoned": list})
+	}
+}
+
+// importHandler imports the uploaded recording file. The body is a multipart form with the meeting fields:
+// "meeting" (UUID of the existing meeting), "topic", "start_time" (YYYY-MM-DD HH:MM:SS), "type",
+// followed by the "file" field with the file. Content-Length of the request is required, it limits the size
+// of the file. Responds with the imported records
+func (s *Server) importHandler(ctx context.Context) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.ContentLength <= 0 {
+			http.Error(rw, "Content-Length is required", http.StatusLengthRequired)
+			return
+		}
+		// uploading a recording takes longer than the server timeouts
+		rc := http.NewResponseController(rw)
+		if err := rc.SetReadDeadline(time.Now().Add(time.Hour)); err != nil {
+			log.Printf("[WARN] failed to extend read deadline, %v", err)
+		}
+		if err := rc.SetWriteDeadline(time.Now().Add(time.Hour)); err != nil {
+			log.Printf("[WARN] failed to extend write deadline, %v", err)
+		}
+
+		mr, err := r.MultipartReader()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		meta := repo.ImportMeta{}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				http.Error(rw, "no file in the form", http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if part.FormName() == "file" {
+				userInfo, _ := token.GetUserInfo(r)
+				log.Printf("[INFO] /import: %s by %s (%s)", part.FileName(), userInfo.Email, r.Header.Get("X-Real-Ip"))
+				imported, err := s.repo.ImportReader(ctx, part.FileName(), part, r.ContentLength, meta)
+				if err != nil {
+					log.Printf("[ERROR] Import of %s failed, %v", part.FileName(), err)
+					status := http.StatusInternalServerError
+					switch {
+					case errors.Is(err, repo.ErrInvalidImport):
+						status = http.StatusBadRequest
+					case errors.Is(err, repo.ErrPathTaken):
+						status = http.StatusConflict
+					case errors.Is(err, repo.ErrNoSpace):
+						status = http.StatusInsufficientStorage
+					}
+					http.Error(rw, err.Error(), status)
+					return
+				}
+				rw.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(rw).Encode(map[string]any{"data": imported})
+				return
+			}
+
+			value, err := io.ReadAll(io.LimitReader(part, 1024))
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			switch part.FormName() {
+			case "meeting":
+				meta.MeetingId = string(value)
+			case "topic":
+				meta.Topic = string(value)
+			case "type":
+				meta.Type = model.RecordType(value)
+			case "start_time":
+				if meta.StartTime, err = time.ParseInLocation(time.DateTime, string(value), time.Local); err != nil {
+					http.Error(rw, "start_time should be YYYY-MM-DD HH:MM:SS", http.StatusBadRequest)
+					return
+				}
+			}
+		}
+	}
+}
+
+// webhookHandler receives Zoom event notifications. Every request is verified with x-zm-signature,
+// endpoint.url_validation challenge is answered, recording.completed and recording.trashed meetings
+// are passed through SyncMeetings, so they are queued right away instead of waiting for the SyncJob.
+// recording.deleted recordings are gone from the cloud, their queued records are marked lost
+func (s *Server) webhookHandler(ctx context.Context) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if s.cfg.Server.WebhookSecret == "" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(rw, r.Body, int64(1<<22)) // 4MB
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("[ERROR] failed to read webhook body, %v", err)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		timestamp := r.Header.Get("x-zm-request-timestamp")
+		if !validWebhookSignature(s.cfg.Server.WebhookSecret, timestamp, body, r.Header.Get("x-zm-signature")) {
+			log.Printf("[WARN] /webhook: invalid signature (%s)", r.Header.Get("X-Real-Ip"))
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// reject replayed requests, Zoom sends the timestamp in seconds
+		if ts, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(ts, 0)).Abs() > 5*time.Minute {
+			log.Printf("[WARN] /webhook: stale timestamp %s (%s)", timestamp, r.Header.Get("X-Real-Ip"))
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var event model.WebhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			log.Printf("[ERROR] failed to decode webhook body, %v", err)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		log.Printf("[INFO] /webhook: %s", event.Event)
+
+		switch event.Event {
+		case "endpoint.url_validation":
+			mac := hmac.New(sha256.New, []byte(s.cfg.Server.WebhookSecret))
+			mac.Write([]byte(event.Payload.PlainToken))
+			resp := map[string]string{
+				"plainToken":     event.Payload.PlainToken,
+				"encryptedToken": hex.EncodeToString(mac.Sum(nil)),
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(resp)
+			return
+		case "recording.completed", "recording.trashed":
+			// trashed recordings can still be downloaded until they are deleted permanently
+			meeting := event.Payload.Object
+			for i := range meeting.Records {
+				if meeting.Records[i].MeetingId == "" {
+					meeting.Records[i].MeetingId = meeting.UUID
+				}
+			}
+			meetings := []model.Meeting{meeting}
+			if err := s.repo.SyncMeetings(ctx, &meetings); err != nil {
+				log.Printf("[ERROR] failed to sync meeting %s from webhook, %v", meeting.UUID, err)
+				// non-2xx response makes Zoom retry the notification
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		case "recording.deleted":
+			// permanently deleted recordings can't be downloaded, the queued ones are lost
+			lost, err := s.repo.MarkMeetingLost(ctx, event.Payload.Object.UUID)
+			if err != nil {
+				log.Printf("[ERROR] failed to mark meeting %s lost from webhook, %v", event.Payload.Object.UUID, err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			log.Printf("[INFO] /webhook: recordings of meeting %s are deleted from the cloud, %d records lost", event.Payload.Object.UUID, lost)
+		default:
+			log.Printf("[DEBUG] /webhook: ignoring event %s", event.Event)
+		}
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// validWebhookSignature checks x-zm-signature header, which is "v0=" + hex(HMAC-SHA256(secret, "v0:{timestamp}:{body}"))
+func validWebhookSignature(secret, timestamp string, body []byte, signature string) bool {
+	if timestamp == "" || signature == "" {
+		return false
 	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
 }
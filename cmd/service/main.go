@@ -33,17 +33,17 @@ type Server struct {
 	authService *auth.Service
 	repo        *repo.Repository
 	cache       mcache.Cacher
+	shareFails  failLimiter // wrong passwords of the share links
 }
 
 func NewServer(conf *config.Parameters) *Server {
-	client := client.NewZoomClient(conf.Client)
-	authService, err := webauth.NewAuthService(conf.Server)
+	s := &Server{cfg: conf, client: client.NewZoomClient(conf.Client), cache: mcache.NewCache()}
+	authService, err := webauth.NewAuthService(conf.Server, s.canLogin)
 	if err != nil {
 		log.Fatalf("[ERROR] failed to init auth service: %e", err)
 	}
-	cache := mcache.NewCache()
-
-	return &Server{cfg: conf, client: client, authService: authService, cache: cache}
+	s.authService = authService
+	return s
 }
 
 func LoadStorage(ctx context.Context, cfg config.Storage, s *storage.Storer) error {
@@ -69,11 +69,26 @@ func (s *Server) Run(ctx context.Context) {
 		log.Fatalf("[ERROR] failed to init storage: %e", err)
 	}
 
+	if err := repo.CheckLayout(s.cfg.Storage.Layout); err != nil {
+		log.Fatalf("[ERROR] bad storage layout: %e", err)
+	}
+	if err := repo.CheckHooks(s.cfg.Download.Hooks); err != nil {
+		log.Fatalf("[ERROR] bad download hooks: %e", err)
+	}
 	s.repo = repo.NewRepository(s.store, s.client, s.cfg)
 
 	log.Printf("[INFO] starting server at %s", s.cfg.Server.Listen)
 	go s.startServer(ctx)
 
+	if s.cfg.Server.DevAuth.Enabled {
+		log.Printf("[WARN] dev login provider is enabled, anyone can log in with any email")
+		go func() {
+			if err := webauth.RunDevAuth(ctx, s.authService); err != nil {
+				log.Printf("[ERROR] failed to run dev auth server: %v", err)
+			}
+		}()
+	}
+
 	if s.cfg.Server.SyncJob {
 		log.Printf("[INFO] starting sync job")
 		go s.repo.SyncJob(ctx)
@@ -82,6 +97,10 @@ func (s *Server) Run(ctx context.Context) {
 		log.Printf("[INFO] starting download job")
 		go s.repo.DownloadJob(ctx)
 	}
+	if s.cfg.Server.DownloadJob {
+		log.Printf("[INFO] starting retention job")
+		go s.repo.RetentionJob(ctx)
+	}
 
 	<-ctx.Done()
 }
@@ -152,6 +171,14 @@ func main() {
 		lgr.StackTraceOnError,
 		lgr.Secret(conf.Client.AccountId, conf.Client.Id, conf.Client.Secret, conf.Server.OAuthClientId, conf.Server.OAuthClientSecret, conf.Server.JWTSecret),
 	}
+	if conf.Storage.ArchiveS3.SecretKey != "" {
+		logOpts = append(logOpts, lgr.Secret(conf.Storage.ArchiveS3.SecretKey))
+	}
+	for _, secret := range []string{conf.Server.OIDC.ClientSecret, conf.Server.GitHub.ClientSecret, conf.Server.MediaSecret, conf.Server.WebhookSecret} {
+		if secret != "" {
+			logOpts = append(logOpts, lgr.Secret(secret))
+		}
+	}
 	if conf.Server.Dbg {
 		logOpts = append(logOpts, lgr.Debug)
 	}
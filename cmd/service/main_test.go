@@ -1,17 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/go-pkgz/auth/token"
 	"github.com/parMaster/zoomrs/client"
 	"github.com/parMaster/zoomrs/config"
 	"github.com/parMaster/zoomrs/repo"
 	"github.com/parMaster/zoomrs/storage"
 	"github.com/parMaster/zoomrs/storage/model"
+	"github.com/parMaster/zoomrs/storage/sqlite"
+	"github.com/parMaster/zoomrs/webauth"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func setup(cfg *config.Parameters, store storage.Storer) error {
@@ -115,9 +132,585 @@ func Test_CheckConsistency(t *testing.T) {
 
 	repo := repo.NewRepository(s, client, cfg)
 
-	checked, err := repo.CheckConsistency(ctx)
+	checked, err := repo.CheckConsistency(ctx, true)
 
 	assert.NoError(t, err)
 	assert.Equal(t, 3, checked)
 
 }
+
+// go test -v ./cmd/service -run ^Test_Webhook$
+func Test_Webhook(t *testing.T) {
+	cfg := &config.Parameters{Server: config.Server{WebhookSecret: "webhookSecret"}}
+	s := &Server{cfg: cfg}
+	handler := s.webhookHandler(context.Background())
+
+	sign := func(ts string, body string) string {
+		mac := hmac.New(sha256.New, []byte(cfg.Server.WebhookSecret))
+		fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+		return "v0=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	body := `{"event":"endpoint.url_validation","payload":{"plainToken":"qgg8vlvZRS6UYooatFL8Aw"}}`
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// url validation challenge
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	req.Header.Set("x-zm-request-timestamp", ts)
+	req.Header.Set("x-zm-signature", sign(ts, body))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var resp map[string]string
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	mac := hmac.New(sha256.New, []byte(cfg.Server.WebhookSecret))
+	mac.Write([]byte("qgg8vlvZRS6UYooatFL8Aw"))
+	assert.Equal(t, "qgg8vlvZRS6UYooatFL8Aw", resp["plainToken"])
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), resp["encryptedToken"])
+
+	// wrong signature
+	req = httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	req.Header.Set("x-zm-request-timestamp", ts)
+	req.Header.Set("x-zm-signature", sign(ts, body+" "))
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// stale timestamp
+	staleTs := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	req = httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	req.Header.Set("x-zm-request-timestamp", staleTs)
+	req.Header.Set("x-zm-signature", sign(staleTs, body))
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// completed recordings are queued, deleted ones are lost
+	cfg.Storage = config.Storage{Repository: t.TempDir(), Path: "file:" + t.TempDir() + "/webhook_test.db?mode=rwc&_journal_mode=WAL", Type: "sqlite"}
+	cfg.Syncable = config.Syncable{Important: []string{"shared_screen_with_speaker_view"}, Optional: []string{"audio_only"}}
+	require.NoError(t, LoadStorage(context.Background(), cfg.Storage, &s.store))
+	s.repo = repo.NewRepository(s.store, nil, cfg)
+	send := func(body string) int {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+		req.Header.Set("x-zm-request-timestamp", ts)
+		req.Header.Set("x-zm-signature", sign(ts, body))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+	body = `{"event":"recording.completed","payload":{"object":{"uuid":"webhookUUID","id":123,"topic":"Webhook",
+		"start_time":"2024-01-10T10:00:00Z","duration":60,"recording_files":[
+		{"id":"rec1","recording_type":"shared_screen_with_speaker_view","file_extension":"MP4","file_size":100,"download_url":"https://zoom.us/rec1"},
+		{"id":"rec2","recording_type":"audio_only","file_extension":"M4A","file_size":10,"download_url":"https://zoom.us/rec2"},
+		{"id":"rec3","recording_type":"chat_file","file_extension":"TXT","file_size":1,"download_url":"https://zoom.us/rec3"}]}}}`
+	assert.Equal(t, http.StatusOK, send(body))
+	records, err := s.store.GetRecords(context.Background(), "webhookUUID")
+	require.NoError(t, err)
+	require.Len(t, records, 2, "chat_file is not syncable")
+	for _, r := range records {
+		assert.Equal(t, model.StatusQueued, r.Status)
+		assert.Equal(t, "webhookUUID", r.MeetingId)
+	}
+
+	assert.NoError(t, s.store.UpdateRecord(context.Background(), "rec2", model.StatusDownloaded, "rec2.m4a"))
+	assert.Equal(t, http.StatusOK, send(`{"event":"recording.deleted","payload":{"object":{"uuid":"webhookUUID"}}}`))
+	records, err = s.store.GetRecords(context.Background(), "webhookUUID")
+	require.NoError(t, err)
+	statuses := map[string]model.RecordStatus{}
+	for _, r := range records {
+		statuses[r.Id] = r.Status
+	}
+	assert.Equal(t, map[string]model.RecordStatus{"rec1": model.StatusLost, "rec2": model.StatusDownloaded}, statuses)
+
+	// webhooks are disabled without secret
+	cfg.Server.WebhookSecret = ""
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body)))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+// go test -v ./cmd/service -run ^Test_Import$
+func Test_Import(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.Parameters{
+		Server:  config.Server{Managers: []string{"manager@example.com"}},
+		Storage: config.Storage{Repository: t.TempDir(), Path: "file:" + t.TempDir() + "/import_test.db?mode=rwc&_journal_mode=WAL", Type: "sqlite"},
+	}
+	var store storage.Storer
+	require.NoError(t, LoadStorage(ctx, cfg.Storage, &store))
+	s := &Server{cfg: cfg, store: store, repo: repo.NewRepository(store, nil, cfg)}
+	handler := s.requireRole(model.RoleManager)(http.HandlerFunc(s.importHandler(ctx)))
+
+	upload := func(email string, fields map[string]string, file string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		for _, k := range []string{"topic", "start_time", "meeting"} {
+			if v, ok := fields[k]; ok {
+				mw.WriteField(k, v)
+			}
+		}
+		if file != "" {
+			fw, _ := mw.CreateFormFile("file", file)
+			fw.Write([]byte("recording"))
+		}
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/import", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req = token.SetUserInfo(req, token.User{Email: email})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := upload("user@example.com", map[string]string{"topic": "Uploaded"}, "rec.mp4")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = upload("manager@example.com", map[string]string{"topic": "Uploaded", "start_time": "yesterday"}, "rec.mp4")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = upload("manager@example.com", map[string]string{"topic": "Uploaded"}, "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = upload("manager@example.com", map[string]string{"topic": "Uploaded", "start_time": "2024-01-10 10:00:00"}, "rec.mp4")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp struct{ Data []model.Record }
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.Len(t, resp.Data, 1)
+	assert.Equal(t, model.SharedScreenWithSpeakerView, resp.Data[0].Type)
+	assert.FileExists(t, resp.Data[0].FilePath)
+
+	// the same file again
+	rec = upload("manager@example.com", map[string]string{"meeting": resp.Data[0].MeetingId}, "rec.mp4")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "already imported")
+
+	// not enough space on the repository
+	cfg.Storage.KeepFreeSpace = 1 << 62
+	rec = upload("manager@example.com", map[string]string{"topic": "Uploaded", "start_time": "2024-01-11 10:00:00"}, "rec.mp4")
+	assert.Equal(t, http.StatusInsufficientStorage, rec.Code)
+	cfg.Storage.KeepFreeSpace = 0
+
+	// the size of the upload is unknown
+	req := httptest.NewRequest(http.MethodPost, "/import", strings.NewReader(""))
+	req.ContentLength = -1
+	req = token.SetUserInfo(req, token.User{Email: "manager@example.com"})
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusLengthRequired, rec.Code)
+}
+
+// go test -v ./cmd/service -run ^Test_ShareLinks$
+func Test_ShareLinks(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.Parameters{
+		Server:  config.Server{Managers: []string{"manager@example.com"}, AccessKeySalt: "salt"},
+		Storage: config.Storage{Repository: t.TempDir(), Path: "file:" + t.TempDir() + "/shares_test.db?mode=rwc&_journal_mode=WAL", Type: "sqlite"},
+	}
+	var store storage.Storer
+	require.NoError(t, LoadStorage(ctx, cfg.Storage, &store))
+	require.NoError(t, setup(cfg, store))
+	s := &Server{cfg: cfg, store: store}
+
+	router := chi.NewRouter()
+	router.Route("/shareLinks", func(r chi.Router) {
+		r.Get("/", s.listShareLinksHandler(ctx))
+		r.Post("/", s.createShareLinkHandler(ctx))
+		r.Delete("/{id}", s.revokeShareLinkHandler(ctx))
+	})
+	router.Get("/watchMeeting/{accessKey}", s.watchMeetingHandler(ctx))
+
+	do := func(method, url, email, body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if email != "" {
+			req = token.SetUserInfo(req, token.User{Email: email})
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	create := func(body string) (string, string) {
+		rec := do(http.MethodPost, "/shareLinks/", "manager@example.com", body, nil)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		var resp struct {
+			Token string
+			Link  model.ShareLink
+		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		assert.Equal(t, shareLinkId(resp.Token), resp.Link.Id)
+		return resp.Token, resp.Link.Id
+	}
+
+	// managers only
+	rec := do(http.MethodPost, "/shareLinks/", "user@example.com", `{"meeting":"testUUID"}`, nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = do(http.MethodPost, "/shareLinks/", "manager@example.com", `{"meeting":"nope"}`, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(http.MethodPost, "/shareLinks/", "manager@example.com", `{"meeting":"testUUID","max_views":-1}`, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// unlimited link
+	tkn, id := create(`{"meeting":"testUUID"}`)
+	rec = do(http.MethodGet, "/watchMeeting/"+tkn, "", "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "testTopic")
+	rec = do(http.MethodGet, "/watchMeeting/wrong", "", "", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	// revoked link
+	rec = do(http.MethodDelete, "/shareLinks/"+id, "manager@example.com", "", nil)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	rec = do(http.MethodDelete, "/shareLinks/nope", "manager@example.com", "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(http.MethodGet, "/watchMeeting/"+tkn, "", "", nil)
+	assert.Equal(t, http.StatusGone, rec.Code)
+
+	// password and max views
+	tkn, _ = create(`{"meeting":"testUUID","password":"pass","max_views":1}`)
+	rec = do(http.MethodGet, "/watchMeeting/"+tkn, "", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = do(http.MethodGet, "/watchMeeting/"+tkn, "", "", map[string]string{"X-Share-Password": "wrong"})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = do(http.MethodGet, "/watchMeeting/"+tkn, "", "", map[string]string{"X-Share-Password": "pass"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	viewCookie := rec.Result().Cookies()
+	require.Len(t, viewCookie, 1)
+	assert.Equal(t, "/watchMeeting/"+tkn, viewCookie[0].Path)
+	rec = do(http.MethodGet, "/watchMeeting/"+tkn, "", "", map[string]string{"X-Share-Password": "pass"})
+	assert.Equal(t, http.StatusGone, rec.Code)
+	// the page reload with the cookie of the counted view isn't counted again, the password is still checked
+	cookie := map[string]string{"X-Share-Password": "pass", "Cookie": viewCookie[0].String()}
+	rec = do(http.MethodGet, "/watchMeeting/"+tkn, "", "", cookie)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = do(http.MethodGet, "/watchMeeting/"+tkn, "", "", map[string]string{"Cookie": viewCookie[0].String()})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	// the cookie is bound to the link
+	otherTkn, _ := create(`{"meeting":"testUUID","max_views":1}`)
+	rec = do(http.MethodGet, "/watchMeeting/"+otherTkn, "", "", map[string]string{"Cookie": viewCookie[0].String()})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = do(http.MethodGet, "/watchMeeting/"+otherTkn, "", "", map[string]string{"Cookie": viewCookie[0].String()})
+	assert.Equal(t, http.StatusGone, rec.Code)
+
+	// wrong passwords lock the link, even for the right one
+	tkn, id = create(`{"meeting":"testUUID","password":"pass"}`)
+	for i := 0; i < maxPasswordFails; i++ {
+		rec = do(http.MethodGet, "/watchMeeting/"+tkn, "", "", map[string]string{"X-Share-Password": "guess"})
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+	rec = do(http.MethodGet, "/watchMeeting/"+tkn, "", "", map[string]string{"X-Share-Password": "pass"})
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	// the lockout is over
+	s.shareFails.fails[id] = failCount{count: maxPasswordFails, last: time.Now().Add(-passwordLockout)}
+	rec = do(http.MethodGet, "/watchMeeting/"+tkn, "", "", map[string]string{"X-Share-Password": "pass"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, s.shareFails.fails, id)
+
+	// expired link
+	tkn, id = create(`{"meeting":"testUUID","expires_in":1}`)
+	_, err := s.store.(*sqlite.SQLiteStorage).DB.ExecContext(ctx, "UPDATE share_links SET expiresAt = '2020-01-01 00:00:00' WHERE id = $1", id)
+	require.NoError(t, err)
+	rec = do(http.MethodGet, "/watchMeeting/"+tkn, "", "", nil)
+	assert.Equal(t, http.StatusGone, rec.Code)
+
+	rec = do(http.MethodGet, "/shareLinks/?meeting=testUUID", "manager@example.com", "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var list struct{ Data []model.ShareLink }
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&list))
+	require.Len(t, list.Data, 5)
+	assert.NotContains(t, rec.Body.String(), "pbkdf2", "password hash is not exposed")
+
+	// legacy links work behind the switch only
+	legacy := fmt.Sprintf("/watchMeeting/%x?uuid=testUUID", md5.Sum([]byte("testUUIDsalt")))
+	rec = do(http.MethodGet, legacy, "", "", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	cfg.Server.LegacyShareLinks = true
+	rec = do(http.MethodGet, legacy, "", "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = do(http.MethodGet, "/watchMeeting/0123456789abcdef0123456789abcdef?uuid=testUUID", "", "", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	// the token of the share link works with a stray ?uuid= too
+	tkn, _ = create(`{"meeting":"testUUID"}`)
+	rec = do(http.MethodGet, "/watchMeeting/"+tkn+"?uuid=otherUUID", "", "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "testTopic")
+}
+
+// go test -v ./cmd/service -run ^Test_Media$
+func Test_Media(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.Parameters{
+		Server:  config.Server{MediaSecret: "mediaSecret"},
+		Storage: config.Storage{Repository: t.TempDir(), Path: "file:" + t.TempDir() + "/media_test.db?mode=rwc&_journal_mode=WAL", Type: "sqlite"},
+	}
+	var store storage.Storer
+	require.NoError(t, LoadStorage(ctx, cfg.Storage, &store))
+	require.NoError(t, setup(cfg, store))
+	require.NoError(t, store.SetRecordDownloaded(ctx, "Id1", cfg.Storage.Repository, cfg.Storage.Repository+"/Id1.m4a", "abc"))
+	require.NoError(t, store.SaveShareLink(ctx, model.ShareLink{Id: shareLinkId("tkn"), MeetingId: "testUUID"}))
+	s := &Server{cfg: cfg, store: store, repo: repo.NewRepository(store, nil, cfg)}
+
+	router := chi.NewRouter()
+	router.Get("/watchMeeting/{accessKey}", s.watchMeetingHandler(ctx))
+	router.Get("/media/{id}", s.mediaHandler(ctx))
+	get := func(url string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// the watch page gets signed urls instead of the paths
+	rec := get("/watchMeeting/tkn", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), cfg.Storage.Repository)
+	var resp struct{ Records []model.Record }
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.Len(t, resp.Records, 3)
+	mediaURL := ""
+	for _, r := range resp.Records {
+		assert.Empty(t, r.FilePath)
+		assert.True(t, strings.HasPrefix(r.MediaURL, "/media/"+r.Id+"?exp="), r.MediaURL)
+		if r.Id == "Id1" {
+			mediaURL = r.MediaURL
+		}
+	}
+
+	rec = get(mediaURL, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "test", rec.Body.String())
+	assert.Equal(t, "bytes", rec.Header().Get("Accept-Ranges"))
+	assert.Equal(t, `"abc"`, rec.Header().Get("ETag"))
+
+	// seeking and conditional requests
+	rec = get(mediaURL, map[string]string{"Range": "bytes=1-2"})
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "es", rec.Body.String())
+	assert.Equal(t, "bytes 1-2/4", rec.Header().Get("Content-Range"))
+	rec = get(mediaURL, map[string]string{"If-None-Match": `"abc"`})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	rec = get(mediaURL, map[string]string{"Range": "bytes=1-2", "If-Range": `"old"`})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "test", rec.Body.String())
+
+	// tampered, expired and unknown
+	rec = get(strings.Replace(mediaURL, "/Id1?", "/Id2?", 1), nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = get(mediaURL+"0", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = get(s.mediaURL("Id1", nil, time.Now().Add(-7*time.Hour)), nil)
+	assert.Equal(t, http.StatusGone, rec.Code)
+	rec = get(s.mediaURL("noSuchId", nil, time.Now()), nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// the url of the share link expires with the link and stops working when it's revoked
+	assert.Contains(t, mediaURL, "&link="+shareLinkId("tkn")+"&")
+	rec = get(strings.Replace(mediaURL, "&link=", "&link=0", 1), nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	expiring := &model.ShareLink{Id: shareLinkId("tkn"), ExpiresAt: time.Now().Add(time.Minute).Format(time.DateTime)}
+	assert.Contains(t, s.mediaURL("Id1", expiring, time.Now()), fmt.Sprintf("?exp=%d&", time.Now().Add(time.Minute).Unix()))
+	require.NoError(t, store.RevokeShareLink(ctx, shareLinkId("tkn")))
+	rec = get(mediaURL, nil)
+	assert.Equal(t, http.StatusGone, rec.Code)
+
+	// the repository is not served by the paths
+	rec = get("/"+cfg.Storage.Repository+"/Id1.m4a", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+// go test -v ./cmd/service -run ^Test_Roles$
+func Test_Roles(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.Parameters{
+		Server: config.Server{
+			Admins:   []string{"admin@example.com"},
+			Managers: []string{"manager@example.com"},
+			Roles:    []config.RoleRule{{Email: "*@ourcompany.com", Role: "viewer"}},
+		},
+		Storage: config.Storage{Repository: t.TempDir(), Path: "file:" + t.TempDir() + "/roles_test.db?mode=rwc&_journal_mode=WAL", Type: "sqlite"},
+	}
+	var store storage.Storer
+	require.NoError(t, LoadStorage(ctx, cfg.Storage, &store))
+	s := &Server{cfg: cfg, store: store}
+
+	for email, want := range map[string]model.Role{
+		"admin@example.com":   model.RoleAdmin,
+		"Manager@Example.com": model.RoleManager,
+		"user@ourcompany.com": model.RoleViewer,
+		"user@example.com":    "",
+		"":                    "",
+	} {
+		role, err := s.userRole(ctx, token.User{ID: "github_1", Email: email})
+		require.NoError(t, err)
+		assert.Equal(t, want, role, email)
+	}
+	assert.False(t, s.canLogin(token.User{Email: "user@example.com"}))
+	assert.True(t, s.canLogin(token.User{Email: "user@ourcompany.com"}))
+
+	router := chi.NewRouter()
+	router.With(s.requireRole(model.RoleManager)).Get("/orphans", func(rw http.ResponseWriter, r *http.Request) {})
+	router.With(s.requireRole(model.RoleAdmin)).Route("/roles", func(r chi.Router) {
+		r.Get("/", s.listRolesHandler(ctx))
+		r.Put("/{email}", s.setRoleHandler(ctx))
+		r.Delete("/{email}", s.deleteRoleHandler(ctx))
+	})
+	do := func(method, url, email, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req = token.SetUserInfo(req, token.User{Email: email})
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/orphans", "user@ourcompany.com", "").Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/orphans", "manager@example.com", "").Code)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, "/roles/user@ourcompany.com", "manager@example.com", `{"role":"manager"}`).Code)
+
+	// the saved role overrides the rules and managers of the config
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/roles/user@ourcompany.com", "admin@example.com", `{"role":"root"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/roles/admin@example.com", "admin@example.com", `{"role":"viewer"}`).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "/roles/User@OurCompany.com", "admin@example.com", `{"role":"manager"}`).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "/roles/manager@example.com", "admin@example.com", `{"role":"viewer"}`).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/orphans", "user@ourcompany.com", "").Code)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/orphans", "manager@example.com", "").Code)
+
+	rec := do(http.MethodGet, "/roles/", "admin@example.com", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp struct{ Data []model.UserRole }
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.Len(t, resp.Data, 2)
+	assert.Equal(t, "admin@example.com", resp.Data[0].UpdatedBy)
+
+	// the config roles apply again
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/roles/manager@example.com", "admin@example.com", "").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/roles/manager@example.com", "admin@example.com", "").Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/orphans", "manager@example.com", "").Code)
+
+	// the users of the dev provider get server.dev_auth.role whatever email they type, the saved admin role too
+	require.NoError(t, store.SetUserRole(ctx, model.UserRole{Email: "saved@example.com", Role: model.RoleAdmin}))
+	for _, email := range []string{"admin@example.com", "manager@example.com", "saved@example.com", "user@example.com"} {
+		role, err := s.userRole(ctx, token.User{ID: webauth.DevProvider + "_1", Email: email})
+		require.NoError(t, err)
+		assert.Equal(t, model.RoleViewer, role, email)
+	}
+	cfg.Server.DevAuth.Role = "manager"
+	role, err := s.userRole(ctx, token.User{ID: webauth.DevProvider + "_1", Email: "saved@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, model.RoleManager, role)
+}
+
+// go test -v ./cmd/service -run ^Test_Abandoned$
+func Test_Abandoned(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.Parameters{
+		Storage: config.Storage{Repository: t.TempDir(), Path: "file:" + t.TempDir() + "/abandoned_test.db?mode=rwc&_journal_mode=WAL", Type: "sqlite"},
+	}
+	var store storage.Storer
+	require.NoError(t, LoadStorage(ctx, cfg.Storage, &store))
+	require.NoError(t, store.SaveMeeting(ctx, model.Meeting{UUID: "abandonedUUID", Id: 1, Topic: "abandoned", StartTime: time.Now(),
+		Records: []model.Record{{Id: "abandonedRec", MeetingId: "abandonedUUID", Type: model.SharedScreenWithSpeakerView, StartTime: time.Now(), FileExtension: "MP4"}}}))
+	require.NoError(t, store.UpdateRecordAttempt(ctx, "abandonedRec", model.StatusAbandoned, 5, "failed to download https://zoom.us/rec/download/secret", time.Now()))
+	s := &Server{cfg: cfg, store: store}
+
+	rec := httptest.NewRecorder()
+	s.abandonedHandler(ctx)(rec, httptest.NewRequest(http.MethodGet, "/abandoned", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp struct {
+		Abandoned []struct {
+			Id        string `json:"id"`
+			Attempts  int    `json:"attempts"`
+			LastError string `json:"last_error"`
+		} `json:"abandoned"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.Len(t, resp.Abandoned, 1)
+	assert.Equal(t, "abandonedRec", resp.Abandoned[0].Id)
+	assert.Equal(t, 5, resp.Abandoned[0].Attempts)
+	assert.Contains(t, resp.Abandoned[0].LastError, "failed to download")
+}
+
+// go test -v ./cmd/service -run ^Test_HostSelfService$
+func Test_HostSelfService(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.Parameters{
+		Server:  config.Server{Roles: []config.RoleRule{{Email: "*@ourcompany.com", Role: "viewer"}}},
+		Storage: config.Storage{Repository: t.TempDir(), Path: "file:" + t.TempDir() + "/hosts_test.db?mode=rwc&_journal_mode=WAL", Type: "sqlite"},
+	}
+	var store storage.Storer
+	require.NoError(t, LoadStorage(ctx, cfg.Storage, &store))
+	require.NoError(t, setup(cfg, store))
+	// listed meetings have downloaded videos
+	for uuid, host := range map[string]string{"hostUUID": "Host@example.com", "otherUUID": "other@example.com"} {
+		require.NoError(t, store.SaveMeeting(ctx, model.Meeting{UUID: uuid, Id: 1, Topic: uuid, StartTime: time.Now(), HostEmail: host,
+			Records: []model.Record{{Id: uuid + "Rec", MeetingId: uuid, Type: model.SharedScreenWithSpeakerView, StartTime: time.Now(),
+				FileExtension: "MP4", FileSize: 4, Status: model.StatusDownloaded}}}))
+	}
+	s := &Server{cfg: cfg, store: store}
+
+	assert.True(t, s.canLogin(token.User{Email: "host@example.com"}))
+	assert.False(t, s.canLogin(token.User{Email: "stranger@example.com"}))
+	// the users of the dev provider are never hosts, the viewer can't share the meeting of the typed email
+	ok, err := s.canAccess(ctx, token.User{ID: webauth.DevProvider + "_1", Email: "host@example.com"}, model.RoleManager,
+		&model.Meeting{HostEmail: "host@example.com"})
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	router := chi.NewRouter()
+	router.Get("/listMeetings", s.listMeetings(ctx))
+	router.Route("/shareLinks", func(r chi.Router) {
+		r.Get("/", s.listShareLinksHandler(ctx))
+		r.Post("/", s.createShareLinkHandler(ctx))
+		r.Delete("/{id}", s.revokeShareLinkHandler(ctx))
+	})
+	router.Get("/watchMeeting/{accessKey}", s.watchMeetingHandler(ctx))
+	do := func(method, url, email, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if email != "" {
+			req = token.SetUserInfo(req, token.User{Email: email})
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	list := func(email string) []model.Meeting {
+		rec := do(http.MethodGet, "/listMeetings", email, "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resp struct{ Data []model.Meeting }
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		return resp.Data
+	}
+
+	// hosts see their own meetings, viewers - all
+	meetings := list("host@example.com")
+	require.Len(t, meetings, 1)
+	assert.Equal(t, "hostUUID", meetings[0].UUID)
+	assert.Len(t, list("user@ourcompany.com"), 2)
+	assert.Empty(t, list("stranger@example.com"))
+
+	// hosts share their own meetings
+	rec := do(http.MethodPost, "/shareLinks/", "host@example.com", `{"meeting":"otherUUID"}`)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = do(http.MethodPost, "/shareLinks/", "user@ourcompany.com", `{"meeting":"hostUUID"}`)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = do(http.MethodPost, "/shareLinks/", "host@example.com", `{"meeting":"hostUUID"}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var created struct{ Link model.ShareLink }
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&created))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/shareLinks/", "host@example.com", "").Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/shareLinks/?meeting=hostUUID", "host@example.com", "").Code)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodDelete, "/shareLinks/"+created.Link.Id, "stranger@example.com", "").Code)
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/shareLinks/"+created.Link.Id, "host@example.com", "").Code)
+
+	// logged in hosts and viewers watch without the share link
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/watchMeeting/meeting?uuid=hostUUID", "host@example.com", "").Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/watchMeeting/meeting?uuid=testUUID", "user@ourcompany.com", "").Code)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/watchMeeting/meeting?uuid=otherUUID", "host@example.com", "").Code)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/watchMeeting/meeting?uuid=hostUUID", "stranger@example.com", "").Code)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/watchMeeting/meeting?uuid=hostUUID", "", "").Code)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/parMaster/zoomrs/storage"
+	"github.com/parMaster/zoomrs/storage/model"
+)
+
+// defaultMediaURLTTL is the lifetime of the signed media url if server.media_url_ttl is not set
+const defaultMediaURLTTL = 6 * time.Hour
+
+// mediaURL returns the signed url of the record file, /media/<record id>?exp=<unix time>[&link=<id>]&sig=<signature>.
+// The url given by the share link is bound to it and expires with the link
+func (s *Server) mediaURL(recordId string, link *model.ShareLink, now time.Time) string {
+	expiresAt, linkId := now.Add(s.mediaURLTTL()), ""
+	if link != nil {
+		linkId = link.Id
+		if linkExp, err := time.ParseInLocation(time.DateTime, link.ExpiresAt, time.Local); err == nil && linkExp.Before(expiresAt) {
+			expiresAt = linkExp
+		}
+	}
+	exp := strconv.FormatInt(expiresAt.Unix(), 10)
+	u := "/media/" + url.PathEscape(recordId) + "?exp=" + exp
+	if linkId != "" {
+		u += "&link=" + linkId
+	}
+	return u + "&sig=" + s.mediaSignature(recordId, exp, linkId)
+}
+
+// mediaURLTTL returns the lifetime of the signed media url, server.media_url_ttl or defaultMediaURLTTL
+func (s *Server) mediaURLTTL() time.Duration {
+	if ttl := time.Duration(s.cfg.Server.MediaURLTTL) * time.Second; ttl > 0 {
+		return ttl
+	}
+	return defaultMediaURLTTL
+}
+
+// mediaSignature returns the signature of the record id, the expiry of the media url and the share link id
+func (s *Server) mediaSignature(recordId, exp, linkId string) string {
+	return s.sign(recordId, exp, linkId)
+}
+
+// sign returns hex encoded HMAC-SHA256 of the parts joined by new lines, signed with server.media_secret
+// (server.jwt_secret if not set)
+func (s *Server) sign(parts ...string) string {
+	secret := s.cfg.Server.MediaSecret
+	if secret == "" {
+		secret = s.cfg.Server.JWTSecret
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// mediaHandler serves the record file by the signed url made by mediaURL. Range and conditional
+// requests are supported, so the player can seek. The url of the share link stops working when
+// the link is revoked
+func (s *Server) mediaHandler(ctx context.Context) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		id, exp, linkId := chi.URLParam(r, "id"), r.URL.Query().Get("exp"), r.URL.Query().Get("link")
+		expiresAt, err := strconv.ParseInt(exp, 10, 64)
+		if err != nil || !hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(s.mediaSignature(id, exp, linkId))) {
+			http.Error(rw, "invalid signature", http.StatusForbidden)
+			return
+		}
+		if time.Now().Unix() > expiresAt {
+			http.Error(rw, "link expired", http.StatusGone)
+			return
+		}
+		if linkId != "" {
+			link, err := s.store.GetShareLink(ctx, linkId)
+			if err != nil && !errors.Is(err, storage.ErrNoRows) {
+				log.Printf("[ERROR] failed to get share link %s, %v", linkId, err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if link == nil || link.Revoked {
+				http.Error(rw, "share link revoked", http.StatusGone)
+				return
+			}
+		}
+
+		rec, err := s.store.GetRecord(ctx, id)
+		if err != nil {
+			if !errors.Is(err, storage.ErrNoRows) {
+				log.Printf("[ERROR] failed to get record %s, %v", id, err)
+			}
+			http.NotFound(rw, r)
+			return
+		}
+		if rec.Status != model.StatusDownloaded && rec.Status != model.StatusArchived {
+			http.NotFound(rw, r)
+			return
+		}
+		log.Printf("[INFO] /media/%s (%s)", id, r.Header.Get("X-Real-Ip"))
+		// the url is valid until exp, the file behind it doesn't change
+		rw.Header().Set("Cache-Control", "private, max-age="+strconv.FormatInt(max(expiresAt-time.Now().Unix(), 0), 10))
+		s.repo.ServeRecord(rw, r, *rec)
+	}
+}
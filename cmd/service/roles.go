@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-pkgz/auth/token"
+	"github.com/parMaster/zoomrs/storage"
+	"github.com/parMaster/zoomrs/storage/model"
+	"github.com/parMaster/zoomrs/webauth"
+)
+
+// userRole returns the role of the user, empty if the user has none. Admins of the config come first,
+// then the role saved by the admin, managers of the config and the first matching rule of server.roles.
+// The users of the dev provider type any email, they get server.dev_auth.role (viewer if not set) only
+func (s *Server) userRole(ctx context.Context, user token.User) (model.Role, error) {
+	email := strings.ToLower(user.Email)
+	if email == "" {
+		return "", nil
+	}
+	if webauth.IsDevUser(user) {
+		if s.cfg.Server.DevAuth.Role == "" {
+			return model.RoleViewer, nil
+		}
+		return model.Role(s.cfg.Server.DevAuth.Role), nil
+	}
+	if containsFold(s.cfg.Server.Admins, email) {
+		return model.RoleAdmin, nil
+	}
+	ur, err := s.store.GetUserRole(ctx, email)
+	if err == nil {
+		return ur.Role, nil
+	}
+	if !errors.Is(err, storage.ErrNoRows) {
+		return "", err
+	}
+	if containsFold(s.cfg.Server.Managers, email) {
+		return model.RoleManager, nil
+	}
+	for _, rule := range s.cfg.Server.Roles {
+		if ok, _ := path.Match(strings.ToLower(rule.Email), email); ok {
+			return model.Role(rule.Role), nil
+		}
+	}
+	return "", nil
+}
+
+// canLogin is the login validator, the users with a role and the hosts of the meetings are let in.
+// Hosts without a role see and share their own meetings only, the users of the dev provider are never hosts
+func (s *Server) canLogin(user token.User) bool {
+	ctx := context.Background()
+	email := user.Email
+	role, err := s.userRole(ctx, user)
+	if err != nil {
+		log.Printf("[ERROR] failed to get role of %s, %v", email, err)
+		return false
+	}
+	if role.Valid() {
+		return true
+	}
+	if webauth.IsDevUser(user) {
+		return false
+	}
+	n, err := s.store.CountHostMeetings(ctx, email)
+	if err != nil {
+		log.Printf("[ERROR] failed to count meetings of %s, %v", email, err)
+		return false
+	}
+	return n > 0
+}
+
+// canAccess returns true if the user has the required role or hosts the meeting
+func (s *Server) canAccess(ctx context.Context, user token.User, required model.Role, meeting *model.Meeting) (bool, error) {
+	role, err := s.userRole(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	return role.Allows(required) || isHost(user, meeting), nil
+}
+
+// isHost returns true if the user hosts the meeting, the users of the dev provider type any email and never do
+func isHost(user token.User, meeting *model.Meeting) bool {
+	return user.Email != "" && meeting != nil && !webauth.IsDevUser(user) && strings.EqualFold(meeting.HostEmail, user.Email)
+}
+
+// requireRole allows the request to the users with the role or a higher one
+func (s *Server) requireRole(required model.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			userInfo, err := token.GetUserInfo(r)
+			if err != nil {
+				http.Error(rw, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			role, err := s.userRole(r.Context(), userInfo)
+			if err != nil {
+				log.Printf("[ERROR] failed to get role of %s, %v", userInfo.Email, err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if !role.Allows(required) {
+				http.Error(rw, string(required)+" role required", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// containsFold returns true if the list contains the email, case insensitive
+func containsFold(list []string, email string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// listRolesHandler lists the roles saved by the admins along with the roles of the config
+func (s *Server) listRolesHandler(ctx context.Context) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		roles, err := s.store.ListUserRoles(ctx)
+		if err != nil {
+			log.Printf("[ERROR] failed to list user roles, %v", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]any{
+			"data":     roles,
+			"admins":   s.cfg.Server.Admins,
+			"managers": s.cfg.Server.Managers,
+			"rules":    s.cfg.Server.Roles,
+		})
+	}
+}
+
+// setRoleHandler saves the role of the user from JSON body {"role": "viewer|manager|admin"}
+func (s *Server) setRoleHandler(ctx context.Context) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		email := strings.ToLower(chi.URLParam(r, "email"))
+		req := struct {
+			Role model.Role `json:"role"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(rw, "invalid request body, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if email == "" || !req.Role.Valid() {
+			http.Error(rw, "email and role (viewer, manager or admin) are required", http.StatusBadRequest)
+			return
+		}
+		userInfo, _ := token.GetUserInfo(r)
+		if strings.EqualFold(userInfo.Email, email) {
+			http.Error(rw, "can't change own role", http.StatusBadRequest)
+			return
+		}
+		ur := model.UserRole{Email: email, Role: req.Role, UpdatedBy: userInfo.Email, UpdatedAt: time.Now().Format(time.DateTime)}
+		if err := s.store.SetUserRole(ctx, ur); err != nil {
+			log.Printf("[ERROR] failed to save role of %s, %v", email, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[INFO] /roles: %s is %s, set by %s", email, req.Role, userInfo.Email)
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(ur)
+	}
+}
+
+// deleteRoleHandler deletes the saved role of the user, the roles of the config apply again
+func (s *Server) deleteRoleHandler(ctx context.Context) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		email := chi.URLParam(r, "email")
+		userInfo, _ := token.GetUserInfo(r)
+		if strings.EqualFold(userInfo.Email, email) {
+			http.Error(rw, "can't change own role", http.StatusBadRequest)
+			return
+		}
+		if err := s.store.DeleteUserRole(ctx, email); err != nil {
+			if errors.Is(err, storage.ErrNoRows) {
+				http.Error(rw, "role not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("[ERROR] failed to delete role of %s, %v", email, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[INFO] /roles: role of %s deleted by %s", email, userInfo.Email)
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-pkgz/auth/token"
+	"github.com/parMaster/zoomrs/storage"
+	"github.com/parMaster/zoomrs/storage/model"
+	"github.com/parMaster/zoomrs/webauth"
+)
+
+// shareLinkRequest is the body of POST /shareLinks
+type shareLinkRequest struct {
+	Meeting   string `json:"meeting"`    // meeting UUID
+	ExpiresIn int    `json:"expires_in"` // hours, 0 - never expires
+	Password  string `json:"password"`   // optional, asked on the watch page
+	MaxViews  int    `json:"max_views"`  // 0 - unlimited
+}
+
+// createShareLinkHandler creates the share link of the meeting. The token is in the response only,
+// the link stores its hash
+func (s *Server) createShareLinkHandler(ctx context.Context) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		req := shareLinkRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(rw, "invalid request body, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Meeting == "" || req.ExpiresIn < 0 || req.MaxViews < 0 {
+			http.Error(rw, "meeting is required, expires_in and max_views can't be negative", http.StatusBadRequest)
+			return
+		}
+		meeting, err := s.store.GetMeeting(ctx, req.Meeting)
+		if err != nil {
+			if errors.Is(err, storage.ErrNoRows) {
+				http.Error(rw, "meeting not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("[ERROR] failed to get meeting %s, %v", req.Meeting, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		userInfo, _ := token.GetUserInfo(r)
+		if !s.canShare(ctx, rw, userInfo, meeting) {
+			return
+		}
+		shareToken, err := newShareToken()
+		if err != nil {
+			log.Printf("[ERROR] failed to generate share token, %v", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		link := model.ShareLink{
+			Id:        shareLinkId(shareToken),
+			MeetingId: req.Meeting,
+			CreatedBy: userInfo.Email,
+			CreatedAt: time.Now().Format(time.DateTime),
+			MaxViews:  req.MaxViews,
+		}
+		if req.ExpiresIn > 0 {
+			link.ExpiresAt = time.Now().Add(time.Duration(req.ExpiresIn) * time.Hour).Format(time.DateTime)
+		}
+		if req.Password != "" {
+			if link.Password, err = webauth.HashPassword(req.Password); err != nil {
+				log.Printf("[ERROR] failed to hash share link password, %v", err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			link.HasPassword = true
+		}
+		if err := s.store.SaveShareLink(ctx, link); err != nil {
+			log.Printf("[ERROR] failed to save share link, %v", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[INFO] /shareLinks: link %s to %s created by %s", link.Id, link.MeetingId, link.CreatedBy)
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		json.NewEncoder(rw).Encode(map[string]any{
+			"token": shareToken,
+			"url":   "/watch/" + shareToken,
+			"link":  link,
+		})
+	}
+}
+
+// listShareLinksHandler lists the share links, of the meeting if ?meeting=<uuid> is set.
+// Hosts without manager role list the links of their meeting only
+func (s *Server) listShareLinksHandler(ctx context.Context) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		meetingId := r.URL.Query().Get("meeting")
+		var meeting *model.Meeting
+		if meetingId != "" {
+			m, err := s.store.GetMeeting(ctx, meetingId)
+			if err != nil && !errors.Is(err, storage.ErrNoRows) {
+				log.Printf("[ERROR] failed to get meeting %s, %v", meetingId, err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			meeting = m
+		}
+		userInfo, _ := token.GetUserInfo(r)
+		if !s.canShare(ctx, rw, userInfo, meeting) {
+			return
+		}
+
+		links, err := s.store.ListShareLinks(ctx, meetingId)
+		if err != nil {
+			log.Printf("[ERROR] failed to list share links, %v", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]any{"data": links})
+	}
+}
+
+// revokeShareLinkHandler revokes the share link by its id
+func (s *Server) revokeShareLinkHandler(ctx context.Context) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		link, err := s.store.GetShareLink(ctx, id)
+		if err != nil {
+			if errors.Is(err, storage.ErrNoRows) {
+				http.Error(rw, "share link not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("[ERROR] failed to get share link %s, %v", id, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		meeting, err := s.store.GetMeeting(ctx, link.MeetingId)
+		if err != nil && !errors.Is(err, storage.ErrNoRows) {
+			log.Printf("[ERROR] failed to get meeting %s, %v", link.MeetingId, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		userInfo, _ := token.GetUserInfo(r)
+		if !s.canShare(ctx, rw, userInfo, meeting) {
+			return
+		}
+		if err := s.store.RevokeShareLink(ctx, id); err != nil {
+			if errors.Is(err, storage.ErrNoRows) {
+				http.Error(rw, "share link not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("[ERROR] failed to revoke share link %s, %v", id, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[INFO] /shareLinks: link %s revoked by %s", id, userInfo.Email)
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// canShare checks if the user manages the share links of the meeting: managers share any meeting,
+// hosts - their own meetings. Responds with 403 if not, the meeting is nil for all the meetings
+func (s *Server) canShare(ctx context.Context, rw http.ResponseWriter, user token.User, meeting *model.Meeting) bool {
+	ok, err := s.canAccess(ctx, user, model.RoleManager, meeting)
+	if err != nil {
+		log.Printf("[ERROR] failed to get role of %s, %v", user.Email, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		http.Error(rw, "manager role or the host of the meeting required", http.StatusForbidden)
+	}
+	return ok
+}
+
+// sharedMeeting returns the UUID of the meeting shared by the access key of the watch link with the share
+// link, nil for the legacy keys and logged in users, or the http status to respond with. The access key is the token of the share link,
+// the view of the link is counted once per shareViewCookie, so reloads of the watch page don't use up max_views.
+// The password of the link is passed in X-Share-Password header, 429 is returned for maxPasswordFails
+// wrong ones in a row until passwordLockout passes. With server.legacy_share_links the old
+// md5(uuid + access_key_salt) keys are accepted too, the meeting is passed in ?uuid=.
+// Logged in viewers and the host of the meeting watch the ?uuid= meeting without the key
+func (s *Server) sharedMeeting(ctx context.Context, rw http.ResponseWriter, r *http.Request, accessKey string) (string, *model.ShareLink, int) {
+	uuid := r.URL.Query().Get("uuid")
+	if userInfo, err := token.GetUserInfo(r); err == nil && uuid != "" {
+		meeting, err := s.store.GetMeeting(ctx, uuid)
+		if err != nil && !errors.Is(err, storage.ErrNoRows) {
+			log.Printf("[ERROR] failed to get meeting %s, %v", uuid, err)
+			return "", nil, http.StatusInternalServerError
+		}
+		ok, err := s.canAccess(ctx, userInfo, model.RoleViewer, meeting)
+		if err != nil {
+			log.Printf("[ERROR] failed to get role of %s, %v", userInfo.Email, err)
+			return "", nil, http.StatusInternalServerError
+		}
+		if ok {
+			return uuid, nil, http.StatusOK
+		}
+	}
+
+	// the token of the share link is tried if the legacy key doesn't match, ?uuid= can be left in the url
+	if uuid != "" && s.cfg.Server.LegacyShareLinks {
+		key := fmt.Sprintf("%x", md5.Sum([]byte(uuid+s.cfg.Server.AccessKeySalt)))
+		if subtle.ConstantTimeCompare([]byte(accessKey), []byte(key)) == 1 {
+			return uuid, nil, http.StatusOK
+		}
+	}
+
+	link, err := s.store.GetShareLink(ctx, shareLinkId(accessKey))
+	if err != nil {
+		if errors.Is(err, storage.ErrNoRows) {
+			return "", nil, http.StatusForbidden
+		}
+		log.Printf("[ERROR] failed to get share link, %v", err)
+		return "", nil, http.StatusInternalServerError
+	}
+	if link.Revoked {
+		return "", nil, http.StatusGone
+	}
+	if link.ExpiresAt != "" {
+		expiresAt, err := time.ParseInLocation(time.DateTime, link.ExpiresAt, time.Local)
+		if err != nil || time.Now().After(expiresAt) {
+			return "", nil, http.StatusGone
+		}
+	}
+	if link.Password != "" {
+		// every guess is counted, the link is locked for a while after too many wrong ones
+		if s.shareFails.locked(link.Id) {
+			return "", nil, http.StatusTooManyRequests
+		}
+		if !webauth.CheckPassword(link.Password, r.Header.Get("X-Share-Password")) {
+			s.shareFails.fail(link.Id)
+			return "", nil, http.StatusUnauthorized
+		}
+		s.shareFails.reset(link.Id)
+	}
+	if s.viewCounted(r, link.Id) {
+		return link.MeetingId, link, http.StatusOK
+	}
+	if err := s.store.AddShareLinkView(ctx, link.Id); err != nil {
+		if errors.Is(err, storage.ErrNoRows) {
+			return "", nil, http.StatusGone // all the views are used or the link is revoked meanwhile
+		}
+		log.Printf("[ERROR] failed to count share link %s view, %v", link.Id, err)
+		return "", nil, http.StatusInternalServerError
+	}
+	s.setViewCookie(rw, accessKey, link.Id, time.Now())
+	return link.MeetingId, link, http.StatusOK
+}
+
+// shareViewCookie keeps the counted view of the share link for the lifetime of the media urls given with it,
+// path of the cookie is the watch link
+const shareViewCookie = "share_view"
+
+// viewCounted returns true if the request has the unexpired shareViewCookie of the link
+func (s *Server) viewCounted(r *http.Request, linkId string) bool {
+	c, err := r.Cookie(shareViewCookie)
+	if err != nil {
+		return false
+	}
+	exp, sig, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return false
+	}
+	expiresAt, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(s.sign("share view", linkId, exp)))
+}
+
+// setViewCookie sets shareViewCookie of the link, <expiry unix time>.<signature>
+func (s *Server) setViewCookie(rw http.ResponseWriter, accessKey, linkId string, now time.Time) {
+	expiresAt := now.Add(s.mediaURLTTL())
+	exp := strconv.FormatInt(expiresAt.Unix(), 10)
+	http.SetCookie(rw, &http.Cookie{
+		Name:     shareViewCookie,
+		Value:    exp + "." + s.sign("share view", linkId, exp),
+		Path:     "/watchMeeting/" + url.PathEscape(accessKey),
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   !strings.HasPrefix(s.cfg.Server.Domain, "http://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+const (
+	maxPasswordFails = 5                // wrong passwords of the share link before it's locked
+	passwordLockout  = 15 * time.Minute // the link is locked for this long after the last wrong password
+)
+
+// failLimiter counts the wrong passwords of the share links, the zero value is ready to use
+type failLimiter struct {
+	mx    sync.Mutex
+	fails map[string]failCount // by share link id
+}
+
+type failCount struct {
+	count int
+	last  time.Time
+}
+
+// locked returns true if the link had too many wrong passwords recently
+func (l *failLimiter) locked(id string) bool {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	f := l.fails[id]
+	return f.count >= maxPasswordFails && time.Since(f.last) < passwordLockout
+}
+
+// fail counts the wrong password of the link, the count starts over after the lockout period
+func (l *failLimiter) fail(id string) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.fails == nil {
+		l.fails = map[string]failCount{}
+	}
+	f := l.fails[id]
+	if time.Since(f.last) >= passwordLockout {
+		f.count = 0
+	}
+	l.fails[id] = failCount{count: f.count + 1, last: time.Now()}
+}
+
+// reset forgets the wrong passwords of the link after the right one
+func (l *failLimiter) reset(id string) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	delete(l.fails, id)
+}
+
+// newShareToken returns the random URL-safe token of the share link
+func newShareToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// shareLinkId returns the id of the share link, hex encoded SHA-256 of the token
+func shareLinkId(shareToken string) string {
+	h := sha256.Sum256([]byte(shareToken))
+	return hex.EncodeToString(h[:])
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path"
+	"regexp"
 	"time"
 
 	"github.com/parMaster/zoomrs/storage/model"
@@ -15,6 +17,7 @@ type Parameters struct {
 	Server    Server    `yaml:"server"`    // Server configuration
 	Client    Client    `yaml:"client"`    // Zoom client configuration
 	Storage   Storage   `yaml:"storage"`   // Storage configuration
+	Download  Download  `yaml:"download"`  // Download configuration
 	Syncable  Syncable  `yaml:"syncable"`  // Syncable configuration
 	Commander Commander `yaml:"commander"` // Commander configuration
 }
@@ -29,14 +32,18 @@ type Client struct {
 	DeleteSkipped          bool              `yaml:"delete_skipped"`            // Delete skipped files from Zoom cloud (the ones that are shorter than MinDuration)
 	CloudCapacityHardLimit model.FileSize    `yaml:"cloud_capacity_hard_limit"` // Hard limit for cloud storage capacity (in bytes)
 	RateLimitingDelay      RateLimitingDelay `yaml:"rate_limiting_delay"`       // Rate limiting delay
+	MaxRetries             int               `yaml:"max_retries"`               // Retries of rate limited (429) and failed (5xx) requests, 5 if not set
+	AccountWide            bool              `yaml:"account_wide"`              // Sync recordings of all users of the account, not only the app owner
 }
 
 // RateLimitingDelay is the delay between requests to Zoom API
-// ms between looped requests. APIs are grouped into categories with progressively longer delays
+// ms between looped requests. APIs are grouped into categories with progressively longer delays.
+// Each category gets a token bucket limiter with one token per delay and Burst tokens capacity
 type RateLimitingDelay struct {
 	Light  time.Duration
 	Medium time.Duration
 	Heavy  time.Duration
+	Burst  int
 }
 
 // unmarshal RateLimitingDelay fields to time.Duration
@@ -45,6 +52,7 @@ func (r *RateLimitingDelay) UnmarshalYAML(value *yaml.Node) error {
 		Light  int `yaml:"light"`
 		Medium int `yaml:"medium"`
 		Heavy  int `yaml:"heavy"`
+		Burst  int `yaml:"burst"`
 	}
 	var t tmp
 	if err := value.Decode(&t); err != nil {
@@ -53,28 +61,149 @@ func (r *RateLimitingDelay) UnmarshalYAML(value *yaml.Node) error {
 	r.Light = time.Duration(t.Light) * time.Millisecond
 	r.Medium = time.Duration(t.Medium) * time.Millisecond
 	r.Heavy = time.Duration(t.Heavy) * time.Millisecond
+	r.Burst = t.Burst
 	return nil
 }
 
 type Server struct {
-	Listen            string   `yaml:"listen"`              // Address or/and Port for http server to listen to
-	Dbg               bool     `yaml:"dbg"`                 // Debug mode
-	AccessKeySalt     string   `yaml:"access_key_salt"`     // Salt for access key generation
-	Domain            string   `yaml:"domain"`              // Domain name for OAuth
-	OAuthClientId     string   `yaml:"oauth_client_id"`     // OAuth client id
-	OAuthClientSecret string   `yaml:"oauth_client_secret"` // OAuth client secret
-	OAuthDisableXSRF  bool     `yaml:"oauth_disable_xsrf"`  // OAuth disable XSRF setting
-	JWTSecret         string   `yaml:"jwt_secret"`          // JWT secret
-	Managers          []string `yaml:"managers"`            // List of managers emails
-	SyncJob           bool     `yaml:"sync_job"`            // Run sync job
-	DownloadJob       bool     `yaml:"download_job"`        // Run download job
+	Listen            string     `yaml:"listen"`              // Address or/and Port for http server to listen to
+	Dbg               bool       `yaml:"dbg"`                 // Debug mode
+	AccessKeySalt     string     `yaml:"access_key_salt"`     // Salt for access key generation
+	Domain            string     `yaml:"domain"`              // Domain name for OAuth, https:// is added if the scheme is not set
+	OAuthClientId     string     `yaml:"oauth_client_id"`     // OAuth client id
+	OAuthClientSecret string     `yaml:"oauth_client_secret"` // OAuth client secret
+	OAuthDisableXSRF  bool       `yaml:"oauth_disable_xsrf"`  // OAuth disable XSRF setting
+	JWTSecret         string     `yaml:"jwt_secret"`          // JWT secret
+	Managers          []string   `yaml:"managers"`            // List of managers emails
+	Admins            []string   `yaml:"admins"`              // List of admins emails, the roles saved in the database don't override them
+	Roles             []RoleRule `yaml:"roles"`               // Roles by email patterns, like "*@ourcompany.com" - viewer, the first matching rule applies
+	SyncJob           bool       `yaml:"sync_job"`            // Run sync job
+	DownloadJob       bool       `yaml:"download_job"`        // Run download job
+	WebhookSecret     string     `yaml:"webhook_secret"`      // Zoom webhook secret token, enables /webhook endpoint if set
+	LegacyShareLinks  bool       `yaml:"legacy_share_links"`  // Accept md5(uuid + access_key_salt) share links made before share_links table, to be disabled after migration
+	MediaSecret       string     `yaml:"media_secret"`        // Secret of the signed /media urls, jwt_secret is used if empty
+	MediaURLTTL       int        `yaml:"media_url_ttl"`       // Signed /media urls expire in this number of seconds, 21600 (6 hours) if not set
+	OIDC              OIDC       `yaml:"oidc"`                // OpenID Connect login provider (Keycloak, Okta, etc.), enabled if issuer is set
+	GitHub            GitHub     `yaml:"github"`              // GitHub login provider, enabled if client_id is set
+	DevAuth           DevAuth    `yaml:"dev_auth"`            // Login without external providers, for offline use and local testing
+}
+
+// OIDC is the generic OpenID Connect provider, its endpoints are discovered from the issuer
+type OIDC struct {
+	Name         string   `yaml:"name"`          // Provider name in /auth/<name>/login urls and on the login page, "oidc" if not set
+	Issuer       string   `yaml:"issuer"`        // Issuer url, like https://keycloak.example.com/realms/company, /.well-known/openid-configuration is read from it
+	ClientId     string   `yaml:"client_id"`     // OAuth client id
+	ClientSecret string   `yaml:"client_secret"` // OAuth client secret
+	Scopes       []string `yaml:"scopes"`        // Requested scopes, openid, email and profile if not set
+}
+
+// GitHub is the GitHub OAuth app
+type GitHub struct {
+	ClientId     string `yaml:"client_id"`     // OAuth app client id
+	ClientSecret string `yaml:"client_secret"` // OAuth app client secret
+}
+
+// DevAuth is the offline login: the fake OAuth server of the "dev" provider and the "local" provider
+// with the passwords of the config
+type DevAuth struct {
+	Enabled bool              `yaml:"enabled"` // Run the "dev" provider, it logs in with any email typed in its form. Never enable in production
+	Host    string            `yaml:"host"`    // Host of the dev OAuth server as seen by the browser, localhost if not set
+	Port    int               `yaml:"port"`    // Port of the dev OAuth server, 8084 if not set
+	Role    string            `yaml:"role"`    // Role of the "dev" provider users whatever email they type: viewer (default), manager or admin
+	Users   map[string]string `yaml:"users"`   // "local" provider users, email: password hash made by "zoomrs-cli --cmd=hash-password". Enabled if not empty
 }
 
 type Storage struct {
-	Type          string `yaml:"type"`            // Type of storage to use. Currently supported: sqlite
-	Path          string `yaml:"path"`            // Path to the database file
-	Repository    string `yaml:"repository"`      // Path to the repository folder where downloaded files are stored
-	KeepFreeSpace uint64 `yaml:"keep_free_space"` // Keep at least this amount of free space (in bytes) on the local storage
+	Type          string          `yaml:"type"`            // Type of storage to use. Currently supported: sqlite
+	Path          string          `yaml:"path"`            // Path to the database file
+	Repository    string          `yaml:"repository"`      // Path to the repository folder where downloaded files are stored
+	Repositories  []string        `yaml:"repositories"`    // Paths to the repository folders (roots), used instead of Repository if set
+	Placement     string          `yaml:"placement"`       // Root for the new download: most_free (default) - with the most free space, first_fit - the first one in the list with enough free space
+	Layout        string          `yaml:"layout"`          // Path template of the downloaded files in the repository, {date}/{id}/{filename} if empty
+	KeepFreeSpace uint64          `yaml:"keep_free_space"` // Keep at least this amount of free space (in bytes) on the local storage, on every root
+	Retention     []RetentionRule `yaml:"retention"`       // Eviction rules of the downloaded recordings, the first matching rule applies
+	Archive       string          `yaml:"archive"`         // Path to the cold archive folder, evicted recordings are moved there instead of deleting. Name of the archive in the media urls with archive_s3
+	ArchiveS3     S3              `yaml:"archive_s3"`      // S3-compatible bucket of the cold archive, used instead of the archive folder if bucket is set
+}
+
+// S3 is the S3-compatible bucket configuration (AWS S3, MinIO, etc.)
+type S3 struct {
+	Endpoint  string `yaml:"endpoint"`   // Endpoint URL, like https://s3.amazonaws.com or http://localhost:9000
+	Region    string `yaml:"region"`     // Region, us-east-1 if not set
+	Bucket    string `yaml:"bucket"`     // Bucket name
+	Prefix    string `yaml:"prefix"`     // Prefix of the object keys, like "zoomrs/"
+	AccessKey string `yaml:"access_key"` // Access key id
+	SecretKey string `yaml:"secret_key"` // Secret access key
+}
+
+// Roots returns the repository folders - Repositories, or Repository if the list is empty
+func (s Storage) Roots() []string {
+	if len(s.Repositories) > 0 {
+		return s.Repositories
+	}
+	return []string{s.Repository}
+}
+
+// RetentionRule matches downloaded recordings by meeting topic, meeting id and recording type,
+// all the set conditions must match. Rule without conditions matches every recording
+type RetentionRule struct {
+	Name       string         // Rule name, used in logs
+	Topic      *regexp.Regexp // Meeting topic regexp
+	MeetingIds []string       // Meeting UUIDs or ids
+	Types      []string       // Recording types
+	Pin        bool           // Never evict matching recordings
+	MinAge     int            // Days - recordings are not evicted to free up space until they are older
+	MaxAge     int            // Days - older recordings are evicted even if there is enough free space, 0 - no limit
+}
+
+// unmarshal RetentionRule, compile topic regexp
+func (r *RetentionRule) UnmarshalYAML(value *yaml.Node) error {
+	type tmp struct {
+		Name       string   `yaml:"name"`
+		Topic      string   `yaml:"topic"`
+		MeetingIds []string `yaml:"meeting_ids"`
+		Types      []string `yaml:"types"`
+		Pin        bool     `yaml:"pin"`
+		MinAge     int      `yaml:"min_age"`
+		MaxAge     int      `yaml:"max_age"`
+	}
+	var t tmp
+	if err := value.Decode(&t); err != nil {
+		return err
+	}
+	if t.Topic != "" {
+		re, err := regexp.Compile(t.Topic)
+		if err != nil {
+			return fmt.Errorf("retention rule %q: bad topic regexp: %w", t.Name, err)
+		}
+		r.Topic = re
+	}
+	r.Name, r.MeetingIds, r.Types, r.Pin, r.MinAge, r.MaxAge = t.Name, t.MeetingIds, t.Types, t.Pin, t.MinAge, t.MaxAge
+	return nil
+}
+
+type Download struct {
+	Workers        int    `yaml:"workers"`         // Number of parallel downloads, 1 if not set
+	BandwidthLimit int64  `yaml:"bandwidth_limit"` // Bytes per second shared by all downloads, 0 - unlimited
+	MaxAttempts    int    `yaml:"max_attempts"`    // Failed download attempts before the record is abandoned, 5 if not set
+	RetryDelay     int    `yaml:"retry_delay"`     // Seconds before the first retry of failed download, doubled with every attempt, 60 if not set
+	Hooks          []Hook `yaml:"hooks"`           // Post-download processing pipeline, hooks of the event run in order
+}
+
+// RoleRule gives the role to the users with the matching emails
+type RoleRule struct {
+	Email string `yaml:"email"` // Email or pattern with * wildcard (path.Match syntax), case insensitive
+	Role  string `yaml:"role"`  // admin, manager or viewer
+}
+
+// Hook is the post-download processing step - external command or built-in step
+type Hook struct {
+	Name    string   `yaml:"name"`    // Hook name, processing status of every record or meeting is saved by it
+	Event   string   `yaml:"event"`   // record - after every downloaded recording (default), meeting - after all recordings of the meeting are downloaded
+	Command []string `yaml:"command"` // External command and its arguments, details are passed in ZOOMRS_* environment variables and as JSON on stdin
+	Step    string   `yaml:"step"`    // Built-in step, used if command is not set
+	Timeout int      `yaml:"timeout"` // Seconds, 600 if not set
+	Retries int      `yaml:"retries"` // Retries of the failed hook
 }
 
 type Syncable struct {
@@ -85,7 +214,8 @@ type Syncable struct {
 }
 
 type Commander struct {
-	Instances []string `yaml:"instances"` // List of instances to check for download status against, before trash/deleting
+	Instances  []string `yaml:"instances"`   // List of instances to check for download status against, before trash/deleting
+	VerifyHash bool     `yaml:"verify_hash"` // Ask instances to check SHA-256 of the downloaded files, not only the size
 }
 
 // NewConfig creates a new Parameters from the given file
@@ -100,6 +230,45 @@ func NewConfig(fname string) (*Parameters, error) {
 		log.Printf("[ERROR] failed to parse config %s: %e", fname, err)
 		return nil, fmt.Errorf("failed to parse config %s: %w", fname, err)
 	}
+	if err = p.validate(); err != nil {
+		log.Printf("[ERROR] invalid config %s: %e", fname, err)
+		return nil, fmt.Errorf("invalid config %s: %w", fname, err)
+	}
 	// log.Printf("[DEBUG] config: %+v", p)
 	return p, nil
 }
+
+// validate checks the values the parser can't, so the mistakes are reported at the start
+func (p *Parameters) validate() error {
+	names := map[string]bool{}
+	for i, h := range p.Download.Hooks {
+		if h.Name == "" {
+			return fmt.Errorf("hook #%d has no name", i+1)
+		}
+		if names[h.Name] {
+			return fmt.Errorf("hook %q is defined twice", h.Name)
+		}
+		names[h.Name] = true
+		if len(h.Command) == 0 && h.Step == "" {
+			return fmt.Errorf("hook %q has neither command nor step", h.Name)
+		}
+		if h.Event != "" && h.Event != "record" && h.Event != "meeting" {
+			return fmt.Errorf("hook %q has unknown event %q", h.Name, h.Event)
+		}
+	}
+	if r := p.Server.DevAuth.Role; r != "" && !model.Role(r).Valid() {
+		return fmt.Errorf("dev_auth has unknown role %q, admin, manager or viewer expected", r)
+	}
+	for i, rule := range p.Server.Roles {
+		if rule.Email == "" {
+			return fmt.Errorf("role rule #%d has no email", i+1)
+		}
+		if _, err := path.Match(rule.Email, ""); err != nil {
+			return fmt.Errorf("role rule #%d has invalid email pattern %q: %w", i+1, rule.Email, err)
+		}
+		if !model.Role(rule.Role).Valid() {
+			return fmt.Errorf("role rule #%d has unknown role %q, admin, manager or viewer expected", i+1, rule.Role)
+		}
+	}
+	return nil
+}
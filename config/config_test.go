@@ -2,6 +2,8 @@ package config
 
 import (
 	"log"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -25,6 +27,15 @@ func Test_LoadConfig(t *testing.T) {
 	assert.NotEmpty(t, conf.Server.AccessKeySalt)
 	assert.NotEmpty(t, conf.Server.JWTSecret)
 	assert.NotEmpty(t, conf.Server.Managers)
+	assert.NotEmpty(t, conf.Server.Admins)
+	assert.Equal(t, []RoleRule{{Email: "*@email.com", Role: "viewer"}}, conf.Server.Roles)
+	assert.Equal(t, "keycloak", conf.Server.OIDC.Name)
+	assert.Empty(t, conf.Server.OIDC.Issuer)
+	assert.Equal(t, []string{"openid", "email", "profile"}, conf.Server.OIDC.Scopes)
+	assert.Empty(t, conf.Server.GitHub.ClientId)
+	assert.False(t, conf.Server.DevAuth.Enabled)
+	assert.Equal(t, 8084, conf.Server.DevAuth.Port)
+	assert.Empty(t, conf.Server.DevAuth.Users)
 
 	assert.NotEmpty(t, conf.Client.AccountId)
 	assert.NotEmpty(t, conf.Client.Id)
@@ -46,8 +57,43 @@ func Test_LoadConfig(t *testing.T) {
 	assert.NotEmpty(t, conf.Syncable.Optional)
 	assert.NotEmpty(t, conf.Syncable.MinDuration)
 
+	assert.Equal(t, []string{conf.Storage.Repository}, conf.Storage.Roots())
+	assert.Equal(t, []string{"/data/disk1", "/data/disk2"}, Storage{Repository: "/tmp", Repositories: []string{"/data/disk1", "/data/disk2"}}.Roots())
+	assert.Equal(t, "most_free", conf.Storage.Placement)
+	assert.Len(t, conf.Storage.Retention, 3)
+	assert.True(t, conf.Storage.Retention[0].Pin)
+	assert.True(t, conf.Storage.Retention[0].Topic.MatchString("Monthly Board Meeting"))
+	assert.Equal(t, 90, conf.Storage.Retention[1].MinAge)
+	assert.Equal(t, []string{"chat_file"}, conf.Storage.Retention[2].Types)
+	assert.Nil(t, conf.Storage.Retention[2].Topic)
+	assert.Equal(t, 730, conf.Storage.Retention[2].MaxAge)
+
 	assert.NotEmpty(t, conf.Commander)
 	assert.NotEmpty(t, conf.Commander.Instances)
 
 	t.Logf("%v+", conf.Storage)
 }
+
+func Test_Validate(t *testing.T) {
+	load := func(yml string) error {
+		fname := filepath.Join(t.TempDir(), "config.yml")
+		if err := os.WriteFile(fname, []byte(yml), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := NewConfig(fname)
+		return err
+	}
+
+	assert.NoError(t, load("download:\n  hooks:\n    - {name: scan, command: [clamdscan]}\n    - {name: verify, event: meeting, step: verify}\n"))
+	assert.ErrorContains(t, load("download:\n  hooks:\n    - {command: [clamdscan]}\n"), "hook #1 has no name")
+	assert.ErrorContains(t, load("download:\n  hooks:\n    - {name: scan}\n"), `hook "scan" has neither command nor step`)
+	assert.ErrorContains(t, load("download:\n  hooks:\n    - {name: scan, step: verify}\n    - {name: scan, step: verify}\n"), "defined twice")
+	assert.ErrorContains(t, load("download:\n  hooks:\n    - {name: scan, event: upload, step: verify}\n"), "unknown event")
+
+	assert.NoError(t, load("server:\n  roles:\n    - {email: \"*@ourcompany.com\", role: viewer}\n    - {email: boss@ourcompany.com, role: admin}\n"))
+	assert.ErrorContains(t, load("server:\n  roles:\n    - {email: \"*@ourcompany.com\", role: Viewer}\n"), `role rule #1 has unknown role "Viewer"`)
+	assert.ErrorContains(t, load("server:\n  roles:\n    - {email: \"*@ourcompany.com\"}\n"), "unknown role")
+	assert.ErrorContains(t, load("server:\n  roles:\n    - {role: viewer}\n"), "role rule #1 has no email")
+	assert.ErrorContains(t, load("server:\n  roles:\n    - {email: \"[*@ourcompany.com\", role: viewer}\n"), "invalid email pattern")
+	assert.ErrorContains(t, load("server:\n  dev_auth:\n    role: root\n"), `dev_auth has unknown role "root"`)
+}
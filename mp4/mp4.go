@@ -0,0 +1,200 @@
+// Package mp4 checks the integrity of MP4/M4A files. The box tree is walked without decoding the media:
+// every box has to fit into its parent, 'ftyp' and 'moov' have to be present, duration is read
+// from 'mvhd' and resolution from the video track header 'tkhd'
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var ErrInvalid = errors.New("invalid mp4 file")
+
+// Info describes the media file
+type Info struct {
+	Brand    string        // major brand of 'ftyp', like "isom" or "M4A "
+	Duration time.Duration // duration of the presentation from 'mvhd'
+	Width    int           // width of the video track, 0 for audio only files
+	Height   int           // height of the video track, 0 for audio only files
+}
+
+// Resolution returns "<width>x<height>" of the video, empty for audio only files
+func (i Info) Resolution() string {
+	if i.Width == 0 || i.Height == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d", i.Width, i.Height)
+}
+
+// containers are the boxes with child boxes walked by Probe
+var containers = map[string]bool{"moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true, "edts": true, "dinf": true}
+
+// maxDepth limits the nesting of the boxes
+const maxDepth = 8
+
+// ProbeFile opens the file and checks it with Probe
+func ProbeFile(path string) (*Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return Probe(f, st.Size())
+}
+
+// Probe walks the box tree of the file of the size and returns the media info.
+// ErrInvalid is returned if the tree is malformed (truncated file included) or 'ftyp', 'moov', 'mvhd' are missing
+func Probe(r io.ReaderAt, size int64) (*Info, error) {
+	p := &prober{r: r, info: &Info{}, found: map[string]bool{}}
+	if err := p.walk(0, size, 0); err != nil {
+		return nil, err
+	}
+	switch {
+	case !p.found["ftyp"]:
+		return nil, fmt.Errorf("%w: no ftyp box", ErrInvalid)
+	case !p.found["moov"]:
+		return nil, fmt.Errorf("%w: no moov box", ErrInvalid)
+	case !p.found["mvhd"]:
+		return nil, fmt.Errorf("%w: no mvhd box", ErrInvalid)
+	}
+	return p.info, nil
+}
+
+type prober struct {
+	r     io.ReaderAt
+	info  *Info
+	found map[string]bool // types of the walked boxes
+}
+
+// walk checks the boxes from start to end, descending into the containers
+func (p *prober) walk(start, end int64, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("%w: boxes nested too deep at %d", ErrInvalid, start)
+	}
+	for off := start; off < end; {
+		if end-off < 8 {
+			return fmt.Errorf("%w: %d trailing bytes at %d", ErrInvalid, end-off, off)
+		}
+		hdr := make([]byte, 16)
+		if _, err := p.r.ReadAt(hdr[:8], off); err != nil {
+			return fmt.Errorf("failed to read box at %d: %w", off, err)
+		}
+		typ := string(hdr[4:8])
+		boxSize, hdrSize := int64(binary.BigEndian.Uint32(hdr)), int64(8)
+		switch boxSize {
+		case 0: // the box extends to the end of the parent
+			boxSize = end - off
+		case 1: // 64-bit size follows the type
+			if end-off < 16 {
+				return fmt.Errorf("%w: truncated %q box header at %d", ErrInvalid, typ, off)
+			}
+			if _, err := p.r.ReadAt(hdr[8:16], off+8); err != nil {
+				return fmt.Errorf("failed to read box at %d: %w", off, err)
+			}
+			boxSize, hdrSize = int64(binary.BigEndian.Uint64(hdr[8:16])), 16
+		}
+		if boxSize < hdrSize || boxSize > end-off {
+			return fmt.Errorf("%w: %q box at %d of %d bytes exceeds its parent", ErrInvalid, typ, off, boxSize)
+		}
+		if depth == 0 && !p.found["ftyp"] && typ != "ftyp" && typ != "free" && typ != "skip" {
+			return fmt.Errorf("%w: %q box before ftyp", ErrInvalid, typ)
+		}
+		p.found[typ] = true
+
+		body, bodySize := off+hdrSize, boxSize-hdrSize
+		var err error
+		switch {
+		case containers[typ]:
+			err = p.walk(body, body+bodySize, depth+1)
+		case typ == "ftyp":
+			err = p.ftyp(body, bodySize)
+		case typ == "mvhd":
+			err = p.mvhd(body, bodySize)
+		case typ == "tkhd":
+			err = p.tkhd(body, bodySize)
+		}
+		if err != nil {
+			return err
+		}
+		off += boxSize
+	}
+	return nil
+}
+
+// read returns the first n bytes of the box body, ErrInvalid if the body is shorter
+func (p *prober) read(typ string, body, bodySize int64, n int) ([]byte, error) {
+	if bodySize < int64(n) {
+		return nil, fmt.Errorf("%w: %q box of %d bytes is too short", ErrInvalid, typ, bodySize)
+	}
+	buf := make([]byte, n)
+	if _, err := p.r.ReadAt(buf, body); err != nil {
+		return nil, fmt.Errorf("failed to read %q box: %w", typ, err)
+	}
+	return buf, nil
+}
+
+func (p *prober) ftyp(body, bodySize int64) error {
+	buf, err := p.read("ftyp", body, bodySize, 8)
+	if err != nil {
+		return err
+	}
+	p.info.Brand = string(buf[:4])
+	return nil
+}
+
+// mvhd reads the timescale and the duration of the presentation
+func (p *prober) mvhd(body, bodySize int64) error {
+	buf, err := p.read("mvhd", body, bodySize, 4)
+	if err != nil {
+		return err
+	}
+	var timescale, duration uint64
+	if buf[0] == 1 {
+		// version, flags, creation and modification time (8 bytes each), timescale, duration (8 bytes)
+		if buf, err = p.read("mvhd", body, bodySize, 32); err != nil {
+			return err
+		}
+		timescale, duration = uint64(binary.BigEndian.Uint32(buf[20:24])), binary.BigEndian.Uint64(buf[24:32])
+	} else {
+		// version, flags, creation and modification time (4 bytes each), timescale, duration (4 bytes)
+		if buf, err = p.read("mvhd", body, bodySize, 20); err != nil {
+			return err
+		}
+		timescale, duration = uint64(binary.BigEndian.Uint32(buf[12:16])), uint64(binary.BigEndian.Uint32(buf[16:20]))
+	}
+	if timescale == 0 {
+		return fmt.Errorf("%w: zero timescale in mvhd", ErrInvalid)
+	}
+	p.info.Duration = time.Duration(duration/timescale)*time.Second +
+		time.Duration(duration%timescale)*time.Second/time.Duration(timescale)
+	return nil
+}
+
+// tkhd reads the width and height of the track, the largest track is the video
+func (p *prober) tkhd(body, bodySize int64) error {
+	buf, err := p.read("tkhd", body, bodySize, 4)
+	if err != nil {
+		return err
+	}
+	// width and height are 16.16 fixed point numbers after the matrix
+	off := 76
+	if buf[0] == 1 {
+		off = 88
+	}
+	if buf, err = p.read("tkhd", body, bodySize, off+8); err != nil {
+		return err
+	}
+	w, h := int(binary.BigEndian.Uint32(buf[off:off+4])>>16), int(binary.BigEndian.Uint32(buf[off+4:off+8])>>16)
+	if w*h > p.info.Width*p.info.Height {
+		p.info.Width, p.info.Height = w, h
+	}
+	return nil
+}
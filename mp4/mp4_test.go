@@ -0,0 +1,89 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// box returns the box of the type with the children
+func box(typ string, children ...[]byte) []byte {
+	body := bytes.Join(children, nil)
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(b, typ...), body...)
+}
+
+// mvhd returns version 0 movie header with the duration in the timescale of 1000
+func mvhd(ms uint32) []byte {
+	b := make([]byte, 100)
+	binary.BigEndian.PutUint32(b[12:], 1000)
+	binary.BigEndian.PutUint32(b[16:], ms)
+	return box("mvhd", b)
+}
+
+// tkhd returns version 0 track header with the size
+func tkhd(w, h uint32) []byte {
+	b := make([]byte, 84)
+	binary.BigEndian.PutUint32(b[76:], w<<16)
+	binary.BigEndian.PutUint32(b[80:], h<<16)
+	return box("tkhd", b)
+}
+
+func ftyp(brand string) []byte {
+	return box("ftyp", []byte(brand), make([]byte, 4), []byte("isom"))
+}
+
+func Test_Probe(t *testing.T) {
+	video := bytes.Join([][]byte{
+		ftyp("isom"),
+		box("moov", mvhd(3723500),
+			box("trak", tkhd(0, 0), box("mdia", box("minf", box("stbl")))),
+			box("trak", tkhd(1920, 1080), box("edts"))),
+		box("mdat", make([]byte, 64)),
+	}, nil)
+	info, err := Probe(bytes.NewReader(video), int64(len(video)))
+	require.NoError(t, err)
+	assert.Equal(t, "isom", info.Brand)
+	assert.Equal(t, time.Hour+2*time.Minute+3*time.Second+500*time.Millisecond, info.Duration)
+	assert.Equal(t, "1920x1080", info.Resolution())
+
+	// audio only, moov after mdat, mdat extends to the end of the file
+	audio := bytes.Join([][]byte{ftyp("M4A "), box("moov", mvhd(5000), box("trak", tkhd(0, 0))), {0, 0, 0, 0}, []byte("mdat"), make([]byte, 32)}, nil)
+	path := filepath.Join(t.TempDir(), "audio.m4a")
+	require.NoError(t, os.WriteFile(path, audio, 0o644))
+	info, err = ProbeFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "M4A ", info.Brand)
+	assert.Equal(t, 5*time.Second, info.Duration)
+	assert.Empty(t, info.Resolution())
+
+	// 64-bit box size
+	large := append(binary.BigEndian.AppendUint32(nil, 1), "mdat"...)
+	large = binary.BigEndian.AppendUint64(large, 16+8)
+	large = append(large, make([]byte, 8)...)
+	withLarge := bytes.Join([][]byte{ftyp("isom"), large, box("moov", mvhd(1000))}, nil)
+	info, err = Probe(bytes.NewReader(withLarge), int64(len(withLarge)))
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, info.Duration)
+
+	invalid := map[string][]byte{
+		"truncated":      video[:len(video)-10],
+		"no moov":        bytes.Join([][]byte{ftyp("isom"), box("mdat", make([]byte, 8))}, nil),
+		"no ftyp":        bytes.Join([][]byte{box("moov", mvhd(1000)), box("mdat")}, nil),
+		"no mvhd":        bytes.Join([][]byte{ftyp("isom"), box("moov", box("trak"))}, nil),
+		"child overflow": bytes.Join([][]byte{ftyp("isom"), box("moov", mvhd(1000), []byte{0, 0, 1, 0, 't', 'r', 'a', 'k'})}, nil),
+		"short mvhd":     bytes.Join([][]byte{ftyp("isom"), box("moov", box("mvhd", make([]byte, 10)))}, nil),
+		"trailing bytes": append(bytes.Join([][]byte{ftyp("isom"), box("moov", mvhd(1000))}, nil), 0, 0, 0),
+		"empty":          {},
+	}
+	for name, data := range invalid {
+		_, err := Probe(bytes.NewReader(data), int64(len(data)))
+		assert.ErrorIs(t, err, ErrInvalid, name)
+	}
+}
@@ -0,0 +1,75 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"github.com/parMaster/zoomrs/blob"
+	"github.com/parMaster/zoomrs/storage/model"
+)
+
+// archiveRecord moves the file of the downloaded record from its repository root to the same key
+// in the archive, the record is marked as archived
+func (r *Repository) archiveRecord(ctx context.Context, rec model.Record) error {
+	store, key, err := r.fileKey(rec)
+	if err != nil {
+		return err
+	}
+	if err := blob.Transfer(ctx, store, r.Archive, key); err != nil {
+		return fmt.Errorf("failed to archive %s: %w", key, err)
+	}
+	if err := r.store.UpdateRecord(ctx, rec.Id, model.StatusArchived, path.Join(r.ArchiveRoot, key)); err != nil {
+		return fmt.Errorf("failed to mark record %s archived: %w", rec.Id, err)
+	}
+	if err := r.removeFromSidecar(ctx, store, key, rec); err != nil {
+		log.Printf("[WARN] failed to update sidecar of %s, %v", rec.Id, err)
+	}
+	if err := r.addToSidecar(ctx, r.Archive, key, rec); err != nil {
+		log.Printf("[WARN] failed to write sidecar of %s, %v", rec.Id, err)
+	}
+	log.Printf("[DEBUG] Archived %s", key)
+	return nil
+}
+
+// RestoreRecord moves the archived record back to the repository root chosen like for a new download
+// and marks it as downloaded.
+// The meeting is marked as watched, so it is evicted again after the never watched ones
+func (r *Repository) RestoreRecord(ctx context.Context, id string) error {
+	rec, err := r.store.GetRecord(ctx, id)
+	if err != nil {
+		return fmt.Errorf("archived record %s: %w", id, err)
+	}
+	if rec.Status != model.StatusArchived {
+		return fmt.Errorf("record %s is %s, not archived", id, rec.Status)
+	}
+	_, key, err := r.fileKey(*rec)
+	if err != nil {
+		return err
+	}
+	root, err := r.placeRecord(rec)
+	if err != nil {
+		return err
+	}
+	err = blob.Transfer(ctx, r.Archive, r.Files[root], key)
+	r.reserved[root].Add(-int64(rec.FileSize))
+	if err != nil {
+		return fmt.Errorf("failed to restore %s: %w", key, err)
+	}
+	if err := r.store.SetRecordDownloaded(ctx, rec.Id, root, path.Join(root, key), rec.Sha256); err != nil {
+		return fmt.Errorf("failed to mark record %s downloaded: %w", rec.Id, err)
+	}
+	if err := r.store.SetMeetingWatched(ctx, rec.MeetingId, time.Now()); err != nil {
+		log.Printf("[WARN] failed to mark meeting %s watched, %v", rec.MeetingId, err)
+	}
+	if err := r.removeFromSidecar(ctx, r.Archive, key, *rec); err != nil {
+		log.Printf("[WARN] failed to update sidecar of %s, %v", rec.Id, err)
+	}
+	if err := r.addToSidecar(ctx, r.Files[root], key, *rec); err != nil {
+		log.Printf("[WARN] failed to write sidecar of %s, %v", rec.Id, err)
+	}
+	log.Printf("[INFO] Restored %s", key)
+	return nil
+}
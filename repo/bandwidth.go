@@ -0,0 +1,99 @@
+package repo
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bandwidthLimiter caps the total download speed of all download workers,
+// implements grab.RateLimiter. Every WaitN call books n bytes of the transfer time
+// after the bookings made before, so the transfers share the bandwidth
+type bandwidthLimiter struct {
+	mx   sync.Mutex
+	rate int64 // bytes per second
+	next time.Time
+}
+
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{rate: rate}
+}
+
+// WaitN blocks until n bytes can be transferred without exceeding the rate
+func (b *bandwidthLimiter) WaitN(ctx context.Context, n int) error {
+	b.mx.Lock()
+	now := time.Now()
+	if b.next.Before(now) {
+		b.next = now
+	}
+	wait := b.next.Sub(now)
+	b.next = b.next.Add(time.Duration(float64(n) / float64(b.rate) * float64(time.Second)))
+	b.mx.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// downloadReservation is the free space reserved on the root for the download in progress. Bytes written
+// to the .part file have left the free space of the drive already, so they are taken off the reservation
+// as they are written. Implements grab.RateLimiter, the shared bandwidth limit applies too
+type downloadReservation struct {
+	reserved  *atomic.Int64 // bytes reserved on the root by all the downloads
+	left      atomic.Int64  // bytes still reserved by this download
+	bandwidth *bandwidthLimiter
+}
+
+// newDownloadReservation takes over size bytes reserved on the root by placeRecord
+func newDownloadReservation(reserved *atomic.Int64, size int64, bandwidth *bandwidthLimiter) *downloadReservation {
+	d := &downloadReservation{reserved: reserved, bandwidth: bandwidth}
+	d.left.Store(size)
+	return d
+}
+
+// WaitN takes n bytes about to be written off the reservation and waits for the bandwidth limiter
+func (d *downloadReservation) WaitN(ctx context.Context, n int) error {
+	d.consume(int64(n))
+	if d.bandwidth == nil {
+		return nil
+	}
+	return d.bandwidth.WaitN(ctx, n)
+}
+
+// consume releases up to n bytes of the reservation
+func (d *downloadReservation) consume(n int64) {
+	for {
+		left := d.left.Load()
+		take := min(n, left)
+		if take <= 0 {
+			return
+		}
+		if d.left.CompareAndSwap(left, left-take) {
+			d.reserved.Add(-take)
+			return
+		}
+	}
+}
+
+// release releases the rest of the reservation
+func (d *downloadReservation) release() {
+	d.consume(math.MaxInt64)
+}
+
+// reset reserves size bytes again, after the .part file is removed
+func (d *downloadReservation) reset(size int64) {
+	d.release()
+	d.reserved.Add(size)
+	d.left.Store(size)
+}
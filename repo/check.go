@@ -0,0 +1,307 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/parMaster/zoomrs/blob"
+	"github.com/parMaster/zoomrs/client"
+	"github.com/parMaster/zoomrs/storage/model"
+)
+
+// CheckProblem is the kind of problem found by Check
+type CheckProblem string
+
+const (
+	ProblemMissing      CheckProblem = "missing"       // file of the record does not exist
+	ProblemEmpty        CheckProblem = "empty"         // file of the record is empty
+	ProblemSizeMismatch CheckProblem = "size_mismatch" // file size differs from the record
+	ProblemHashMismatch CheckProblem = "hash_mismatch" // file SHA-256 differs from the one saved after download
+	ProblemOrphanDir    CheckProblem = "orphan_dir"    // folder in the repository without files of any record
+	ProblemError        CheckProblem = "error"         // file could not be checked
+)
+
+// Repair actions of CheckItem
+const (
+	RepairRequeued      = "requeued"      // queued to download again from the cloud
+	RepairUnrecoverable = "unrecoverable" // marked unrecoverable, not in the cloud anymore
+	RepairRemoved       = "removed"       // empty folder removed
+)
+
+// CheckOptions are the checks and the repairs of Check, repairs are off by default
+type CheckOptions struct {
+	VerifyHash        bool // check SHA-256 of the files, not only the size (reads every file)
+	Requeue           bool // queue the broken records still in the cloud to download again
+	MarkUnrecoverable bool // mark the broken records not in the cloud anymore as unrecoverable
+	RemoveEmptyDirs   bool // remove the folders without any files from the repository roots
+}
+
+// CheckItem is the problem of the record file or the repository folder found by Check
+type CheckItem struct {
+	RecordId  string             `json:"record_id,omitempty"`
+	MeetingId string             `json:"meeting_id,omitempty"`
+	Status    model.RecordStatus `json:"status,omitempty"` // status of the record when checked
+	Path      string             `json:"path"`
+	Problem   CheckProblem       `json:"problem"`
+	Error     string             `json:"error,omitempty"`
+	Repair    string             `json:"repair,omitempty"` // repair action taken, empty if none
+}
+
+// CheckReport is the result of Check
+type CheckReport struct {
+	Checked       int         `json:"checked"` // checked record files
+	Problems      []CheckItem `json:"problems"`
+	Requeued      int         `json:"requeued"`
+	Unrecoverable int         `json:"unrecoverable"`
+	RemovedDirs   int         `json:"removed_dirs"` // removed folders, nested ones included
+}
+
+// Unrepaired returns the number of problems left without repair
+func (rep *CheckReport) Unrepaired() (n int) {
+	for _, p := range rep.Problems {
+		if p.Repair == "" {
+			n++
+		}
+	}
+	return n
+}
+
+// Check verifies the files of all downloaded and archived records and looks for the folders of the
+// repository roots without files of any record. Broken records are requeued if they are still in the cloud,
+// or marked unrecoverable otherwise, and empty folders are removed - if enabled by opts
+func (r *Repository) Check(ctx context.Context, opts CheckOptions) (*CheckReport, error) {
+	report := &CheckReport{Problems: []CheckItem{}}
+	if err := r.checkRecords(ctx, opts, report); err != nil {
+		return report, err
+	}
+	for _, root := range r.cfg.Storage.Roots() {
+		if err := r.checkDirs(ctx, root, opts, report); err != nil {
+			return report, err
+		}
+	}
+	log.Printf("[INFO] Check: %d files checked, %d problems, %d requeued, %d unrecoverable, %d folders removed",
+		report.Checked, len(report.Problems), report.Requeued, report.Unrecoverable, report.RemovedDirs)
+	return report, nil
+}
+
+// checkRecords verifies the files of downloaded and archived records and repairs the broken ones
+func (r *Repository) checkRecords(ctx context.Context, opts CheckOptions, report *CheckReport) error {
+	cloud := map[string]*model.Meeting{} // meeting uuid -> cloud meeting, nil if not in the cloud
+	for _, status := range []model.RecordStatus{model.StatusDownloaded, model.StatusArchived} {
+		recs, err := r.store.GetRecordsByStatus(ctx, status)
+		if err != nil {
+			return fmt.Errorf("failed to get %s records: %w", status, err)
+		}
+		for _, rec := range recs {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			report.Checked++
+			err := r.VerifyFile(ctx, rec, opts.VerifyHash)
+			if err == nil {
+				continue
+			}
+			item := CheckItem{RecordId: rec.Id, MeetingId: rec.MeetingId, Status: rec.Status, Path: rec.FilePath,
+				Problem: fileProblem(err), Error: err.Error()}
+			log.Printf("[WARN] Check: %s record %s, %v", item.Problem, rec.Id, err)
+			if item.Problem != ProblemError && (opts.Requeue || opts.MarkUnrecoverable) {
+				if item.Repair, err = r.repairRecord(ctx, rec, opts, cloud); err != nil {
+					item.Error += "; repair failed: " + err.Error()
+				}
+				switch item.Repair {
+				case RepairRequeued:
+					report.Requeued++
+				case RepairUnrecoverable:
+					report.Unrecoverable++
+				}
+			}
+			report.Problems = append(report.Problems, item)
+		}
+	}
+	return nil
+}
+
+// fileProblem returns the problem of the VerifyFile error
+func fileProblem(err error) CheckProblem {
+	switch {
+	case errors.Is(err, ErrFileMissing):
+		return ProblemMissing
+	case errors.Is(err, ErrFileEmpty):
+		return ProblemEmpty
+	case errors.Is(err, ErrFileSize):
+		return ProblemSizeMismatch
+	case errors.Is(err, ErrFileHash):
+		return ProblemHashMismatch
+	}
+	return ProblemError
+}
+
+// repairRecord queues the record with the broken file to download again if it is still in the cloud,
+// otherwise marks it unrecoverable. Cloud meetings are cached in cloud. Returns the repair action taken
+func (r *Repository) repairRecord(ctx context.Context, rec model.Record, opts CheckOptions, cloud map[string]*model.Meeting) (string, error) {
+	meeting, ok := cloud[rec.MeetingId]
+	if !ok {
+		var err error
+		meeting, err = r.client.GetMeetingRecordings(ctx, rec.MeetingId)
+		if err != nil && !errors.Is(err, client.ErrMeetingNotFound) {
+			return "", fmt.Errorf("failed to get cloud recordings of %s: %w", rec.MeetingId, err)
+		}
+		cloud[rec.MeetingId] = meeting
+	}
+
+	var fresh *model.Record
+	if meeting != nil {
+		for i := range meeting.Records {
+			if meeting.Records[i].Id == rec.Id {
+				fresh = &meeting.Records[i]
+				break
+			}
+		}
+	}
+
+	if fresh == nil {
+		if !opts.MarkUnrecoverable {
+			return "", nil
+		}
+		if err := r.store.UpdateRecord(ctx, rec.Id, model.StatusUnrecoverable, rec.FilePath); err != nil {
+			return "", fmt.Errorf("failed to mark record %s unrecoverable: %w", rec.Id, err)
+		}
+		log.Printf("[INFO] Check: record %s is not in the cloud anymore, marked unrecoverable", rec.Id)
+		return RepairUnrecoverable, nil
+	}
+
+	if !opts.Requeue {
+		return "", nil
+	}
+	// broken file is deleted, so it is not left behind if the record is downloaded to another root
+	if store, key, err := r.fileKey(rec); err == nil {
+		if err := store.Delete(ctx, key); err != nil && !errors.Is(err, blob.ErrNotFound) {
+			return "", fmt.Errorf("failed to delete %s: %w", rec.FilePath, err)
+		}
+		if err := r.removeFromSidecar(ctx, store, key, rec); err != nil {
+			log.Printf("[WARN] failed to update sidecar of %s, %v", rec.Id, err)
+		}
+	}
+	if err := r.store.UpdateRecordSource(ctx, rec.Id, fresh.DownloadURL, fresh.FileSize); err != nil {
+		return "", fmt.Errorf("failed to update record %s: %w", rec.Id, err)
+	}
+	if err := r.store.UpdateRecord(ctx, rec.Id, model.StatusQueued, ""); err != nil {
+		return "", fmt.Errorf("failed to requeue record %s: %w", rec.Id, err)
+	}
+	log.Printf("[INFO] Check: record %s requeued", rec.Id)
+	return RepairRequeued, nil
+}
+
+// checkDirs reports the top-most folders of the root without files of downloaded or unrecoverable records,
+// or downloads in progress. With opts.RemoveEmptyDirs folders without any files are removed, deepest first,
+// except the folders of the records being downloaded
+func (r *Repository) checkDirs(ctx context.Context, root string, opts CheckOptions, report *CheckReport) error {
+	dir := filepath.Clean(root)
+	used := map[string]bool{}     // folders with files of records or downloads in progress
+	hasFiles := map[string]bool{} // folders with any files
+	markParents := func(m map[string]bool, p string) {
+		for d := filepath.Dir(p); d != dir && strings.HasPrefix(d, dir); d = filepath.Dir(d) {
+			m[d] = true
+		}
+	}
+	// broken files of unrecoverable records are kept, they are still tracked
+	for _, status := range []model.RecordStatus{model.StatusDownloaded, model.StatusUnrecoverable} {
+		recs, err := r.store.GetRecordsByStatus(ctx, status)
+		if err != nil {
+			return fmt.Errorf("failed to get %s records: %w", status, err)
+		}
+		for _, rec := range recs {
+			if r.recordRoot(rec) == root {
+				markParents(used, filepath.Clean(rec.FilePath))
+			}
+		}
+	}
+	root = dir
+
+	var dirs []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			log.Printf("[WARN] Check: skipping %s, %v", p, err)
+			return nil
+		}
+		if p == root {
+			return nil
+		}
+		if d.IsDir() {
+			if filepath.Dir(p) == root && strings.HasPrefix(d.Name(), importPrefix) {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, p)
+			return nil
+		}
+		markParents(hasFiles, p)
+		if strings.HasSuffix(p, ".part") {
+			markParents(used, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk %s: %w", root, err)
+	}
+
+	// downloads are placed under the placement lock after they are marked downloading, so the folders
+	// of all the downloads which can create them until the lock is released are known
+	if opts.RemoveEmptyDirs {
+		r.placeMx.Lock()
+		defer r.placeMx.Unlock()
+	}
+	recs, err := r.store.GetRecordsByStatus(ctx, model.StatusDownloading)
+	if err != nil {
+		return fmt.Errorf("failed to get %s records: %w", model.StatusDownloading, err)
+	}
+	for _, rec := range recs {
+		// .part file is in the record folder, the file is saved by the layout when it's done
+		recFolder, _ := rec.Paths(root)
+		markParents(used, filepath.Join(recFolder, rec.Id))
+		key, err := r.layoutKey(ctx, rec, "")
+		if err != nil {
+			return fmt.Errorf("failed to get layout path of %s: %w", rec.Id, err)
+		}
+		markParents(used, filepath.Join(root, filepath.FromSlash(key)))
+	}
+
+	removed := map[string]bool{}
+	if opts.RemoveEmptyDirs {
+		sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+		for _, dir := range dirs {
+			if used[dir] || hasFiles[dir] {
+				continue
+			}
+			if err := os.Remove(dir); err != nil {
+				log.Printf("[WARN] Check: failed to remove %s, %v", dir, err)
+				continue
+			}
+			removed[dir] = true
+		}
+		sort.Strings(dirs)
+		report.RemovedDirs += len(removed)
+	}
+
+	for _, dir := range dirs {
+		parent := filepath.Dir(dir)
+		if used[dir] || (parent != root && !used[parent]) {
+			continue
+		}
+		item := CheckItem{Path: dir, Problem: ProblemOrphanDir}
+		if removed[dir] {
+			item.Repair = RepairRemoved
+		}
+		report.Problems = append(report.Problems, item)
+	}
+	return nil
+}
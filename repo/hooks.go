@@ -0,0 +1,304 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parMaster/zoomrs/config"
+	"github.com/parMaster/zoomrs/storage/model"
+)
+
+// Hook events
+const (
+	HookEventRecord  = "record"  // the recording is downloaded
+	HookEventMeeting = "meeting" // all recordings of the meeting are downloaded
+)
+
+const defaultHookTimeout = 10 * time.Minute
+
+// hookRetryDelay is the pause before the retry of the failed hook, multiplied by the attempt
+var hookRetryDelay = 5 * time.Second
+
+// maxHookOutput limits the command output saved as the hook error
+const maxHookOutput = 1024
+
+// HookEvent describes the downloaded recording or the meeting, passed to the hooks as JSON on stdin
+type HookEvent struct {
+	Event     string       `json:"event"` // record or meeting
+	UUID      string       `json:"uuid"`  // meeting UUID
+	Id        uint64       `json:"id"`    // meeting id
+	Topic     string       `json:"topic"`
+	StartTime string       `json:"start_time"` // time.DateTime, local time
+	HostEmail string       `json:"host_email,omitempty"`
+	Records   []HookRecord `json:"recording_files"` // the downloaded recording, or all downloaded recordings of the meeting
+}
+
+// HookRecord is the downloaded recording of HookEvent
+type HookRecord struct {
+	Id            string           `json:"id"`
+	Type          model.RecordType `json:"recording_type"`
+	StartTime     string           `json:"start_time"` // time.DateTime, local time
+	FileExtension string           `json:"file_extension"`
+	FileSize      int64            `json:"file_size"` // bytes
+	FilePath      string           `json:"file_path"`
+	Sha256        string           `json:"sha256,omitempty"`
+	MediaDuration int              `json:"media_duration,omitempty"` // seconds
+	Resolution    string           `json:"resolution,omitempty"`
+}
+
+// HookStep is the built-in hook, it's configured by the name in download.hooks
+type HookStep func(ctx context.Context, r *Repository, ev HookEvent) error
+
+// hookSteps are the built-in hooks
+var hookSteps = map[string]HookStep{
+	// verify reads the downloaded files again and checks their size and SHA-256
+	"verify": func(ctx context.Context, r *Repository, ev HookEvent) error {
+		recs, err := r.store.GetRecords(ctx, ev.UUID)
+		if err != nil {
+			return err
+		}
+		ids := map[string]bool{}
+		for _, hr := range ev.Records {
+			ids[hr.Id] = true
+		}
+		var result error
+		for _, rec := range recs {
+			if ids[rec.Id] {
+				result = errors.Join(result, r.VerifyFile(ctx, rec, true))
+			}
+		}
+		return result
+	},
+}
+
+// RegisterHookStep adds the built-in hook step, so it can be used in download.hooks by the name.
+// Call it before the downloads are started
+func RegisterHookStep(name string, step HookStep) {
+	hookSteps[name] = step
+}
+
+// CheckHooks checks that the built-in steps of the hooks without a command are known,
+// it's called after the steps are registered
+func CheckHooks(hooks []config.Hook) error {
+	for _, h := range hooks {
+		if _, ok := hookSteps[h.Step]; len(h.Command) == 0 && !ok {
+			return fmt.Errorf("hook %q has unknown step %q", h.Name, h.Step)
+		}
+	}
+	return nil
+}
+
+// runHooks runs the hooks of the event one by one for the downloaded record (record event) or all
+// downloaded records of the meeting (meeting event). Hooks already done for the record or the meeting
+// are skipped, the pipeline stops at the failed hook. Every hook run is saved with its status
+func (r *Repository) runHooks(ctx context.Context, event, meetingId string, rec *model.Record) error {
+	var hooks []config.Hook
+	for _, h := range r.cfg.Download.Hooks {
+		if h.Event == event || (h.Event == "" && event == HookEventRecord) {
+			hooks = append(hooks, h)
+		}
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	id := meetingId
+	if event == HookEventRecord {
+		id = rec.Id
+	}
+	// the meeting can be completed by concurrent downloads, its hooks run once
+	if _, running := r.hooksRunning.LoadOrStore(event+"\x00"+id, true); running {
+		return nil
+	}
+	defer r.hooksRunning.Delete(event + "\x00" + id)
+
+	ev, err := r.hookEvent(ctx, event, meetingId, rec)
+	if err != nil {
+		return err
+	}
+	runs, err := r.store.GetHookRuns(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to get hook runs of %s: %w", id, err)
+	}
+	done := map[string]bool{}
+	for _, run := range runs {
+		done[run.Hook] = run.Status == model.HookDone
+	}
+
+	for _, h := range hooks {
+		if done[h.Name] {
+			continue
+		}
+		run := model.HookRun{Hook: h.Name, Id: id, MeetingId: meetingId, Event: event, Status: model.HookDone}
+		for {
+			run.Attempts++
+			err = r.runHook(ctx, h, ev)
+			if err == nil || run.Attempts > h.Retries || ctx.Err() != nil {
+				break
+			}
+			log.Printf("[WARN] hook %s of %s failed (attempt %d), %v", h.Name, id, run.Attempts, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(hookRetryDelay * time.Duration(run.Attempts)):
+			}
+		}
+		if err != nil {
+			run.Status, run.LastError = model.HookFailed, err.Error()
+		}
+		run.UpdatedAt = time.Now().Format(time.DateTime)
+		if saveErr := r.store.SaveHookRun(ctx, run); saveErr != nil {
+			log.Printf("[ERROR] failed to save hook %s run of %s, %v", h.Name, id, saveErr)
+		}
+		if err != nil {
+			return fmt.Errorf("hook %s of %s failed: %w", h.Name, id, err)
+		}
+		log.Printf("[INFO] hook %s of %s done", h.Name, id)
+	}
+	return nil
+}
+
+// hookEvent returns the details of the record or the meeting for the hooks
+func (r *Repository) hookEvent(ctx context.Context, event, meetingId string, rec *model.Record) (HookEvent, error) {
+	meeting, err := r.store.GetMeeting(ctx, meetingId)
+	if err != nil {
+		return HookEvent{}, fmt.Errorf("failed to get meeting %s: %w", meetingId, err)
+	}
+	ev := HookEvent{Event: event, UUID: meeting.UUID, Id: meeting.Id, Topic: meeting.Topic,
+		StartTime: meeting.DateTime, HostEmail: meeting.HostEmail, Records: []HookRecord{}}
+
+	recs := []model.Record{}
+	if event == HookEventRecord {
+		recs = append(recs, *rec)
+	} else if recs, err = r.store.GetRecords(ctx, meetingId); err != nil {
+		return HookEvent{}, fmt.Errorf("failed to get records of %s: %w", meetingId, err)
+	}
+	for _, rec := range recs {
+		if rec.Status != model.StatusDownloaded && event == HookEventMeeting {
+			continue
+		}
+		startTime := rec.DateTime
+		if startTime == "" {
+			startTime = rec.StartTime.Local().Format(time.DateTime)
+		}
+		ev.Records = append(ev.Records, HookRecord{Id: rec.Id, Type: rec.Type, StartTime: startTime,
+			FileExtension: rec.FileExtension, FileSize: int64(rec.FileSize), FilePath: rec.FilePath, Sha256: rec.Sha256,
+			MediaDuration: rec.MediaDuration, Resolution: rec.Resolution})
+	}
+	return ev, nil
+}
+
+// runHook runs the external command or the built-in step of the hook with the timeout
+func (r *Repository) runHook(ctx context.Context, h config.Hook, ev HookEvent) error {
+	timeout := time.Duration(h.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if len(h.Command) == 0 {
+		step, ok := hookSteps[h.Step]
+		if !ok {
+			return fmt.Errorf("unknown hook step %q", h.Step)
+		}
+		return step(ctx, r, ev)
+	}
+
+	input, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = append(os.Environ(), hookEnv(ev)...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.WaitDelay = 5 * time.Second
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", timeout)
+		}
+		if len(out) > maxHookOutput {
+			out = out[len(out)-maxHookOutput:]
+		}
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// hookEnv returns the ZOOMRS_* environment variables of the event. Record fields are set for the
+// record event only, ZOOMRS_FILE_PATHS lists all the files of the event, one per line
+func hookEnv(ev HookEvent) []string {
+	env := []string{
+		"ZOOMRS_EVENT=" + ev.Event,
+		"ZOOMRS_MEETING_UUID=" + ev.UUID,
+		"ZOOMRS_MEETING_ID=" + strconv.FormatUint(ev.Id, 10),
+		"ZOOMRS_TOPIC=" + ev.Topic,
+		"ZOOMRS_START_TIME=" + ev.StartTime,
+		"ZOOMRS_HOST_EMAIL=" + ev.HostEmail,
+	}
+	paths := make([]string, 0, len(ev.Records))
+	for _, rec := range ev.Records {
+		paths = append(paths, rec.FilePath)
+	}
+	env = append(env, "ZOOMRS_FILE_PATHS="+strings.Join(paths, "\n"))
+	if ev.Event == HookEventRecord && len(ev.Records) == 1 {
+		rec := ev.Records[0]
+		env = append(env,
+			"ZOOMRS_RECORD_ID="+rec.Id,
+			"ZOOMRS_RECORD_TYPE="+rec.Type.String(),
+			"ZOOMRS_FILE_PATH="+rec.FilePath,
+			"ZOOMRS_FILE_SIZE="+strconv.FormatInt(rec.FileSize, 10),
+			"ZOOMRS_SHA256="+rec.Sha256,
+		)
+	}
+	return env
+}
+
+// RunFailedHooks runs the hooks failed after all retries again, with the hooks after them.
+// Records and meetings which are not downloaded anymore are skipped. Returns the number of the retried runs
+func (r *Repository) RunFailedHooks(ctx context.Context) (retried int, result error) {
+	runs, err := r.store.GetHookRunsByStatus(ctx, model.HookFailed)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get failed hook runs: %w", err)
+	}
+	seen := map[string]bool{}
+	for _, run := range runs {
+		if seen[run.Event+"\x00"+run.Id] {
+			continue
+		}
+		seen[run.Event+"\x00"+run.Id] = true
+
+		var rec *model.Record
+		if run.Event == HookEventRecord {
+			recs, err := r.store.GetRecords(ctx, run.MeetingId)
+			if err != nil {
+				result = errors.Join(result, fmt.Errorf("failed to get records of %s: %w", run.MeetingId, err))
+				continue
+			}
+			for i := range recs {
+				if recs[i].Id == run.Id && recs[i].Status == model.StatusDownloaded {
+					rec = &recs[i]
+				}
+			}
+			if rec == nil {
+				log.Printf("[WARN] record %s is not downloaded, hooks skipped", run.Id)
+				continue
+			}
+		} else if !r.meetingRecordsLoaded(ctx, run.MeetingId) {
+			log.Printf("[WARN] meeting %s is not downloaded, hooks skipped", run.MeetingId)
+			continue
+		}
+		retried++
+		result = errors.Join(result, r.runHooks(ctx, run.Event, run.MeetingId, rec))
+	}
+	return retried, result
+}
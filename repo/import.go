@@ -0,0 +1,311 @@
+package repo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/parMaster/zoomrs/blob"
+	"github.com/parMaster/zoomrs/mp4"
+	"github.com/parMaster/zoomrs/storage"
+	"github.com/parMaster/zoomrs/storage/model"
+)
+
+var (
+	ErrInvalidImport = errors.New("invalid import")
+	ErrNoSpace       = errors.New("not enough free space")
+)
+
+// ImportMeta describes the meeting of the imported files
+type ImportMeta struct {
+	MeetingId string           // UUID of the meeting to add the files to, generated from the topic and start time if empty
+	Topic     string           // topic of the new meeting
+	StartTime time.Time        // start time of the meeting, modification time of the first file if zero
+	Type      model.RecordType // type of the recordings, guessed by the file extension if empty
+	Move      bool             // move the files into the repository instead of copying
+}
+
+// importTypes are the recording types guessed by the file extension
+var importTypes = map[string]model.RecordType{
+	"mp4": model.SharedScreenWithSpeakerView,
+	"m4a": model.AudioOnly,
+	"txt": model.ChatFile,
+}
+
+// Orphan is the file in the repository which is not tracked by any record
+type Orphan struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Import adds the file, or all the recording files of the folder, to the catalog as one meeting.
+// Files are placed to the repository with cfg.Storage.Layout like the downloaded ones and marked downloaded,
+// record ids are made of the meeting and SHA-256 of the file, so the same file is not imported to the meeting twice
+func (r *Repository) Import(ctx context.Context, src string, meta ImportMeta) ([]model.Record, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{src}
+	if info.IsDir() {
+		files = nil
+		err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type().IsRegular() && (meta.Type != "" || importTypes[extension(p)] != "") && !isSidecar(p) {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("%w: no recording files in %s", ErrInvalidImport, src)
+		}
+		sort.Strings(files)
+	}
+
+	if meta.StartTime.IsZero() {
+		info, err := os.Stat(files[0])
+		if err != nil {
+			return nil, err
+		}
+		meta.StartTime = info.ModTime()
+	}
+	meeting, err := r.importMeeting(ctx, &meta)
+	if err != nil {
+		return nil, err
+	}
+
+	var imported []model.Record
+	var result error
+	for _, f := range files {
+		rec, err := r.importFile(ctx, f, meeting, meta)
+		if err != nil {
+			result = errors.Join(result, fmt.Errorf("failed to import %s: %w", f, err))
+			continue
+		}
+		log.Printf("[INFO] Imported %s to %s", f, rec.FilePath)
+		imported = append(imported, *rec)
+	}
+	return imported, result
+}
+
+// importMeeting returns the meeting to import the files to, the new meeting is saved to the database
+func (r *Repository) importMeeting(ctx context.Context, meta *ImportMeta) (*model.Meeting, error) {
+	if meta.MeetingId != "" {
+		meeting, err := r.store.GetMeeting(ctx, meta.MeetingId)
+		if err == nil || !errors.Is(err, storage.ErrNoRows) {
+			return meeting, err
+		}
+	} else {
+		h := sha256.Sum256([]byte(meta.Topic + "\x00" + meta.StartTime.UTC().Format(time.RFC3339)))
+		meta.MeetingId = "import-" + hex.EncodeToString(h[:12])
+		if meeting, err := r.store.GetMeeting(ctx, meta.MeetingId); err == nil || !errors.Is(err, storage.ErrNoRows) {
+			return meeting, err
+		}
+	}
+	if meta.Topic == "" {
+		return nil, fmt.Errorf("%w: topic of the new meeting %s is not set", ErrInvalidImport, meta.MeetingId)
+	}
+	meeting := model.Meeting{UUID: meta.MeetingId, Topic: meta.Topic, StartTime: meta.StartTime}
+	if err := r.store.SaveMeeting(ctx, meeting); err != nil {
+		return nil, fmt.Errorf("failed to save meeting %s: %w", meeting.UUID, err)
+	}
+	return r.store.GetMeeting(ctx, meeting.UUID)
+}
+
+// importFile puts the file to the repository and saves it as the downloaded record of the meeting
+func (r *Repository) importFile(ctx context.Context, src string, meeting *model.Meeting, meta ImportMeta) (*model.Record, error) {
+	tp := meta.Type
+	if tp == "" {
+		if tp = importTypes[extension(src)]; tp == "" {
+			return nil, fmt.Errorf("%w: unknown recording type of %s", ErrInvalidImport, path.Base(src))
+		}
+	}
+	sum, err := fileSha256(src)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, fmt.Errorf("%w: file is empty", ErrInvalidImport)
+	}
+
+	// the same file can be imported to different meetings
+	id := sha256.Sum256([]byte(meeting.UUID + "\x00" + sum))
+	start := meta.StartTime.Local()
+	rec := &model.Record{Id: "import-" + hex.EncodeToString(id[:12]), MeetingId: meeting.UUID, Type: tp, StartTime: start,
+		DateTime: start.Format(time.DateTime), FileExtension: strings.ToUpper(extension(src)),
+		FileSize: model.FileSize(info.Size()), Sha256: sum, Status: model.StatusDownloaded}
+	// media info of the imported files is best effort, old recordings are imported as is
+	if media, err := mp4.ProbeFile(src); err == nil && (rec.FileExtension == "MP4" || rec.FileExtension == "M4A") {
+		rec.MediaDuration, rec.Resolution = int(media.Duration.Round(time.Second).Seconds()), media.Resolution()
+	}
+	recs, err := r.store.GetRecords(ctx, meeting.UUID)
+	if err != nil {
+		return nil, err
+	}
+	for _, existing := range recs {
+		if existing.Id == rec.Id {
+			return nil, fmt.Errorf("%w: already imported as %s", ErrInvalidImport, rec.Id)
+		}
+	}
+
+	key, err := renderLayout(r.cfg.Storage.Layout, *rec, meeting.Topic, filepath.Base(src))
+	if err != nil {
+		return nil, err
+	}
+	root, err := r.placeRecord(rec)
+	if err != nil {
+		return nil, err
+	}
+	defer r.reserved[root].Add(-int64(rec.FileSize))
+	store := r.Files[root]
+	if _, err := store.Stat(ctx, key); !errors.Is(err, blob.ErrNotFound) {
+		return nil, fmt.Errorf("%w: %s already exists in %s", ErrPathTaken, key, root)
+	}
+	if meta.Move {
+		err = blob.PutFile(ctx, store, key, src)
+	} else {
+		err = putCopy(ctx, store, key, src)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to save %s: %w", key, err)
+	}
+
+	rec.Root, rec.FilePath = root, filepath.Join(root, filepath.FromSlash(key))
+	if err := r.store.SaveRecord(ctx, *rec); err != nil {
+		return nil, fmt.Errorf("failed to save record %s: %w", rec.Id, err)
+	}
+	if err := r.addToSidecar(ctx, store, key, *rec); err != nil {
+		log.Printf("[WARN] failed to write sidecar of %s, %v", rec.Id, err)
+	}
+	return rec, nil
+}
+
+// putCopy copies the local file to the store
+func putCopy(ctx context.Context, store blob.Store, key, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, key, f, info.Size())
+}
+
+// extension returns the lower case extension of the file without the dot
+func extension(name string) string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+}
+
+// Orphans returns the files in the repository roots which are not tracked by any downloaded record.
+// Sidecars and the files of downloads in progress are not reported
+func (r *Repository) Orphans(ctx context.Context) ([]Orphan, error) {
+	tracked := map[string]bool{}
+	recs, err := r.store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get downloaded records: %w", err)
+	}
+	for _, rec := range recs {
+		if _, key, err := r.fileKey(rec); err == nil {
+			tracked[r.recordRoot(rec)+"\x00"+key] = true
+		}
+	}
+
+	orphans := []Orphan{}
+	for _, root := range r.cfg.Storage.Roots() {
+		files, err := r.Files[root].List(ctx, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", root, err)
+		}
+		for _, f := range files {
+			if tracked[root+"\x00"+f.Key] || isSidecar(f.Key) || strings.HasSuffix(f.Key, ".part") ||
+				strings.HasSuffix(f.Key, ".tmp") || strings.HasPrefix(f.Key, importPrefix) {
+				continue
+			}
+			orphans = append(orphans, Orphan{Path: filepath.Join(root, filepath.FromSlash(f.Key)), Size: f.Size, ModTime: f.ModTime})
+		}
+	}
+	return orphans, nil
+}
+
+// importPrefix is the prefix of the temporary folders of the uploaded files in the repository root
+const importPrefix = ".import-"
+
+// ImportReader saves the uploaded file of up to size bytes to a temporary folder in the repository root and
+// imports it with the name, so the file is moved to its place without copying. The root is chosen and the space
+// is reserved like for the download, ErrNoSpace is returned if the root can't keep cfg.Storage.KeepFreeSpace free
+func (r *Repository) ImportReader(ctx context.Context, name string, src io.Reader, size int64, meta ImportMeta) ([]model.Record, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("%w: size of the upload is unknown", ErrInvalidImport)
+	}
+	name = sanitize(filepath.Base(name))
+	dir, err := r.saveUpload(name, src, size)
+	if dir != "" {
+		defer os.RemoveAll(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta.Move = true
+	return r.Import(ctx, filepath.Join(dir, name), meta)
+}
+
+// saveUpload writes the upload to the new temporary folder of the root chosen for it, the space is reserved
+// until the file is written. Returns the folder, it's removed by the caller
+func (r *Repository) saveUpload(name string, src io.Reader, size int64) (string, error) {
+	upload := &model.Record{Id: name, FileSize: model.FileSize(size)}
+	root, err := r.placeRecord(upload)
+	if err != nil {
+		return "", err
+	}
+	defer r.reserved[root].Add(-size)
+	usage, err := r.diskUsage(root)
+	if err != nil {
+		return "", fmt.Errorf("failed to get disk usage of %s: %w", root, err)
+	}
+	if usage.Free < r.cfg.Storage.KeepFreeSpace {
+		return "", fmt.Errorf("%w on %s for the upload of %s", ErrNoSpace, root, model.FileSize(size))
+	}
+
+	dir, err := os.MkdirTemp(root, importPrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return dir, err
+	}
+	n, err := io.Copy(f, io.LimitReader(src, size+1))
+	if err != nil {
+		f.Close()
+		return dir, fmt.Errorf("failed to save %s: %w", name, err)
+	}
+	if n > size {
+		f.Close()
+		return dir, fmt.Errorf("%w: %s is bigger than %s", ErrInvalidImport, name, model.FileSize(size))
+	}
+	return dir, f.Close()
+}
@@ -0,0 +1,207 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/parMaster/zoomrs/blob"
+	"github.com/parMaster/zoomrs/storage/model"
+)
+
+// defaultLayout keeps the files where they were stored before layouts were configurable
+const defaultLayout = "{date}/{id}/{filename}"
+
+// layoutPlaceholders removes the known placeholders from the layout
+var layoutPlaceholders = strings.NewReplacer("{date}", "", "{start_time}", "", "{topic}", "", "{meeting}", "",
+	"{type}", "", "{ext}", "", "{id}", "", "{filename}", "")
+
+// maxElementLen limits the length of the placeholder value in bytes, so the file names stay within the file system limits
+const maxElementLen = 100
+
+// Relocation is the move of the record file to the path of the current layout
+type Relocation struct {
+	Id   string `json:"id"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// sanitize makes the placeholder value safe to be a part of a file name: path separators, characters
+// reserved on Windows and control characters are replaced with "_", leading and trailing spaces and dots
+// are trimmed, so the value can't be "." or ".."
+func sanitize(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, value)
+	value = strings.Trim(value, " .")
+	if len(value) > maxElementLen {
+		value = value[:maxElementLen]
+		for !utf8.ValidString(value) {
+			value = value[:len(value)-1]
+		}
+		value = strings.TrimRight(value, " .")
+	}
+	if value == "" {
+		return "_"
+	}
+	return value
+}
+
+// renderLayout returns the key of the record file in the repository root by the layout template.
+// Placeholders: {date} and {start_time} of the record, {topic} and {meeting} (UUID) of the meeting,
+// {type}, {ext} and {id} of the record, {filename} - the file name sent by Zoom
+func renderLayout(layout string, rec model.Record, topic, filename string) (string, error) {
+	if layout == "" {
+		layout = defaultLayout
+	}
+	if strings.ContainsAny(layoutPlaceholders.Replace(layout), "{}") {
+		return "", fmt.Errorf("unknown placeholder in layout %q", layout)
+	}
+	date, startTime, _ := strings.Cut(rec.DateTime, " ")
+	key := strings.NewReplacer(
+		"{date}", sanitize(date),
+		"{start_time}", sanitize(strings.ReplaceAll(startTime, ":", "-")),
+		"{topic}", sanitize(topic),
+		"{meeting}", sanitize(rec.MeetingId),
+		"{type}", sanitize(string(rec.Type)),
+		"{ext}", sanitize(strings.ToLower(rec.FileExtension)),
+		"{id}", sanitize(rec.Id),
+		"{filename}", sanitize(filename),
+	).Replace(layout)
+	if !fs.ValidPath(key) || key == "." {
+		return "", fmt.Errorf("layout %q gives invalid path %q for record %s", layout, key, rec.Id)
+	}
+	return key, nil
+}
+
+// CheckLayout validates the layout template with a sample record, so a bad cfg.Storage.Layout
+// is reported at the start instead of failing every download
+func CheckLayout(layout string) error {
+	sample := model.Record{Id: "id", MeetingId: "meeting", Type: model.SharedScreenWithGalleryView,
+		FileExtension: "MP4", DateTime: "2024-01-10 10:05:00"}
+	_, err := renderLayout(layout, sample, "topic", "recording.mp4")
+	return err
+}
+
+// layoutKey returns the key of the record file by cfg.Storage.Layout, the meeting topic is loaded if it's used
+func (r *Repository) layoutKey(ctx context.Context, rec model.Record, filename string) (string, error) {
+	topic := ""
+	if strings.Contains(r.cfg.Storage.Layout, "{topic}") {
+		meeting, err := r.store.GetMeeting(ctx, rec.MeetingId)
+		if err != nil {
+			return "", fmt.Errorf("failed to get meeting %s: %w", rec.MeetingId, err)
+		}
+		topic = meeting.Topic
+	}
+	return renderLayout(r.cfg.Storage.Layout, rec, topic, filename)
+}
+
+// Relayout moves the files of the downloaded records to the paths of the current cfg.Storage.Layout,
+// the file name sent by Zoom is the current name of the file. Paths of all the moved records are updated
+// in one transaction, the files are moved back if it fails. Records which can't be moved (the target
+// is taken by another file or record) are reported in the error and left in place.
+// With dryRun only the planned moves are returned
+func (r *Repository) Relayout(ctx context.Context, dryRun bool) (moves []Relocation, result error) {
+	recs, err := r.store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get downloaded records: %w", err)
+	}
+
+	type move struct {
+		Relocation
+		store    *blob.Local
+		from, to string
+		rec      model.Record
+	}
+	var planned []move
+	targets := map[string]string{} // target path -> record id
+	for _, rec := range recs {
+		store, key, err := r.fileKey(rec)
+		if err != nil {
+			result = errors.Join(result, err)
+			continue
+		}
+		local, ok := store.(*blob.Local)
+		if !ok {
+			result = errors.Join(result, fmt.Errorf("record %s is not in the local repository", rec.Id))
+			continue
+		}
+		newKey, err := r.layoutKey(ctx, rec, path.Base(key))
+		if err != nil {
+			result = errors.Join(result, err)
+			continue
+		}
+		if newKey == key {
+			continue
+		}
+		to := local.Path(newKey)
+		if id, ok := targets[to]; ok {
+			result = errors.Join(result, fmt.Errorf("records %s and %s have the same path %s, add {id} to the layout", id, rec.Id, to))
+			continue
+		}
+		if _, err := local.Stat(ctx, newKey); !errors.Is(err, blob.ErrNotFound) {
+			result = errors.Join(result, fmt.Errorf("can't move record %s, %s already exists", rec.Id, to))
+			continue
+		}
+		targets[to] = rec.Id
+		planned = append(planned, move{Relocation{Id: rec.Id, From: rec.FilePath, To: to}, local, key, newKey, rec})
+	}
+	if dryRun {
+		for _, m := range planned {
+			moves = append(moves, m.Relocation)
+		}
+		return moves, result
+	}
+
+	var moved []move
+	for _, m := range planned {
+		if err := ctx.Err(); err != nil {
+			result = errors.Join(result, err)
+			break
+		}
+		if err := m.store.Rename(ctx, m.from, m.to); err != nil {
+			result = errors.Join(result, fmt.Errorf("failed to move %s: %w", m.From, err))
+			continue
+		}
+		moved = append(moved, m)
+	}
+	if len(moved) == 0 {
+		return nil, result
+	}
+
+	paths := map[string]string{}
+	for _, m := range moved {
+		paths[m.Id] = filepath.Join(m.store.Root(), filepath.FromSlash(m.to))
+	}
+	if err := r.store.UpdateRecordPaths(ctx, paths); err != nil {
+		result = errors.Join(result, fmt.Errorf("failed to update records paths: %w", err))
+		for _, m := range moved {
+			if err := m.store.Rename(ctx, m.to, m.from); err != nil {
+				log.Printf("[ERROR] failed to move %s back to %s, %v", m.To, m.From, err)
+				result = errors.Join(result, fmt.Errorf("failed to move %s back: %w", m.To, err))
+			}
+		}
+		return nil, result
+	}
+	for _, m := range moved {
+		log.Printf("[DEBUG] Moved %s to %s", m.From, m.To)
+		moves = append(moves, m.Relocation)
+		if err := r.removeFromSidecar(ctx, m.store, m.from, m.rec); err != nil {
+			log.Printf("[WARN] failed to update sidecar of %s, %v", m.Id, err)
+		}
+		if err := r.addToSidecar(ctx, m.store, m.to, m.rec); err != nil {
+			log.Printf("[WARN] failed to write sidecar of %s, %v", m.Id, err)
+		}
+	}
+	return moves, result
+}
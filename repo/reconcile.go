@@ -0,0 +1,193 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"text/tabwriter"
+	"time"
+
+	"github.com/parMaster/zoomrs/storage/model"
+)
+
+// ReconcileItem is a recording found by Reconcile in the cloud or in the local catalog only,
+// or with different size or status
+type ReconcileItem struct {
+	MeetingId string             `json:"meeting_id"`
+	RecordId  string             `json:"record_id"`
+	Topic     string             `json:"topic,omitempty"`
+	DateTime  string             `json:"date_time"`
+	Type      model.RecordType   `json:"type"`
+	CloudSize model.FileSize     `json:"cloud_size"`
+	LocalSize model.FileSize     `json:"local_size"`
+	Status    model.RecordStatus `json:"status,omitempty"` // local status
+	Reason    string             `json:"reason,omitempty"`
+}
+
+// ReconcileReport is the result of comparison of the Zoom cloud recordings and the local catalog
+type ReconcileReport struct {
+	CloudOnly      []ReconcileItem `json:"cloud_only"`      // syncable recordings in the cloud, never synced
+	LocalOnly      []ReconcileItem `json:"local_only"`      // recordings waiting for download, but not in the cloud anymore
+	SizeMismatch   []ReconcileItem `json:"size_mismatch"`   // file size in the cloud differs from the catalog
+	StatusMismatch []ReconcileItem `json:"status_mismatch"` // 'downloaded' with bad or missing file, 'lost' but still in the cloud
+	Queued         int             `json:"queued"`          // recordings queued to download
+}
+
+// Reconcile compares all the meetings in the cloud with the local catalog. Meetings which are not synced
+// because of duration or recording types are not reported. With queue, cloud-only recordings are queued
+// to download, and 'lost' recordings still in the cloud are requeued
+func (r *Repository) Reconcile(ctx context.Context, queue bool) (*ReconcileReport, error) {
+	cloud, err := r.client.GetAllMeetingsWithRetry(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cloud meetings, %w", err)
+	}
+
+	meetings, err := r.store.GetMeetings(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get local meetings, %w", err)
+	}
+	local := map[string]map[string]model.Record{} // meeting uuid -> record id -> record
+	for _, m := range meetings {
+		recs, err := r.store.GetRecords(ctx, m.UUID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get records of %s, %w", m.UUID, err)
+		}
+		local[m.UUID] = map[string]model.Record{}
+		for _, rec := range recs {
+			local[m.UUID][rec.Id] = rec
+		}
+	}
+
+	report := &ReconcileReport{CloudOnly: []ReconcileItem{}, LocalOnly: []ReconcileItem{},
+		SizeMismatch: []ReconcileItem{}, StatusMismatch: []ReconcileItem{}}
+	var newMeetings []model.Meeting
+	var newRecords, lostRecords []model.Record
+
+	inCloud := map[string]bool{} // record ids
+	seen := map[string]bool{}    // meeting uuids, chunks of GetAllMeetings overlap
+	for _, cm := range cloud {
+		if seen[cm.UUID] {
+			continue
+		}
+		seen[cm.UUID] = true
+		for _, rec := range cm.Records {
+			inCloud[rec.Id] = true
+		}
+		if cm.Duration < r.cfg.Syncable.MinDuration {
+			continue
+		}
+
+		wanted := r.syncableRecords(cm.Records)
+		recs, synced := local[cm.UUID]
+		if !synced && len(wanted) > 0 {
+			newMeetings = append(newMeetings, cm)
+		}
+		for _, rec := range wanted {
+			rec.MeetingId = cm.UUID
+			item := ReconcileItem{MeetingId: cm.UUID, RecordId: rec.Id, Topic: cm.Topic,
+				DateTime: rec.StartTime.Local().Format(time.DateTime), Type: rec.Type, CloudSize: rec.FileSize}
+
+			l, ok := recs[rec.Id]
+			if !ok {
+				report.CloudOnly = append(report.CloudOnly, item)
+				if synced {
+					newRecords = append(newRecords, rec)
+				}
+				continue
+			}
+
+			item.LocalSize, item.Status = l.FileSize, l.Status
+			if l.FileSize != rec.FileSize {
+				report.SizeMismatch = append(report.SizeMismatch, item)
+			}
+			switch l.Status {
+			case model.StatusLost:
+				item.Reason = "marked as lost, but it's in the cloud"
+				report.StatusMismatch = append(report.StatusMismatch, item)
+				lostRecords = append(lostRecords, rec)
+			case model.StatusUnrecoverable:
+				item.Reason = "marked as unrecoverable, but it's in the cloud"
+				report.StatusMismatch = append(report.StatusMismatch, item)
+				lostRecords = append(lostRecords, rec)
+			case model.StatusDownloaded:
+				if err := r.VerifyFile(ctx, l, false); err != nil {
+					item.Reason = err.Error()
+					report.StatusMismatch = append(report.StatusMismatch, item)
+				}
+			}
+		}
+	}
+
+	for _, m := range meetings {
+		for _, rec := range local[m.UUID] {
+			if inCloud[rec.Id] {
+				continue
+			}
+			switch rec.Status {
+			case model.StatusQueued, model.StatusDownloading, model.StatusFailed, model.StatusCorrupt, model.StatusAbandoned:
+				report.LocalOnly = append(report.LocalOnly, ReconcileItem{MeetingId: m.UUID, RecordId: rec.Id, Topic: m.Topic,
+					DateTime: rec.DateTime, Type: rec.Type, LocalSize: rec.FileSize, Status: rec.Status,
+					Reason: "not in the cloud, can't be downloaded"})
+			}
+		}
+	}
+
+	log.Printf("[INFO] Reconcile: %d cloud meetings, %d local meetings, %d cloud only, %d local only, %d size mismatch, %d status mismatch",
+		len(seen), len(meetings), len(report.CloudOnly), len(report.LocalOnly), len(report.SizeMismatch), len(report.StatusMismatch))
+
+	if !queue {
+		return report, nil
+	}
+
+	if err := r.SyncMeetings(ctx, &newMeetings); err != nil {
+		return report, fmt.Errorf("failed to queue new meetings, %w", err)
+	}
+	report.Queued = len(report.CloudOnly) - len(newRecords)
+	for _, rec := range newRecords {
+		if err := r.store.SaveRecord(ctx, rec); err != nil {
+			return report, fmt.Errorf("failed to queue record %s, %w", rec.Id, err)
+		}
+		report.Queued++
+	}
+	for _, rec := range lostRecords {
+		if err := r.store.UpdateRecordSource(ctx, rec.Id, rec.DownloadURL, rec.FileSize); err != nil {
+			return report, fmt.Errorf("failed to update record %s, %w", rec.Id, err)
+		}
+		if err := r.store.UpdateRecord(ctx, rec.Id, model.StatusQueued, ""); err != nil {
+			return report, fmt.Errorf("failed to requeue record %s, %w", rec.Id, err)
+		}
+		report.Queued++
+	}
+	log.Printf("[INFO] Reconcile: %d records queued", report.Queued)
+
+	return report, nil
+}
+
+// WriteTable writes the report as a text table, section by section
+func (rep *ReconcileReport) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	sections := []struct {
+		title string
+		items []ReconcileItem
+	}{
+		{"Cloud only", rep.CloudOnly},
+		{"Local only", rep.LocalOnly},
+		{"Size mismatch", rep.SizeMismatch},
+		{"Status mismatch", rep.StatusMismatch},
+	}
+	for _, s := range sections {
+		fmt.Fprintf(tw, "%s: %d\n", s.title, len(s.items))
+		if len(s.items) == 0 {
+			continue
+		}
+		fmt.Fprintln(tw, "DATE\tMEETING\tRECORD\tTYPE\tCLOUD SIZE\tLOCAL SIZE\tSTATUS\tTOPIC\tREASON")
+		for _, i := range s.items {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				i.DateTime, i.MeetingId, i.RecordId, i.Type, i.CloudSize, i.LocalSize, i.Status, i.Topic, i.Reason)
+		}
+		fmt.Fprintln(tw)
+	}
+	fmt.Fprintf(tw, "Queued: %d\n", rep.Queued)
+	return tw.Flush()
+}
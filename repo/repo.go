@@ -3,34 +3,69 @@ package repo
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cavaliergopher/grab/v3"
 	"github.com/shirou/gopsutil/v4/disk"
 
+	"github.com/parMaster/zoomrs/blob"
 	"github.com/parMaster/zoomrs/client"
 	"github.com/parMaster/zoomrs/config"
+	"github.com/parMaster/zoomrs/mp4"
 	"github.com/parMaster/zoomrs/storage"
 	"github.com/parMaster/zoomrs/storage/model"
 )
 
+// SyncCursor is the name of the cursor with the last day synced by SyncJob
+const SyncCursor = "sync"
+
+const (
+	syncChunkDays      = 30
+	defaultMaxAttempts = 5
+	defaultRetryDelay  = 1 * time.Minute
+	maxRetryDelay      = 6 * time.Hour
+)
+
+// downloadQueuedPause is the pause of DownloadQueued after a failed download
+var downloadQueuedPause = 30 * time.Second
+
 var (
 	ErrNoQueuedRecords = errors.New("no records queued to download")
+	ErrRecordLost      = errors.New("record is not in the cloud anymore")
+	ErrFileMissing     = errors.New("file does not exist")
+	ErrFileEmpty       = errors.New("file is empty")
+	ErrFileSize        = errors.New("file size does not match")
+	ErrFileHash        = errors.New("file sha256 does not match")
+	ErrCorrupt         = errors.New("downloaded file is corrupt")
+	ErrPathTaken       = errors.New("file path is taken by another file")
+	errRangeIgnored    = errors.New("server ignored range request, can't resume download")
 )
 
 // Client is an interface for the Zoom API client
 type Client interface {
 	Authorize() error
 	GetMeetings(ctx context.Context, daysAgo int) ([]model.Meeting, error)
+	GetIntervalMeetings(ctx context.Context, from, to time.Time) ([]model.Meeting, error)
+	GetAllMeetingsWithRetry(ctx context.Context) ([]model.Meeting, error)
 	GetToken() (*client.AccessToken, error)
-	DeleteMeetingRecordings(meetingId string, delete bool) error
+	DeleteMeetingRecordings(ctx context.Context, meetingId string, delete bool) error
+	GetMeetingRecordings(ctx context.Context, meetingId string) (*model.Meeting, error)
+	GetTrashedMeetingRecordings(ctx context.Context, hostId, meetingId string, start time.Time) (*model.Meeting, error)
 }
 
 // syncable is a struct that holds record types grouped by priority for syncing
@@ -50,6 +85,22 @@ type Repository struct {
 	client   Client
 	cfg      *config.Parameters
 	Syncable syncable
+	syncMx   sync.Mutex // SyncMeetings is called by SyncJob and webhooks concurrently
+
+	claimMx   sync.Mutex               // serializes claiming queued records and resetting failed ones
+	inFlight  int                      // number of downloads in progress, guarded by claimMx
+	reserved  map[string]*atomic.Int64 // bytes reserved on every root by downloads in progress
+	placeMx   sync.Mutex               // serializes choosing the root and reserving space on it
+	saveMx    sync.Mutex               // serializes checking the layout path is free and saving the file to it
+	evictMx   sync.Mutex               // only one download worker frees up space at a time
+	bandwidth *bandwidthLimiter        // shared by all download workers, nil if not limited
+
+	hooksRunning sync.Map // "<event>\x00<record id or meeting uuid>" of the hooks in progress
+	sidecarMx    sync.Map // *sync.Mutex of the sidecars by sidecarLock, one per folder
+
+	Files       map[string]blob.Store // downloaded recordings by root, cfg.Storage.Roots() folders
+	Archive     blob.Store            // evicted recordings, cfg.Storage.Archive folder or cfg.Storage.ArchiveS3 bucket, nil if not set
+	ArchiveRoot string                // archived records paths start with it, cfg.Storage.Archive, "archive" for the bucket by default
 }
 
 func NewRepository(store storage.Storer, client Client, cfg *config.Parameters) *Repository {
@@ -69,10 +120,37 @@ func NewRepository(store storage.Storer, client Client, cfg *config.Parameters)
 		sync.Optional[model.RecordType(t)] = true
 	}
 
-	return &Repository{store: store, client: client, cfg: cfg, Syncable: sync}
+	r := &Repository{store: store, client: client, cfg: cfg, Syncable: sync,
+		bandwidth: newBandwidthLimiter(cfg.Download.BandwidthLimit),
+		reserved:  map[string]*atomic.Int64{},
+		Files:     map[string]blob.Store{}}
+	for _, root := range cfg.Storage.Roots() {
+		r.reserved[root] = &atomic.Int64{}
+		r.Files[root] = blob.NewLocal(root)
+	}
+
+	if layout := cfg.Storage.Layout; layout != "" && !strings.Contains(layout, "{id}") {
+		log.Printf("[WARN] storage layout %q has no {id}, records with the same path fail to download", layout)
+	}
+
+	switch {
+	case cfg.Storage.ArchiveS3.Bucket != "":
+		// archived records paths and media urls start with the archive name
+		r.ArchiveRoot = cfg.Storage.Archive
+		if r.ArchiveRoot == "" {
+			r.ArchiveRoot = "archive"
+		}
+		r.Archive = blob.NewS3(cfg.Storage.ArchiveS3)
+	case cfg.Storage.Archive != "":
+		r.ArchiveRoot = cfg.Storage.Archive
+		r.Archive = blob.NewLocal(cfg.Storage.Archive)
+	}
+	return r
 }
 
-// SyncJob is a long running job that tries SyncMeeting on a regular interval
+// SyncJob is a long running job that syncs meetings on a regular interval. Every run covers the days
+// from the sync cursor (the last synced day) up to today, so the days missed while the service
+// was down are caught up
 func (r *Repository) SyncJob(ctx context.Context) {
 
 	if len(r.Syncable.Important)+len(r.Syncable.Alternative)+len(r.Syncable.Optional) == 0 {
@@ -82,20 +160,11 @@ func (r *Repository) SyncJob(ctx context.Context) {
 
 	ticker := time.NewTicker(60 * time.Minute)
 	for {
-		meetings, err := r.client.GetMeetings(ctx, 1)
-		if err != nil {
-			log.Printf("[ERROR] failed to get meetings, %v, retrying in 30 sec", err)
-
-			select {
-			case <-ctx.Done():
-				return
-			case <-time.After(30 * time.Second):
-				continue
-			}
+		from, err := r.syncFrom(ctx)
+		if err == nil {
+			err = r.SyncRange(ctx, from, time.Now(), SyncCursor)
 		}
-		log.Printf("[DEBUG] Syncing meetings - %d in feed", len(meetings))
-
-		if err = r.SyncMeetings(ctx, &meetings); err != nil {
+		if err != nil {
 			log.Printf("[ERROR] failed to sync meetings, %v, retrying in 30 sec", err)
 			select {
 			case <-ctx.Done():
@@ -113,6 +182,53 @@ func (r *Repository) SyncJob(ctx context.Context) {
 	}
 }
 
+// syncFrom returns the first day to sync: the day before the sync cursor, as recordings of the meetings
+// ended late can become available after the day is over. Yesterday if the cursor is not set
+func (r *Repository) syncFrom(ctx context.Context) (time.Time, error) {
+	cursor, err := r.store.GetCursor(ctx, SyncCursor)
+	if err == storage.ErrNoRows {
+		return time.Now().AddDate(0, 0, -1), nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get sync cursor, %w", err)
+	}
+	from, err := time.ParseInLocation(time.DateOnly, cursor, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse sync cursor %q, %w", cursor, err)
+	}
+	return from.AddDate(0, 0, -1), nil
+}
+
+// SyncRange syncs meetings of the from-to days (inclusive) in chunks of syncChunkDays, as Zoom API
+// doesn't return more than a month of recordings at once. If cursor is not empty, the cursor with
+// this name is moved to the last day of every synced chunk
+func (r *Repository) SyncRange(ctx context.Context, from, to time.Time, cursor string) error {
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.Local)
+	for start := from; !start.After(to); start = start.AddDate(0, 0, syncChunkDays) {
+		end := start.AddDate(0, 0, syncChunkDays-1)
+		if end.After(to) {
+			end = to
+		}
+
+		meetings, err := r.client.GetIntervalMeetings(ctx, start, end)
+		if err != nil {
+			return fmt.Errorf("failed to get meetings %s - %s, %w", start.Format(time.DateOnly), end.Format(time.DateOnly), err)
+		}
+		log.Printf("[DEBUG] Syncing meetings %s - %s - %d in feed", start.Format(time.DateOnly), end.Format(time.DateOnly), len(meetings))
+
+		if err = r.SyncMeetings(ctx, &meetings); err != nil {
+			return err
+		}
+		if cursor == "" {
+			continue
+		}
+		if err = r.store.SetCursor(ctx, cursor, end.Format(time.DateOnly)); err != nil {
+			return fmt.Errorf("failed to set %s cursor, %w", cursor, err)
+		}
+	}
+	return nil
+}
+
 // SyncMeeting gets a slice of meetings and saves new ones to the database.
 // Filter for MinDuration and RecordType is applied.
 func (r *Repository) SyncMeetings(ctx context.Context, meetings *[]model.Meeting) error {
@@ -121,13 +237,16 @@ func (r *Repository) SyncMeetings(ctx context.Context, meetings *[]model.Meeting
 		return nil
 	}
 
+	r.syncMx.Lock()
+	defer r.syncMx.Unlock()
+
 	var saved, skipDuration, skipEmpty, skipExists int
 	for _, meeting := range *meetings {
 		if meeting.Duration < r.cfg.Syncable.MinDuration {
 			log.Printf("[DEBUG] Skipping meeting %s - duration %d is less than %d", meeting.UUID, meeting.Duration, r.cfg.Syncable.MinDuration)
 			skipDuration++
 			if r.cfg.Client.DeleteSkipped {
-				err := r.client.DeleteMeetingRecordings(meeting.UUID, r.cfg.Client.DeleteDownloaded)
+				err := r.client.DeleteMeetingRecordings(ctx, meeting.UUID, r.cfg.Client.DeleteDownloaded)
 				if err != nil {
 					log.Printf("[ERROR] failed to delete meeting %s - %v", meeting.UUID, err)
 				}
@@ -138,39 +257,13 @@ func (r *Repository) SyncMeetings(ctx context.Context, meetings *[]model.Meeting
 		if err != nil {
 			if err == storage.ErrNoRows {
 
-				// filter out meeting recordings that are not supported
-				// and sort them by priority
-				var important, alternative, optional []model.Record
-				for _, record := range meeting.Records {
-					if _, ok := r.Syncable.Important[record.Type]; ok {
-						important = append(important, record)
-					}
-					if _, ok := r.Syncable.Alternative[record.Type]; ok {
-						alternative = append(alternative, record)
-					}
-					if _, ok := r.Syncable.Optional[record.Type]; ok {
-						optional = append(optional, record)
-					}
-				}
-
-				meeting.Records = []model.Record{}
-
-				// if there are no important records, use alternative
-				if len(important) > 0 {
-					meeting.Records = important
-				} else if len(alternative) > 0 {
-					meeting.Records = alternative
-				}
-				// use optional if there any
-				if len(optional) > 0 {
-					meeting.Records = append(meeting.Records, optional...)
-				}
+				meeting.Records = r.syncableRecords(meeting.Records)
 
 				if len(meeting.Records) == 0 {
 					log.Printf("[DEBUG] Skipping meeting %s - no records to sync", meeting.UUID)
 					skipEmpty++
 					if r.cfg.Client.DeleteSkipped {
-						err := r.client.DeleteMeetingRecordings(meeting.UUID, r.cfg.Client.DeleteDownloaded)
+						err := r.client.DeleteMeetingRecordings(ctx, meeting.UUID, r.cfg.Client.DeleteDownloaded)
 						if err != nil {
 							log.Printf("[ERROR] failed to delete meeting %s - %v", meeting.UUID, err)
 						}
@@ -196,8 +289,55 @@ func (r *Repository) SyncMeetings(ctx context.Context, meetings *[]model.Meeting
 	return nil
 }
 
-// DownloadJob is a long running job that tries DownloadOnce on a regular interval
+// syncableRecords filters out meeting recordings that are not supported
+// and sorts them by priority
+func (r *Repository) syncableRecords(records []model.Record) []model.Record {
+	var important, alternative, optional []model.Record
+	for _, record := range records {
+		if _, ok := r.Syncable.Important[record.Type]; ok {
+			important = append(important, record)
+		}
+		if _, ok := r.Syncable.Alternative[record.Type]; ok {
+			alternative = append(alternative, record)
+		}
+		if _, ok := r.Syncable.Optional[record.Type]; ok {
+			optional = append(optional, record)
+		}
+	}
+
+	result := []model.Record{}
+
+	// if there are no important records, use alternative
+	if len(important) > 0 {
+		result = important
+	} else if len(alternative) > 0 {
+		result = alternative
+	}
+	// use optional if there any
+	if len(optional) > 0 {
+		result = append(result, optional...)
+	}
+	return result
+}
+
+// DownloadJob is a long running job that runs cfg.Download.Workers download workers
 func (r *Repository) DownloadJob(ctx context.Context) {
+	workers := max(r.cfg.Download.Workers, 1)
+	log.Printf("[DEBUG] starting %d download workers", workers)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.downloadWorker(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// downloadWorker tries DownloadOnce on a regular interval
+func (r *Repository) downloadWorker(ctx context.Context) {
 	ticker := time.NewTicker(1 * time.Second)
 	for {
 		select {
@@ -218,91 +358,484 @@ func (r *Repository) DownloadJob(ctx context.Context) {
 	}
 }
 
-// DownloadOnce gets a queued record and downloads it
+// DownloadOnce claims a queued record and downloads it
 func (r *Repository) DownloadOnce(ctx context.Context) error {
-	queued, err := r.store.GetQueuedRecord(ctx)
+	r.claimMx.Lock()
+	queued, err := r.store.ClaimQueuedRecord(ctx)
 	if err == storage.ErrNoRows {
+		defer r.claimMx.Unlock()
 		log.Printf("[DEBUG] No queued records")
-		// retry 'failed' records and 'downloading' records - put them back to 'queued'
-		err := r.store.ResetFailedRecords(ctx)
-		if err != nil {
+		// retry 'failed' records due for the next attempt - put them back to 'queued'
+		if err := r.store.ResetFailedRecords(ctx); err != nil {
 			return errors.Join(fmt.Errorf("failed to reset failed records"), err)
 		}
+		// 'downloading' records are left by the interrupted downloads only if no download is in progress
+		if r.inFlight > 0 {
+			return ErrNoQueuedRecords
+		}
+		if err := r.store.ResetDownloadingRecords(ctx); err != nil {
+			return errors.Join(fmt.Errorf("failed to reset downloading records"), err)
+		}
 		return ErrNoQueuedRecords
 	}
 	if err != nil {
+		r.claimMx.Unlock()
 		return errors.Join(fmt.Errorf("failed to get queued records"), err)
 	}
+	if queued == nil {
+		r.claimMx.Unlock()
+		return nil
+	}
+	r.inFlight++
+	r.claimMx.Unlock()
 
 	// download the record
-	if queued != nil {
-		log.Printf("[DEBUG] ↓ %d MB | %s record %s meetingId %s", queued.FileSize/1024/1024, queued.Type, queued.Id, queued.MeetingId)
-		log.Printf("[INFO] ↓ %d MB | %s | %s", queued.FileSize/1024/1024, queued.Id, queued.DateTime)
-		downErr := r.DownloadRecord(ctx, queued)
-		if downErr != nil {
-			return errors.Join(fmt.Errorf("download returned error %s", queued.Id), downErr)
+	downErr := r.downloadInFlight(ctx, queued)
+	if downErr != nil {
+		return errors.Join(fmt.Errorf("download returned error %s", queued.Id), downErr)
+	}
+
+	// failed hooks don't fail the download, they are saved and can be run again with RunFailedHooks
+	if err := r.runHooks(ctx, HookEventRecord, queued.MeetingId, queued); err != nil {
+		log.Printf("[ERROR] %v", err)
+	}
+	loaded := r.meetingRecordsLoaded(ctx, queued.MeetingId)
+	if loaded {
+		if err := r.runHooks(ctx, HookEventMeeting, queued.MeetingId, nil); err != nil {
+			log.Printf("[ERROR] %v", err)
 		}
+	}
 
-		if r.meetingRecordsLoaded(ctx, queued.MeetingId) && (r.cfg.Client.DeleteDownloaded || r.cfg.Client.TrashDownloaded) {
-			err := r.client.DeleteMeetingRecordings(queued.MeetingId, r.cfg.Client.DeleteDownloaded)
-			if err != nil {
-				return errors.Join(fmt.Errorf("failed to delete meeting %s", queued.MeetingId), err)
-			}
+	if loaded && (r.cfg.Client.DeleteDownloaded || r.cfg.Client.TrashDownloaded) {
+		err := r.client.DeleteMeetingRecordings(ctx, queued.MeetingId, r.cfg.Client.DeleteDownloaded)
+		if err != nil {
+			return errors.Join(fmt.Errorf("failed to delete meeting %s", queued.MeetingId), err)
 		}
 	}
 	return nil
 }
 
-// DownloadRecord downloads the record file from the given URL
-func (r *Repository) DownloadRecord(ctx context.Context, record *model.Record) error {
+// downloadInFlight downloads the claimed record, it's counted in inFlight until the download is done.
+// The hooks run after that, so the long ones don't keep the records left 'downloading' from being reset
+func (r *Repository) downloadInFlight(ctx context.Context, queued *model.Record) error {
+	defer func() {
+		r.claimMx.Lock()
+		r.inFlight--
+		r.claimMx.Unlock()
+	}()
+	log.Printf("[DEBUG] ↓ %d MB | %s record %s meetingId %s", queued.FileSize/1024/1024, queued.Type, queued.Id, queued.MeetingId)
+	log.Printf("[INFO] ↓ %d MB | %s | %s", queued.FileSize/1024/1024, queued.Id, queued.DateTime)
+	return r.DownloadRecord(ctx, queued)
+}
+
+// DownloadQueued downloads queued records one by one until there are no queued records left,
+// failed records due for the next attempt are retried
+func (r *Repository) DownloadQueued(ctx context.Context) error {
+	var lastError error
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("downloading terminated early: %w", ctx.Err())
+		default:
+		}
+		err := r.DownloadOnce(ctx)
+		if err == ErrNoQueuedRecords {
+			// first time DownloadOnce resets failed records, exit if there are still none
+			if err == lastError {
+				log.Printf("[DEBUG] no queued records, exiting")
+				return nil
+			}
+			lastError = err
+			continue
+		}
+		if err != nil {
+			log.Printf("[ERROR] failed to download meetings, %v, retrying in %s", err, downloadQueuedPause)
+			lastError = err
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("downloading terminated in the process: %w", ctx.Err())
+			case <-time.After(downloadQueuedPause):
+				continue
+			}
+		}
+		lastError = nil
+	}
+}
+
+// DownloadRecord downloads the record file from the given URL.
+// The file is downloaded to <record id>.<ext>.part in the record folder, interrupted download
+// is resumed with HTTP Range request. Complete file is fsynced and renamed to the name
+// suggested by Zoom (Content-Disposition), its SHA-256 is saved with the record.
+// Stale download url (401, 403, 404) is refreshed from Zoom and the download is retried,
+// the record is marked 'lost' if its meeting is not in the cloud anymore.
+// Failed download is counted as an attempt, see recordFailed
+func (r *Repository) DownloadRecord(ctx context.Context, record *model.Record) (err error) {
 
 	token, err := r.client.GetToken()
 	if err != nil {
+		// not the record's fault, put it back to the queue
+		r.store.UpdateRecord(ctx, record.Id, model.StatusQueued, "")
 		return err
 	}
 	r.store.UpdateRecord(ctx, record.Id, model.StatusDownloading, "")
+	defer func() {
+		if err != nil && !errors.Is(err, ErrRecordLost) {
+			r.recordFailed(ctx, record, err)
+		}
+	}()
 
-	path, _ := record.Paths(r.cfg.Storage.Repository)
+	// space for the file is reserved on the root, so concurrent downloads don't count on the same free space
+	root, err := r.placeRecord(record)
+	if err != nil {
+		return err
+	}
+	// the bytes of the .part file are not reserved, they are counted as used by the drive already
+	res := newDownloadReservation(r.reserved[root], int64(record.FileSize), r.bandwidth)
+	defer res.release()
+
+	path, _ := record.Paths(root)
 	if err = r.prepareDestination(path); err != nil {
 		return err
 	}
 
+	partPath := filepath.Join(path, record.Id+"."+strings.ToLower(record.FileExtension)+".part")
+	if info, err := os.Stat(partPath); err == nil {
+		res.consume(info.Size())
+	}
+
 	if _, err = r.freeUpSpace(ctx); err != nil {
 		log.Printf("[ERROR] failed to free up space, %v", err)
 	}
 
-	url := fmt.Sprintf("%s?access_token=%s", record.DownloadURL, token.AccessToken)
-	resp, err := grab.Get(path, url)
+	filePath, sum, err := r.fetchFile(ctx, record, root, partPath, token.AccessToken, res)
+	if staleDownloadURL(err) {
+		log.Printf("[INFO] download url of %s is stale (%v), refreshing", record.Id, err)
+		size := record.FileSize
+		if err = r.refreshRecord(ctx, record); err != nil {
+			return err
+		}
+		if record.FileSize != size {
+			os.Remove(partPath)
+			res.reset(int64(record.FileSize))
+		}
+		if token, err = r.client.GetToken(); err != nil {
+			return err
+		}
+		filePath, sum, err = r.fetchFile(ctx, record, root, partPath, token.AccessToken, res)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[DEBUG] Download saved to %s, sha256 %s", filePath, sum)
+	if err := r.store.SetRecordDownloaded(ctx, record.Id, root, filePath, sum); err != nil {
+		return fmt.Errorf("failed to update record %s, %w", record.Id, err)
+	}
+	if record.MediaDuration > 0 || record.Resolution != "" {
+		if err := r.store.SetRecordMedia(ctx, record.Id, record.MediaDuration, record.Resolution); err != nil {
+			log.Printf("[WARN] failed to save media info of %s, %v", record.Id, err)
+		}
+	}
+
+	// the sidecar keeps the meeting details next to the file, see RebuildDB
+	record.FilePath, record.Root, record.Sha256 = filePath, root, sum
+	if key, err := filepath.Rel(root, filePath); err == nil {
+		if err := r.addToSidecar(ctx, r.Files[root], filepath.ToSlash(key), *record); err != nil {
+			log.Printf("[WARN] failed to write sidecar of %s, %v", record.Id, err)
+		}
+	}
+
+	return nil
+}
+
+// fetchFile downloads the record file to partPath (resuming it if it exists), checks it, and puts
+// to the repository root by cfg.Storage.Layout. The bytes written are taken off the space reservation. Returns the path and hex encoded SHA-256 of the file.
+// ErrPathTaken is returned if there is a file of another record at the layout path, the .part file is kept
+func (r *Repository) fetchFile(ctx context.Context, record *model.Record, root, partPath, accessToken string, res *downloadReservation) (filePath, sum string, err error) {
+	downURL := fmt.Sprintf("%s?access_token=%s", record.DownloadURL, accessToken)
+	req, err := grab.NewRequest(partPath, downURL)
 	if err != nil {
-		r.store.UpdateRecord(ctx, record.Id, model.StatusFailed, "")
-		return fmt.Errorf("failed to download %s, %v", url, err)
+		return "", "", fmt.Errorf("failed to create request %s, %v", record.DownloadURL, err)
+	}
+	req = req.WithContext(ctx)
+	req.Size = int64(record.FileSize)
+	req.RateLimiter = res // shared bandwidth limit, the written bytes are taken off the reservation
+	// grab appends to the .part file when resuming, make sure the server sent the rest of the file
+	req.BeforeCopy = func(resp *grab.Response) error {
+		if resp.DidResume && resp.HTTPResponse.StatusCode != http.StatusPartialContent {
+			return errRangeIgnored
+		}
+		return nil
 	}
 
-	// check if the download was successful
-	if resp.HTTPResponse.StatusCode != 200 {
-		r.store.UpdateRecord(ctx, record.Id, model.StatusFailed, "")
-		return fmt.Errorf("failed to download %s, status %d", url, resp.HTTPResponse.StatusCode)
+	resp := grab.DefaultClient.Do(req)
+	if err := resp.Err(); err != nil {
+		// url.Error contains the access token, it's not logged or saved with the record
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		// .part file can't be resumed, start over next time
+		if errors.Is(err, errRangeIgnored) || errors.Is(err, grab.ErrBadLength) {
+			if rmErr := os.Remove(partPath); rmErr != nil {
+				log.Printf("[ERROR] failed to remove %s, %v", partPath, rmErr)
+			}
+		}
+		return "", "", fmt.Errorf("failed to download %s, %w", record.DownloadURL, err)
 	}
+	if resp.DidResume {
+		log.Printf("[DEBUG] Download of %s resumed from %s", record.Id, partPath)
+	}
+
 	// check if the file is not empty
 	if resp.Size() == 0 || resp.Size() != int64(record.FileSize) {
-		r.store.UpdateRecord(ctx, record.Id, model.StatusFailed, "")
-		return fmt.Errorf("failed to download %s, size %d", url, resp.Size())
+		os.Remove(partPath)
+		return "", "", fmt.Errorf("failed to download %s, size %d", record.DownloadURL, resp.Size())
+	}
+	// the right size doesn't mean the file is complete inside
+	if err := r.validateMedia(ctx, record, partPath); err != nil {
+		os.Remove(partPath)
+		return "", "", err
+	}
+
+	filename := downloadFilename(resp.HTTPResponse, record)
+	// check if filename extension matches record.FileExtension
+	if !strings.HasSuffix(strings.ToLower(filename), "."+strings.ToLower(record.FileExtension)) {
+		os.Remove(partPath)
+		return "", "", fmt.Errorf("failed to download %s, extension of %s", record.DownloadURL, filename)
 	}
 
-	// check if resp.Filename extension matches record.FileExtension
-	if resp.Filename[len(resp.Filename)-len(record.FileExtension):] != strings.ToLower(record.FileExtension) {
-		r.store.UpdateRecord(ctx, record.Id, model.StatusFailed, "")
-		return fmt.Errorf("failed to download %s, extension %s", url, resp.Filename[len(resp.Filename)-len(record.FileExtension):])
+	if err := syncFile(partPath); err != nil {
+		return "", "", fmt.Errorf("failed to sync %s, %w", partPath, err)
+	}
+	sum, err = fileSha256(partPath)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to hash %s, %w", partPath, err)
+	}
+	key, err := r.layoutKey(ctx, *record, filename)
+	if err != nil {
+		return "", "", err
+	}
+	filePath = filepath.Join(root, filepath.FromSlash(key))
+	// layout without {id} can give the same path to different records, only the file of the record itself
+	// (downloaded again) is replaced
+	r.saveMx.Lock()
+	defer r.saveMx.Unlock()
+	if _, err := r.Files[root].Stat(ctx, key); !errors.Is(err, blob.ErrNotFound) {
+		owner := ""
+		if err == nil {
+			owner, err = sidecarOwner(ctx, r.Files[root], key)
+		}
+		if err == nil && owner != record.Id {
+			err = fmt.Errorf("%w, add {id} to the layout", ErrPathTaken)
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("failed to save %s, %w", filePath, err)
+		}
+	}
+	if err := blob.PutFile(ctx, r.Files[root], key, partPath); err != nil {
+		return "", "", fmt.Errorf("failed to save %s, %w", filePath, err)
 	}
+	// the record folder of the .part file is left empty if the layout puts the file elsewhere
+	recFolder, dateFolder := record.Paths(root)
+	if os.Remove(recFolder) == nil {
+		os.Remove(dateFolder)
+	}
+	return filePath, sum, nil
+}
 
-	log.Printf("[DEBUG] Download saved to %s", resp.Filename)
-	if err := r.store.UpdateRecord(ctx, record.Id, model.StatusDownloaded, resp.Filename); err != nil {
+// mediaDurationSlack is how much longer than the meeting its recording can be, Zoom rounds the meeting duration to minutes
+const mediaDurationSlack = time.Minute
+
+// validateMedia checks the box tree of the downloaded MP4/M4A file and saves its duration and resolution
+// to the record. The file is corrupt if it's malformed, has no duration, or is longer than the meeting.
+// Recordings shorter than the meeting are fine - recording could be started late or paused
+func (r *Repository) validateMedia(ctx context.Context, record *model.Record, path string) error {
+	if ext := strings.ToLower(record.FileExtension); ext != "mp4" && ext != "m4a" {
+		return nil
+	}
+	info, err := mp4.ProbeFile(path)
+	if err != nil {
+		return fmt.Errorf("%w: %s, %w", ErrCorrupt, record.Id, err)
+	}
+	if info.Duration <= 0 {
+		return fmt.Errorf("%w: %s, no duration", ErrCorrupt, record.Id)
+	}
+	if meeting, err := r.store.GetMeeting(ctx, record.MeetingId); err == nil && meeting.Duration > 0 {
+		if limit := time.Duration(meeting.Duration)*time.Minute + mediaDurationSlack; info.Duration > limit {
+			return fmt.Errorf("%w: %s, duration %s is longer than the meeting (%d min)", ErrCorrupt, record.Id, info.Duration, meeting.Duration)
+		}
+	}
+	record.MediaDuration, record.Resolution = int(info.Duration.Round(time.Second).Seconds()), info.Resolution()
+	log.Printf("[DEBUG] %s is valid %s, duration %s, resolution %q", record.Id, info.Brand, info.Duration, record.Resolution)
+	return nil
+}
+
+// staleDownloadURL returns true if the download failed because the download url is expired or revoked
+func staleDownloadURL(err error) bool {
+	var statusErr grab.StatusCodeError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	return statusErr == http.StatusUnauthorized || statusErr == http.StatusForbidden || statusErr == http.StatusNotFound
+}
+
+// refreshRecord gets the meeting recordings from Zoom again and updates download url and file size
+// of the record. ErrRecordLost is returned and the record is marked 'lost' if the meeting
+// or the record is not in the cloud anymore, neither in the trash
+func (r *Repository) refreshRecord(ctx context.Context, record *model.Record) error {
+	meeting, err := r.client.GetMeetingRecordings(ctx, record.MeetingId)
+	if err != nil && !errors.Is(err, client.ErrMeetingNotFound) {
+		return fmt.Errorf("failed to refresh download url of %s, %w", record.Id, err)
+	}
+
+	fresh := findRecord(meeting, record.Id)
+	if fresh == nil {
+		// trashed recordings can still be downloaded, the record is lost only if it's not in the trash too
+		saved, err := r.store.GetMeeting(ctx, record.MeetingId)
+		if err != nil {
+			return fmt.Errorf("failed to get meeting %s, %w", record.MeetingId, err)
+		}
+		trashed, err := r.client.GetTrashedMeetingRecordings(ctx, saved.HostId, record.MeetingId, saved.StartTime)
+		if err != nil && !errors.Is(err, client.ErrMeetingNotFound) {
+			return fmt.Errorf("failed to refresh download url of %s from the trash, %w", record.Id, err)
+		}
+		fresh = findRecord(trashed, record.Id)
+	}
+	if fresh == nil {
+		log.Printf("[WARN] record %s of meeting %s is not in the cloud anymore, marked as lost", record.Id, record.MeetingId)
+		if err := r.store.UpdateRecord(ctx, record.Id, model.StatusLost, ""); err != nil {
+			return fmt.Errorf("failed to update record %s, %w", record.Id, err)
+		}
+		record.Status = model.StatusLost
+		return ErrRecordLost
+	}
+
+	if err := r.store.UpdateRecordSource(ctx, record.Id, fresh.DownloadURL, fresh.FileSize); err != nil {
 		return fmt.Errorf("failed to update record %s, %w", record.Id, err)
 	}
+	record.DownloadURL = fresh.DownloadURL
+	record.FileSize = fresh.FileSize
+	return nil
+}
 
+// findRecord returns the record of the meeting by id, nil if the meeting is nil or has no such record
+func findRecord(meeting *model.Meeting, id string) *model.Record {
+	if meeting == nil {
+		return nil
+	}
+	for i := range meeting.Records {
+		if meeting.Records[i].Id == id {
+			return &meeting.Records[i]
+		}
+	}
 	return nil
 }
 
+// MarkMeetingLost marks the records of the meeting waiting for the download (queued, failed or corrupt)
+// as lost, the recordings are deleted from the cloud. Records being downloaded are marked lost by
+// refreshRecord when their download fails. Returns the number of the lost records
+func (r *Repository) MarkMeetingLost(ctx context.Context, meetingId string) (int, error) {
+	records, err := r.store.GetRecords(ctx, meetingId)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get records of %s, %w", meetingId, err)
+	}
+	lost := 0
+	for _, record := range records {
+		if record.Status != model.StatusQueued && record.Status != model.StatusFailed && record.Status != model.StatusCorrupt {
+			continue
+		}
+		if err := r.store.UpdateRecord(ctx, record.Id, model.StatusLost, ""); err != nil {
+			return lost, fmt.Errorf("failed to update record %s, %w", record.Id, err)
+		}
+		lost++
+	}
+	return lost, nil
+}
+
+// recordFailed counts the failed download attempt of the record and saves the error.
+// The record is retried after the delay doubled with every attempt, and abandoned
+// after cfg.Download.MaxAttempts attempts. Corrupt downloads are marked 'corrupt' and retried the same way
+func (r *Repository) recordFailed(ctx context.Context, record *model.Record, downErr error) {
+	if ctx.Err() != nil {
+		// interrupted by shutdown, 'downloading' record is put back to the queue on the next start
+		return
+	}
+
+	maxAttempts := r.cfg.Download.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	record.Attempts++
+	record.Status = model.StatusFailed
+	if errors.Is(downErr, ErrCorrupt) {
+		record.Status = model.StatusCorrupt
+	}
+	if record.Attempts >= maxAttempts {
+		record.Status = model.StatusAbandoned
+		log.Printf("[WARN] record %s abandoned after %d attempts, last error: %v", record.Id, record.Attempts, downErr)
+	}
+
+	next := time.Now().Add(r.retryDelay(record.Attempts))
+	record.NextAttemptAt = next.Local().Format(time.DateTime)
+	record.LastError = downErr.Error()
+	if err := r.store.UpdateRecordAttempt(ctx, record.Id, record.Status, record.Attempts, record.LastError, next); err != nil {
+		log.Printf("[ERROR] failed to update record %s, %v", record.Id, err)
+	}
+}
+
+// retryDelay returns the delay before the next attempt to download failed record,
+// cfg.Download.RetryDelay doubled with every attempt, up to maxRetryDelay
+func (r *Repository) retryDelay(attempts int) time.Duration {
+	delay := time.Duration(r.cfg.Download.RetryDelay) * time.Second
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// downloadFilename returns the file name suggested by Content-Disposition header of the download
+// response, or <record id>.<ext> if there is none
+func downloadFilename(resp *http.Response, record *model.Record) string {
+	if resp != nil {
+		if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+			filename := filepath.Base(params["filename"])
+			if filename != "." && filename != "/" && filename != ".." && !strings.HasSuffix(filename, ".part") {
+				return filename
+			}
+		}
+	}
+	return record.Id + "." + strings.ToLower(record.FileExtension)
+}
+
+// fileSha256 returns hex encoded SHA-256 of the file
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// syncFile flushes the file (or the directory entries) to disk
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
 // PrepareDestination creates directory for the downloaded file
 func (r *Repository) prepareDestination(path string) error {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
@@ -320,7 +853,7 @@ func (r *Repository) meetingRecordsLoaded(ctx context.Context, meetingId string)
 		return false
 	}
 	for _, record := range records {
-		if record.Status != model.StatusDownloaded {
+		if record.Status != model.StatusDownloaded && record.Status != model.StatusArchived {
 			return false
 		}
 	}
@@ -386,18 +919,13 @@ func (r *Repository) CleanupJob(ctx context.Context, daysAgo int) {
 					return
 				default:
 					log.Printf("[DEBUG] Deleting meeting %s", meeting.UUID)
-					err := r.client.DeleteMeetingRecordings(meeting.UUID, r.cfg.Client.DeleteDownloaded)
+					err := r.client.DeleteMeetingRecordings(ctx, meeting.UUID, r.cfg.Client.DeleteDownloaded)
+					// client takes care of the rate limiting
 					if err != nil {
 						log.Printf("[ERROR] failed to delete meeting %s - %v", meeting.UUID, err)
 					} else {
 						deleted++
 					}
-					select {
-					case <-ctx.Done():
-						return
-					case <-time.After(r.cfg.Client.RateLimitingDelay.Light):
-						continue
-					}
 				}
 			}
 			log.Printf("[INFO] Deleted %d out of %d meetings", deleted, len(meetings))
@@ -417,8 +945,9 @@ func (r *Repository) requestMeetingsLoaded(meetings []string) (loaded bool, err
 	}
 
 	req := struct {
-		Meetings []string `json:"meetings"`
-	}{Meetings: meetings}
+		Meetings   []string `json:"meetings"`
+		VerifyHash bool     `json:"verify_hash,omitempty"`
+	}{Meetings: meetings, VerifyHash: r.cfg.Commander.VerifyHash}
 
 	body, err := json.Marshal(req)
 	if err != nil {
@@ -451,101 +980,272 @@ func (r *Repository) requestMeetingsLoaded(meetings []string) (loaded bool, err
 	return true, nil
 }
 
-// CheckConsistency checks if all downloaded files exist and have correct size
-// returns number of checked files and error
-func (r *Repository) CheckConsistency(ctx context.Context) (checked int, result error) {
-	recs, err := r.store.GetRecordsByStatus(ctx, model.StatusDownloaded)
-	if err != nil {
-		return 0, fmt.Errorf("failed to get records by status %s: %w", model.StatusDownloaded, err)
+// CheckConsistency checks if all downloaded and archived files exist and have correct size,
+// with verifyHash SHA-256 of the files is checked as well (reads every file).
+// returns number of checked files and the problems joined, see Check for the full report with repairs
+func (r *Repository) CheckConsistency(ctx context.Context, verifyHash bool) (checked int, result error) {
+	report := &CheckReport{}
+	if err := r.checkRecords(ctx, CheckOptions{VerifyHash: verifyHash}, report); err != nil {
+		return report.Checked, err
 	}
+	for _, p := range report.Problems {
+		result = errors.Join(result, errors.New(p.Error))
+	}
+	return report.Checked, result
+}
 
-	for _, rec := range recs {
-		// check if file with path exists
-		if _, err := os.Stat(rec.FilePath); os.IsNotExist(err) {
-			log.Printf("File does not exist: %s", rec.FilePath)
-			errors.Join(result, fmt.Errorf("file does not exist: %s", rec.FilePath))
-		}
-		// check if file is not empty
-		if info, err := os.Stat(rec.FilePath); err == nil {
-			if info.Size() == 0 {
-				log.Printf("File is empty: %s", rec.FilePath)
-				errors.Join(result, fmt.Errorf("file is empty: %s", rec.FilePath))
-			}
+// recordRoot returns the repository root of the downloaded record. Records downloaded before
+// roots were saved are matched by the file path, the first root is the default
+func (r *Repository) recordRoot(rec model.Record) string {
+	roots := r.cfg.Storage.Roots()
+	if _, ok := r.Files[rec.Root]; ok {
+		return rec.Root
+	}
+	for _, root := range roots {
+		if key, err := filepath.Rel(root, rec.FilePath); err == nil && !strings.HasPrefix(key, "..") {
+			return root
 		}
-		// check if file size matches record.FileSize
-		if info, err := os.Stat(rec.FilePath); err == nil {
-			if info.Size() != int64(rec.FileSize) {
-				log.Printf("File size does not match: %s", rec.FilePath)
-				errors.Join(result, fmt.Errorf("file size does not match: %s", rec.FilePath))
-			}
+	}
+	return roots[0]
+}
+
+// fileKey returns the store of the record file and its key in the store. Downloaded records
+// are in their repository root, archived - in the archive
+func (r *Repository) fileKey(rec model.Record) (blob.Store, string, error) {
+	root := r.recordRoot(rec)
+	store := r.Files[root]
+	if rec.Status == model.StatusArchived {
+		if r.Archive == nil {
+			return nil, "", fmt.Errorf("record %s is archived, but the archive is not configured", rec.Id)
 		}
-		checked++
+		store, root = r.Archive, r.ArchiveRoot
 	}
-	log.Printf("Checked files: %d", checked)
-	return
+	key, err := filepath.Rel(root, rec.FilePath)
+	if err != nil || key == "." || strings.HasPrefix(key, "..") {
+		return nil, "", fmt.Errorf("file %s of record %s is not in %s", rec.FilePath, rec.Id, root)
+	}
+	return store, filepath.ToSlash(key), nil
 }
 
-// freeUpSpace deletes downloaded files if there is less than cfg.Storage.KeepFreeSpace bytes free
-// on the drive where cfg.Storage.Repository located
-func (r *Repository) freeUpSpace(ctx context.Context) (deleted int, result error) {
-	usage, err := disk.Usage(r.cfg.Storage.Repository)
+// ServeRecord serves the file of the downloaded or archived record, Range and conditional requests
+// are supported. SHA-256 of the file is the ETag
+func (r *Repository) ServeRecord(rw http.ResponseWriter, req *http.Request, rec model.Record) {
+	store, key, err := r.fileKey(rec)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get disk usage: %w", err)
-	}
-	if usage.Free > uint64(r.cfg.Storage.KeepFreeSpace) {
-		log.Printf("[DEBUG]Free space Available/Required: %d/%d bytes (%s/ %s) no need to free up space.",
-			usage.Free,
-			r.cfg.Storage.KeepFreeSpace,
-			model.FileSize(usage.Free),
-			model.FileSize(r.cfg.Storage.KeepFreeSpace),
-		)
-		return 0, nil
+		log.Printf("[ERROR] failed to serve record %s, %v", rec.Id, err)
+		http.NotFound(rw, req)
+		return
 	}
-	log.Printf("[DEBUG] Free space Available/Required: %d/%d bytes (%s/ %s), %d bytes (%s) over the limit", usage.Free, r.cfg.Storage.KeepFreeSpace, model.FileSize(usage.Free), model.FileSize(r.cfg.Storage.KeepFreeSpace), r.cfg.Storage.KeepFreeSpace-usage.Free, model.FileSize(r.cfg.Storage.KeepFreeSpace-usage.Free))
+	if rec.Sha256 != "" {
+		rw.Header().Set("ETag", `"`+rec.Sha256+`"`)
+	}
+	blob.ServeFile(rw, req, store, key)
+}
 
-	recs, err := r.store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+// VerifyFile checks if the file of the downloaded or archived record exists and has correct size.
+// With verifyHash its SHA-256 is compared to the one saved after download, records
+// downloaded before hashes were saved are checked by size only
+func (r *Repository) VerifyFile(ctx context.Context, rec model.Record, verifyHash bool) error {
+	store, key, err := r.fileKey(rec)
 	if err != nil {
-		return deleted, fmt.Errorf("failed to get downloaded records %w", err)
+		return err
 	}
-	for _, rec := range recs {
-		usage, err = disk.Usage(r.cfg.Storage.Repository)
+	info, err := store.Stat(ctx, key)
+	if err != nil {
+		if errors.Is(err, blob.ErrNotFound) {
+			return fmt.Errorf("%w: %s", ErrFileMissing, rec.FilePath)
+		}
+		return fmt.Errorf("failed to stat %s: %w", rec.FilePath, err)
+	}
+	if info.Size == 0 {
+		return fmt.Errorf("%w: %s", ErrFileEmpty, rec.FilePath)
+	}
+	if info.Size != int64(rec.FileSize) {
+		return fmt.Errorf("%w: %s", ErrFileSize, rec.FilePath)
+	}
+	if !verifyHash || rec.Sha256 == "" {
+		return nil
+	}
+	rc, err := store.Open(ctx, key, 0, -1)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", rec.FilePath, err)
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return fmt.Errorf("failed to hash %s: %w", rec.FilePath, err)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != rec.Sha256 {
+		return fmt.Errorf("%w: %s", ErrFileHash, rec.FilePath)
+	}
+	return nil
+}
+
+// freeUpSpace deletes downloaded files if there is less than cfg.Storage.KeepFreeSpace bytes free
+// on the drive of any repository root, following cfg.Storage.Retention rules. Only the records
+// on the roots short of space are evicted. Records older than max_age of their retention rule
+// are deleted regardless of the free space.
+// With cfg.Storage.Archive set, records are moved to the archive instead of deleting
+func (r *Repository) freeUpSpace(ctx context.Context) (deleted int, result error) {
+	r.evictMx.Lock()
+	defer r.evictMx.Unlock()
+
+	// short returns true if the root has not enough free space
+	short := func(root string) (bool, error) {
+		usage, err := r.diskUsage(root)
+		if err != nil {
+			return false, fmt.Errorf("failed to get disk usage of %s: %w", root, err)
+		}
+		if usage.Free > r.cfg.Storage.KeepFreeSpace {
+			log.Printf("[DEBUG] Free space of %s Available/Required: %d/%d bytes (%s/ %s)", root, usage.Free, r.cfg.Storage.KeepFreeSpace, model.FileSize(usage.Free), model.FileSize(r.cfg.Storage.KeepFreeSpace))
+			return false, nil
+		}
+		log.Printf("[DEBUG] Free space of %s Available/Required: %d/%d bytes (%s/ %s), %d bytes (%s) over the limit", root, usage.Free, r.cfg.Storage.KeepFreeSpace, model.FileSize(usage.Free), model.FileSize(r.cfg.Storage.KeepFreeSpace), r.cfg.Storage.KeepFreeSpace-usage.Free, model.FileSize(r.cfg.Storage.KeepFreeSpace-usage.Free))
+		return true, nil
+	}
+
+	shortRoots := map[string]bool{}
+	for _, root := range r.cfg.Storage.Roots() {
+		isShort, err := short(root)
 		if err != nil {
-			return deleted, fmt.Errorf("failed to get disk usage: %w", err)
+			return 0, err
 		}
-		if usage.Free > uint64(r.cfg.Storage.KeepFreeSpace) {
-			log.Printf("[INFO] Free space is %d (%d bytes), deleted %d records", model.FileSize(usage.Free), usage.Free, deleted)
-			break
+		if isShort {
+			shortRoots[root] = true
 		}
+	}
+	candidates, err := r.evictionCandidates(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(shortRoots) == 0 && (len(candidates) == 0 || !candidates[0].expired) {
+		log.Printf("[DEBUG] No need to free up space")
+		return 0, nil
+	}
 
-		recFolder, dateFolder := rec.Paths(r.cfg.Storage.Repository)
-		if _, err := os.Stat(recFolder); err != nil {
-			log.Printf("[ERROR] %s does not exist, skipping", recFolder)
+	for _, rec := range candidates {
+		root := r.recordRoot(rec.Record)
+		if !rec.expired {
+			if !shortRoots[root] {
+				continue
+			}
+			isShort, err := short(root)
+			if err != nil {
+				return deleted, err
+			}
+			if !isShort {
+				log.Printf("[INFO] Enough free space on %s, deleted %d records", root, deleted)
+				delete(shortRoots, root)
+				continue
+			}
+		}
+
+		if r.Archive != nil {
+			if err := r.archiveRecord(ctx, rec.Record); err != nil {
+				log.Printf("[ERROR] %v", err)
+				result = errors.Join(result, err)
+			} else {
+				deleted++
+			}
+			continue
+		}
+
+		store, key, err := r.fileKey(rec.Record)
+		if err != nil {
+			log.Printf("[ERROR] %v", err)
+			result = errors.Join(result, err)
 			continue
 		}
-		if err := os.RemoveAll(recFolder); err != nil {
-			log.Printf("[DEBUG] Failed to delete %s, %v", recFolder, err)
-			errors.Join(result, fmt.Errorf("failed to delete %s, %v; ", recFolder, err))
+		// empty record and date folders are removed with the file
+		if err := store.Delete(ctx, key); err != nil {
+			if errors.Is(err, blob.ErrNotFound) {
+				log.Printf("[ERROR] %s does not exist, skipping", rec.FilePath)
+				continue
+			}
+			log.Printf("[DEBUG] Failed to delete %s, %v", rec.FilePath, err)
+			result = errors.Join(result, fmt.Errorf("failed to delete %s, %v; ", rec.FilePath, err))
 		} else {
 			deleted++
-			log.Printf("[DEBUG] Deleted %s", recFolder)
+			log.Printf("[DEBUG] Deleted %s", rec.FilePath)
 			r.store.UpdateRecord(ctx, rec.Id, model.StatusDeleted, "")
+			if err := r.removeFromSidecar(ctx, store, key, rec.Record); err != nil {
+				log.Printf("[WARN] failed to update sidecar of %s, %v", rec.Id, err)
+			}
+		}
+	}
+	for root := range shortRoots {
+		if isShort, err := short(root); err == nil && isShort {
+			log.Printf("[WARN] Not enough free space on %s, but all its downloaded records are kept by retention rules", root)
 		}
+	}
+	return
+}
 
-		// if dateFolder is empty, delete it
-		if files, err := os.ReadDir(dateFolder); err != nil {
-			log.Printf("[ERROR] Failed to read %s, %v", dateFolder, err)
-		} else {
-			if len(files) == 0 {
-				if err := os.Remove(dateFolder); err != nil {
-					log.Printf("[ERROR] Failed to delete %s, %v", dateFolder, err)
-				} else {
-					log.Printf("[DEBUG] Deleted %s", dateFolder)
-				}
-			}
+// diskUsage returns usage stats of the drive where the repository root is located,
+// space reserved by downloads in progress is counted as used
+func (r *Repository) diskUsage(root string) (*disk.UsageStat, error) {
+	usage, err := disk.Usage(root)
+	if err != nil {
+		return nil, err
+	}
+	var reserved uint64
+	if res, ok := r.reserved[root]; ok {
+		reserved = uint64(max(res.Load(), 0))
+	}
+	if reserved > usage.Free {
+		reserved = usage.Free
+	}
+	usage.Free -= reserved
+	usage.Used += reserved
+	return usage, nil
+}
+
+// placeRecord chooses the repository root for the record download and reserves the space for the file on it,
+// the caller releases the reservation. The root with the .part file of the previous attempt is reused,
+// otherwise it's chosen by cfg.Storage.Placement: the root with the most free space, or the first one
+// with enough free space for the file (first_fit)
+func (r *Repository) placeRecord(record *model.Record) (string, error) {
+	r.placeMx.Lock()
+	defer r.placeMx.Unlock()
+
+	root := r.pickRoot(record)
+	if root == "" {
+		return "", fmt.Errorf("no repository root is available for %s", record.Id)
+	}
+	r.reserved[root].Add(int64(record.FileSize))
+	return root, nil
+}
+
+// pickRoot returns the root for the record download following cfg.Storage.Placement,
+// empty string if the disk usage of all the roots is unknown
+func (r *Repository) pickRoot(record *model.Record) string {
+	roots := r.cfg.Storage.Roots()
+	if len(roots) == 1 {
+		return roots[0]
+	}
+	for _, root := range roots {
+		path, _ := record.Paths(root)
+		partPath := filepath.Join(path, record.Id+"."+strings.ToLower(record.FileExtension)+".part")
+		if _, err := os.Stat(partPath); err == nil {
+			return root
 		}
+	}
 
+	best, mostFree := "", uint64(0)
+	for _, root := range roots {
+		usage, err := r.diskUsage(root)
+		if err != nil {
+			log.Printf("[WARN] failed to get disk usage of %s, %v", root, err)
+			continue
+		}
+		if r.cfg.Storage.Placement == "first_fit" && usage.Free > uint64(record.FileSize)+r.cfg.Storage.KeepFreeSpace {
+			return root
+		}
+		if best == "" || usage.Free > mostFree {
+			best, mostFree = root, usage.Free
+		}
 	}
-	return
+	return best
 }
 
 // GetStats - returns statistics about the repository. d is a divider for the file size: 'K', 'M', 'G'.
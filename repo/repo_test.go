@@ -1,18 +1,36 @@
 package repo
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/parMaster/zoomrs/client"
 	"github.com/parMaster/zoomrs/config"
+	"github.com/parMaster/zoomrs/storage"
 	"github.com/parMaster/zoomrs/storage/model"
 	"github.com/parMaster/zoomrs/storage/sqlite"
 	"github.com/shirou/gopsutil/v4/disk"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_FreeUpSpace(t *testing.T) {
@@ -203,3 +221,1393 @@ func Test_FreeUpSpace(t *testing.T) {
 	}
 
 }
+
+type testClient struct {
+	meeting   *model.Meeting                                    // returned by GetMeetingRecordings, client.ErrMeetingNotFound if nil
+	intervals [][2]string                                       // from-to days requested with GetIntervalMeetings
+	meetings  func(from, to time.Time) ([]model.Meeting, error) // returned by GetIntervalMeetings
+	all       []model.Meeting                                   // returned by GetAllMeetingsWithRetry
+	trashed   *model.Meeting                                    // returned by GetTrashedMeetingRecordings, client.ErrMeetingNotFound if nil
+}
+
+func (c *testClient) Authorize() error { return nil }
+func (c *testClient) GetMeetings(ctx context.Context, daysAgo int) ([]model.Meeting, error) {
+	return nil, nil
+}
+func (c *testClient) GetIntervalMeetings(ctx context.Context, from, to time.Time) ([]model.Meeting, error) {
+	c.intervals = append(c.intervals, [2]string{from.Format(time.DateOnly), to.Format(time.DateOnly)})
+	if c.meetings == nil {
+		return nil, nil
+	}
+	return c.meetings(from, to)
+}
+func (c *testClient) GetAllMeetingsWithRetry(ctx context.Context) ([]model.Meeting, error) {
+	return c.all, nil
+}
+func (c *testClient) GetToken() (*client.AccessToken, error) {
+	return &client.AccessToken{AccessToken: "testToken"}, nil
+}
+func (c *testClient) DeleteMeetingRecordings(ctx context.Context, meetingId string, delete bool) error {
+	return nil
+}
+func (c *testClient) GetMeetingRecordings(ctx context.Context, meetingId string) (*model.Meeting, error) {
+	if c.meeting == nil {
+		return nil, client.ErrMeetingNotFound
+	}
+	return c.meeting, nil
+}
+func (c *testClient) GetTrashedMeetingRecordings(ctx context.Context, hostId, meetingId string, start time.Time) (*model.Meeting, error) {
+	if c.trashed == nil {
+		return nil, client.ErrMeetingNotFound
+	}
+	return c.trashed, nil
+}
+
+// testMP4 returns the minimal valid MP4 file of the duration in seconds, padded with 'mdat' to the size
+func testMP4(seconds uint32, size int) []byte {
+	box := func(typ string, body []byte) []byte {
+		return append(append(binary.BigEndian.AppendUint32(nil, uint32(8+len(body))), typ...), body...)
+	}
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1)
+	binary.BigEndian.PutUint32(mvhd[16:], seconds)
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], 1280<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], 720<<16)
+	data := append(box("ftyp", []byte("isom\x00\x00\x00\x00isom")), box("moov", append(box("mvhd", mvhd), box("trak", box("tkhd", tkhd))...))...)
+	mdat := make([]byte, size-len(data)-8)
+	for i := range mdat {
+		mdat[i] = byte(i % 251)
+	}
+	return append(data, box("mdat", mdat)...)
+}
+
+// interrupted download is resumed from the .part file, complete file is renamed and its hash is saved
+func Test_DownloadRecordResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	content := testMP4(90, 100*1024)
+	sum := sha256.Sum256(content)
+
+	var ranges []string
+	ignoreRange := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "testToken", r.URL.Query().Get("access_token"))
+		w.Header().Set("Content-Disposition", `attachment; filename="GMT20240101-100000_Recording.mp4"`)
+		if r.Method == http.MethodGet && r.Header.Get("Range") != "" {
+			ranges = append(ranges, r.Header.Get("Range"))
+			if ignoreRange {
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				w.Write(content)
+				return
+			}
+		}
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir()}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/download_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	repo := NewRepository(store, &testClient{}, cfg)
+
+	meeting := model.Meeting{UUID: "resumeUUID", StartTime: time.Now(), Records: []model.Record{
+		{Id: "resumeId", MeetingId: "resumeUUID", StartTime: time.Now(), FileExtension: "MP4", FileSize: model.FileSize(len(content)), DownloadURL: ts.URL + "/rec/download/resumeId"},
+	}}
+	require.NoError(t, store.SaveMeeting(ctx, meeting))
+	recs, err := store.GetRecords(ctx, meeting.UUID)
+	require.NoError(t, err)
+	rec := recs[0]
+
+	recFolder, _ := rec.Paths(cfg.Storage.Repository)
+	partPath := filepath.Join(recFolder, "resumeId.mp4.part")
+
+	// server ignores Range, .part can't be resumed and is removed
+	require.NoError(t, os.MkdirAll(recFolder, 0o755))
+	require.NoError(t, os.WriteFile(partPath, content[:40*1024], 0o644))
+	ignoreRange = true
+	err = repo.DownloadRecord(ctx, &rec)
+	assert.Error(t, err)
+	assert.NoFileExists(t, partPath)
+	ignoreRange = false
+
+	// half of the file downloaded before the restart
+	require.NoError(t, os.WriteFile(partPath, content[:40*1024], 0o644))
+	ranges = nil
+	err = repo.DownloadRecord(ctx, &rec)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bytes=40960-"}, ranges)
+	assert.NoFileExists(t, partPath)
+
+	filePath := filepath.Join(recFolder, "GMT20240101-100000_Recording.mp4")
+	data, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	downloaded, err := store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	require.NoError(t, err)
+	require.Len(t, downloaded, 1)
+	assert.Equal(t, filePath, downloaded[0].FilePath)
+	assert.Equal(t, hex.EncodeToString(sum[:]), downloaded[0].Sha256)
+	assert.Equal(t, 90, downloaded[0].MediaDuration)
+	assert.Equal(t, "1280x720", downloaded[0].Resolution)
+	assert.FileExists(t, filepath.Join(recFolder, sidecarName))
+
+	// content is verified by hash
+	checked, err := repo.CheckConsistency(ctx, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, checked)
+	data[0]++
+	require.NoError(t, os.WriteFile(filePath, data, 0o644))
+	_, err = repo.CheckConsistency(ctx, false)
+	assert.NoError(t, err)
+	_, err = repo.CheckConsistency(ctx, true)
+	assert.ErrorContains(t, err, "sha256 does not match")
+}
+
+// downloads of the right size with malformed MP4 or too long for the meeting are marked corrupt and retried
+func Test_DownloadRecordCorrupt(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	files := map[string][]byte{"long": testMP4(10*60, 1024), "valid": testMP4(5*60, 1024)}
+	files["noMoov"] = bytes.Replace(testMP4(60, 1024), []byte("moov"), []byte("free"), 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "rec.mp4", time.Now(), bytes.NewReader(files[filepath.Base(r.URL.Path)]))
+	}))
+	defer ts.Close()
+
+	cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir()}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/corrupt_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	repo := NewRepository(store, &testClient{}, cfg)
+
+	meeting := model.Meeting{UUID: "corruptUUID", StartTime: time.Now(), Duration: 5}
+	for _, id := range []string{"long", "noMoov", "valid"} {
+		meeting.Records = append(meeting.Records, model.Record{Id: id, MeetingId: meeting.UUID, StartTime: time.Now(),
+			FileExtension: "MP4", FileSize: 1024, DownloadURL: ts.URL + "/rec/download/" + id})
+	}
+	require.NoError(t, store.SaveMeeting(ctx, meeting))
+
+	recs, err := store.GetRecords(ctx, meeting.UUID)
+	require.NoError(t, err)
+	for _, rec := range recs {
+		err := repo.DownloadRecord(ctx, &rec)
+		if rec.Id == "valid" {
+			assert.NoError(t, err)
+			continue
+		}
+		assert.ErrorIs(t, err, ErrCorrupt, rec.Id)
+	}
+
+	corrupt, err := store.GetRecordsByStatus(ctx, model.StatusCorrupt)
+	require.NoError(t, err)
+	require.Len(t, corrupt, 2)
+	for _, rec := range corrupt {
+		assert.Equal(t, 1, rec.Attempts)
+		assert.Contains(t, rec.LastError, "corrupt")
+	}
+	downloaded, err := store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	require.NoError(t, err)
+	require.Len(t, downloaded, 1)
+	assert.Equal(t, 300, downloaded[0].MediaDuration)
+}
+
+// failed downloads are retried with growing delay and abandoned after max attempts
+func Test_RecordFailed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir()}, Download: config.Download{MaxAttempts: 3, RetryDelay: 10}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/failed_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	repo := NewRepository(store, &testClient{}, cfg)
+
+	assert.Equal(t, 10*time.Second, repo.retryDelay(1))
+	assert.Equal(t, 40*time.Second, repo.retryDelay(3))
+	assert.Equal(t, maxRetryDelay, repo.retryDelay(100))
+
+	meeting := model.Meeting{UUID: "failedUUID", StartTime: time.Now(), Records: []model.Record{
+		{Id: "failedId", MeetingId: "failedUUID", StartTime: time.Now(), FileExtension: "MP4", FileSize: 10, DownloadURL: ts.URL + "/rec/download/failedId"},
+	}}
+	require.NoError(t, store.SaveMeeting(ctx, meeting))
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		rec, err := store.ClaimQueuedRecord(ctx)
+		require.NoError(t, err)
+		assert.Error(t, repo.DownloadRecord(ctx, rec))
+
+		recs, err := store.GetRecords(ctx, meeting.UUID)
+		require.NoError(t, err)
+		assert.Equal(t, attempt, recs[0].Attempts)
+		assert.Contains(t, recs[0].LastError, "500")
+		assert.NotContains(t, recs[0].LastError, "testToken")
+		if attempt < 3 {
+			assert.Equal(t, model.StatusFailed, recs[0].Status)
+			// not due yet
+			require.NoError(t, store.ResetFailedRecords(ctx))
+			_, err = store.ClaimQueuedRecord(ctx)
+			assert.ErrorIs(t, err, storage.ErrNoRows)
+			require.NoError(t, store.UpdateRecordAttempt(ctx, rec.Id, model.StatusQueued, recs[0].Attempts, recs[0].LastError, time.Now()))
+		} else {
+			assert.Equal(t, model.StatusAbandoned, recs[0].Status)
+		}
+	}
+
+	// due failed records are requeued while other downloads are in progress, the stale 'downloading' ones are not
+	require.NoError(t, store.SaveMeeting(ctx, model.Meeting{UUID: "dueUUID", StartTime: time.Now(), Records: []model.Record{
+		{Id: "dueId", MeetingId: "dueUUID", StartTime: time.Now(), FileExtension: "MP4", FileSize: 10},
+		{Id: "staleId", MeetingId: "dueUUID", StartTime: time.Now(), FileExtension: "MP4", FileSize: 10},
+	}}))
+	require.NoError(t, store.UpdateRecordAttempt(ctx, "dueId", model.StatusFailed, 1, "err", time.Now().Add(-time.Minute)))
+	require.NoError(t, store.UpdateRecord(ctx, "staleId", model.StatusDownloading, ""))
+	repo.inFlight = 1
+	assert.ErrorIs(t, repo.DownloadOnce(ctx), ErrNoQueuedRecords)
+	recs, err := store.GetRecords(ctx, "dueUUID")
+	require.NoError(t, err)
+	statuses := map[string]model.RecordStatus{}
+	for _, r := range recs {
+		statuses[r.Id] = r.Status
+	}
+	assert.Equal(t, map[string]model.RecordStatus{"dueId": model.StatusQueued, "staleId": model.StatusDownloading}, statuses)
+}
+
+// stale download url is refreshed, record deleted from the cloud is marked as lost
+func Test_DownloadRecordRefresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	content := testMP4(60, 1024)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rec/download/fresh" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "fresh.mp4", time.Now(), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir()}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/refresh_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	zoom := &testClient{}
+	repo := NewRepository(store, zoom, cfg)
+
+	meeting := model.Meeting{UUID: "refreshUUID", StartTime: time.Now(), Records: []model.Record{
+		{Id: "refreshId", MeetingId: "refreshUUID", StartTime: time.Now(), FileExtension: "MP4", FileSize: 10, DownloadURL: ts.URL + "/rec/download/stale"},
+	}}
+	require.NoError(t, store.SaveMeeting(ctx, meeting))
+
+	zoom.meeting = &model.Meeting{UUID: "refreshUUID", Records: []model.Record{
+		{Id: "refreshId", DownloadURL: ts.URL + "/rec/download/fresh", FileSize: model.FileSize(len(content))},
+	}}
+	rec, err := store.ClaimQueuedRecord(ctx)
+	require.NoError(t, err)
+	require.NoError(t, repo.DownloadRecord(ctx, rec))
+
+	recs, err := store.GetRecords(ctx, meeting.UUID)
+	require.NoError(t, err)
+	assert.Equal(t, model.StatusDownloaded, recs[0].Status)
+	assert.Equal(t, ts.URL+"/rec/download/fresh", recs[0].DownloadURL)
+	assert.Equal(t, model.FileSize(len(content)), recs[0].FileSize)
+	data, err := os.ReadFile(recs[0].FilePath)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	// meeting is in the trash, still downloadable
+	require.NoError(t, store.UpdateRecordSource(ctx, "refreshId", ts.URL+"/rec/download/stale", 10))
+	require.NoError(t, store.UpdateRecord(ctx, "refreshId", model.StatusQueued, ""))
+	zoom.trashed, zoom.meeting = zoom.meeting, nil
+	rec, err = store.ClaimQueuedRecord(ctx)
+	require.NoError(t, err)
+	require.NoError(t, repo.DownloadRecord(ctx, rec))
+	recs, err = store.GetRecords(ctx, meeting.UUID)
+	require.NoError(t, err)
+	assert.Equal(t, model.StatusDownloaded, recs[0].Status)
+	assert.Equal(t, ts.URL+"/rec/download/fresh", recs[0].DownloadURL)
+
+	// meeting is deleted from the cloud
+	require.NoError(t, store.UpdateRecordSource(ctx, "refreshId", ts.URL+"/rec/download/stale", 10))
+	require.NoError(t, store.UpdateRecord(ctx, "refreshId", model.StatusQueued, ""))
+	zoom.trashed = nil
+	rec, err = store.ClaimQueuedRecord(ctx)
+	require.NoError(t, err)
+	assert.ErrorIs(t, repo.DownloadRecord(ctx, rec), ErrRecordLost)
+
+	recs, err = store.GetRecords(ctx, meeting.UUID)
+	require.NoError(t, err)
+	assert.Equal(t, model.StatusLost, recs[0].Status)
+	assert.Equal(t, 0, recs[0].Attempts)
+}
+
+// sync covers the days from the cursor up to today in chunks and moves the cursor
+func Test_SyncRange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Parameters{Syncable: config.Syncable{Important: []string{string(model.SharedScreenWithGalleryView)}}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/sync_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	zoom := &testClient{}
+	repo := NewRepository(store, zoom, cfg)
+
+	// no cursor - yesterday
+	from, err := repo.syncFrom(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, time.Now().AddDate(0, 0, -1).Format(time.DateOnly), from.Format(time.DateOnly))
+
+	// the day before the cursor
+	require.NoError(t, store.SetCursor(ctx, SyncCursor, "2024-01-10"))
+	from, err = repo.syncFrom(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "2024-01-09", from.Format(time.DateOnly))
+
+	to := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+	require.NoError(t, repo.SyncRange(ctx, from, to, SyncCursor))
+	assert.Equal(t, [][2]string{{"2024-01-09", "2024-02-07"}, {"2024-02-08", "2024-03-01"}}, zoom.intervals)
+	cursor, err := store.GetCursor(ctx, SyncCursor)
+	require.NoError(t, err)
+	assert.Equal(t, "2024-03-01", cursor)
+
+	// failed chunk keeps the cursor at the last synced one
+	zoom.intervals = nil
+	zoom.meetings = func(from, to time.Time) ([]model.Meeting, error) {
+		if from.Month() == time.April {
+			return nil, errors.New("zoom is down")
+		}
+		return []model.Meeting{{UUID: from.Format(time.DateOnly), Duration: 10, StartTime: from, Records: []model.Record{
+			{Id: "rec" + from.Format(time.DateOnly), Type: model.SharedScreenWithGalleryView, StartTime: from},
+		}}}, nil
+	}
+	err = repo.SyncRange(ctx, time.Date(2024, 3, 2, 0, 0, 0, 0, time.Local), time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local), SyncCursor)
+	assert.ErrorContains(t, err, "zoom is down")
+	cursor, err = store.GetCursor(ctx, SyncCursor)
+	require.NoError(t, err)
+	assert.Equal(t, "2024-03-31", cursor)
+	_, err = store.GetMeeting(ctx, "2024-03-02")
+	assert.NoError(t, err)
+}
+
+// all queued records are downloaded, failed records not due yet are left for later
+func Test_DownloadQueued(t *testing.T) {
+	downloadQueuedPause = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	content := testMP4(60, 1024)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rec/download/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, "rec.mp4", time.Now(), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir()}, Download: config.Download{RetryDelay: 3600}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/queued_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	repo := NewRepository(store, &testClient{}, cfg)
+
+	meeting := model.Meeting{UUID: "queuedUUID", StartTime: time.Now()}
+	for _, id := range []string{"q1", "q2", "broken"} {
+		meeting.Records = append(meeting.Records, model.Record{Id: id, MeetingId: meeting.UUID, StartTime: time.Now(),
+			FileExtension: "MP4", FileSize: model.FileSize(len(content)), DownloadURL: ts.URL + "/rec/download/" + id})
+	}
+	require.NoError(t, store.SaveMeeting(ctx, meeting))
+
+	ctx, cancelDownloads := context.WithTimeout(ctx, 10*time.Second)
+	defer cancelDownloads()
+	require.NoError(t, repo.DownloadQueued(ctx))
+
+	downloaded, err := store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	require.NoError(t, err)
+	assert.Len(t, downloaded, 2)
+	failed, err := store.GetRecordsByStatus(ctx, model.StatusFailed)
+	require.NoError(t, err)
+	require.Len(t, failed, 1)
+	assert.Equal(t, "broken", failed[0].Id)
+}
+
+// download workers share the bandwidth limit, the written bytes are taken off the space reservation
+func Test_DownloadReservation(t *testing.T) {
+	reserved := &atomic.Int64{}
+	reserved.Add(1000)
+	res := newDownloadReservation(reserved, 1000, nil)
+	res.consume(300) // resumed .part file
+	assert.Equal(t, int64(700), reserved.Load())
+	require.NoError(t, res.WaitN(context.Background(), 200))
+	assert.Equal(t, int64(500), reserved.Load())
+	res.consume(1000) // never releases more than reserved
+	assert.Equal(t, int64(0), reserved.Load())
+	res.reset(800)
+	assert.Equal(t, int64(800), reserved.Load())
+	res.release()
+	res.release()
+	assert.Equal(t, int64(0), reserved.Load())
+
+	// 2 workers transfer 40 KB at 100 KB/s together, the first chunk is not delayed
+	limiter := newBandwidthLimiter(100 << 10)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := newDownloadReservation(&atomic.Int64{}, 20<<10, limiter)
+			for range 4 {
+				assert.NoError(t, res.WaitN(context.Background(), 5<<10))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.GreaterOrEqual(t, time.Since(start), 330*time.Millisecond)
+	assert.Nil(t, newBandwidthLimiter(0))
+}
+
+// DownloadJob runs cfg.Download.Workers downloads at once, never more
+func Test_DownloadWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	content := testMP4(60, 1024)
+	var active, maxActive atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			m := maxActive.Load()
+			if n <= m || maxActive.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(300 * time.Millisecond)
+		http.ServeContent(w, r, "rec.mp4", time.Now(), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir()}, Download: config.Download{Workers: 3}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/workers_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	repo := NewRepository(store, &testClient{}, cfg)
+
+	meeting := model.Meeting{UUID: "workersUUID", StartTime: time.Now()}
+	for i := range 5 {
+		id := fmt.Sprintf("w%d", i)
+		meeting.Records = append(meeting.Records, model.Record{Id: id, MeetingId: meeting.UUID, StartTime: time.Now(),
+			FileExtension: "MP4", FileSize: model.FileSize(len(content)), DownloadURL: ts.URL + "/rec/download/" + id})
+	}
+	require.NoError(t, store.SaveMeeting(ctx, meeting))
+
+	done := make(chan struct{})
+	go func() {
+		repo.DownloadJob(ctx)
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		downloaded, err := store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+		return err == nil && len(downloaded) == 5
+	}, 10*time.Second, 50*time.Millisecond)
+	cancel()
+	<-done
+	assert.Equal(t, int32(3), maxActive.Load())
+	for _, res := range repo.reserved {
+		assert.Equal(t, int64(0), res.Load(), "all reservations are released")
+	}
+}
+
+// cloud and local catalog differences are reported, missing and lost records are queued
+func Test_Reconcile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir()},
+		Syncable: config.Syncable{Important: []string{string(model.SharedScreenWithGalleryView)}, MinDuration: 5}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/reconcile_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	zoom := &testClient{}
+	repo := NewRepository(store, zoom, cfg)
+
+	now := time.Now()
+	rec := func(id string, size model.FileSize) model.Record {
+		return model.Record{Id: id, Type: model.SharedScreenWithGalleryView, StartTime: now, FileExtension: "MP4",
+			FileSize: size, DownloadURL: "https://zoom.us/rec/download/" + id}
+	}
+	local := model.Meeting{UUID: "local", Duration: 10, StartTime: now, Records: []model.Record{
+		rec("synced", 100), rec("resized", 100), rec("lost", 100), rec("gone", 100), rec("missingFile", 100),
+	}}
+	for i := range local.Records {
+		local.Records[i].MeetingId = local.UUID
+	}
+	require.NoError(t, store.SaveMeeting(ctx, local))
+	require.NoError(t, store.UpdateRecord(ctx, "lost", model.StatusLost, ""))
+	require.NoError(t, store.SetRecordDownloaded(ctx, "missingFile", "", filepath.Join(t.TempDir(), "nothing.mp4"), ""))
+
+	zoom.all = []model.Meeting{
+		{UUID: "local", Duration: 10, StartTime: now, Records: []model.Record{
+			rec("synced", 100), rec("resized", 200), rec("lost", 100), rec("missingFile", 100), rec("new", 100),
+		}},
+		{UUID: "cloud", Duration: 10, StartTime: now, Records: []model.Record{rec("cloud1", 100)}},
+		{UUID: "cloud", Duration: 10, StartTime: now, Records: []model.Record{rec("cloud1", 100)}},
+		{UUID: "short", Duration: 1, StartTime: now, Records: []model.Record{rec("short1", 100)}},
+		{UUID: "audio", Duration: 10, StartTime: now, Records: []model.Record{{Id: "audio1", Type: model.AudioOnly, StartTime: now}}},
+	}
+	for _, m := range zoom.all {
+		for i := range m.Records {
+			m.Records[i].MeetingId = m.UUID
+		}
+	}
+
+	ids := func(items []ReconcileItem) []string {
+		res := []string{}
+		for _, i := range items {
+			res = append(res, i.RecordId)
+		}
+		sort.Strings(res)
+		return res
+	}
+
+	report, err := repo.Reconcile(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cloud1", "new"}, ids(report.CloudOnly))
+	assert.Equal(t, []string{"gone"}, ids(report.LocalOnly))
+	assert.Equal(t, []string{"resized"}, ids(report.SizeMismatch))
+	assert.Equal(t, []string{"lost", "missingFile"}, ids(report.StatusMismatch))
+	assert.Equal(t, 0, report.Queued)
+	_, err = store.GetMeeting(ctx, "cloud")
+	assert.ErrorIs(t, err, storage.ErrNoRows)
+
+	var table bytes.Buffer
+	require.NoError(t, report.WriteTable(&table))
+	assert.Contains(t, table.String(), "Cloud only: 2")
+	assert.Contains(t, table.String(), "Local only: 1")
+
+	report, err = repo.Reconcile(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Queued)
+	queued, err := store.GetRecordsByStatus(ctx, model.StatusQueued)
+	require.NoError(t, err)
+	queuedIds := []string{}
+	for _, r := range queued {
+		queuedIds = append(queuedIds, r.Id)
+	}
+	sort.Strings(queuedIds)
+	assert.Equal(t, []string{"cloud1", "gone", "lost", "new", "resized", "synced"}, queuedIds)
+
+	report, err = repo.Reconcile(ctx, false)
+	require.NoError(t, err)
+	assert.Empty(t, report.CloudOnly)
+	assert.Equal(t, []string{"missingFile"}, ids(report.StatusMismatch))
+}
+
+// records are evicted following the retention rules, expired ones even if there is enough free space
+func Test_Retention(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir(), Retention: []config.RetentionRule{
+		{Name: "board", Topic: regexp.MustCompile("(?i)board"), Pin: true},
+		{Name: "pinned id", MeetingIds: []string{"42"}, Pin: true},
+		{Name: "chats", Types: []string{string(model.ChatFile)}, MaxAge: 30},
+		{Name: "recent", MinAge: 7},
+	}}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/retention_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	repo := NewRepository(store, &testClient{}, cfg)
+
+	saveMeeting := func(uuid string, id uint64, topic string, daysAgo int, types ...model.RecordType) {
+		start := time.Now().AddDate(0, 0, -daysAgo)
+		m := model.Meeting{UUID: uuid, Id: id, Topic: topic, StartTime: start}
+		for _, tp := range types {
+			m.Records = append(m.Records, model.Record{Id: uuid + "_" + string(tp), MeetingId: uuid, Type: tp, StartTime: start})
+		}
+		require.NoError(t, store.SaveMeeting(ctx, m))
+		for _, rec := range m.Records {
+			rec.DateTime = start.Format(time.DateTime)
+			recFolder, _ := rec.Paths(cfg.Storage.Repository)
+			require.NoError(t, os.MkdirAll(recFolder, 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(recFolder, rec.Id), []byte("test"), 0o644))
+			require.NoError(t, store.SetRecordDownloaded(ctx, rec.Id, "", filepath.Join(recFolder, rec.Id), ""))
+		}
+	}
+	saveMeeting("board", 1, "Board meeting", 100, model.SharedScreenWithGalleryView)
+	saveMeeting("pinned", 42, "Pinned", 100, model.SharedScreenWithGalleryView)
+	saveMeeting("kept", 2, "Kept", 100, model.SharedScreenWithGalleryView)
+	saveMeeting("old", 3, "Old", 60, model.SharedScreenWithGalleryView, model.ChatFile)
+	saveMeeting("watched", 4, "Watched", 50, model.SharedScreenWithGalleryView)
+	saveMeeting("newer", 5, "Newer", 20, model.SharedScreenWithGalleryView, model.ChatFile)
+	saveMeeting("recent", 6, "Recent", 1, model.SharedScreenWithGalleryView)
+	require.NoError(t, store.SetMeetingKeep(ctx, "kept", true))
+	require.NoError(t, store.SetMeetingWatched(ctx, "watched", time.Now()))
+	assert.ErrorIs(t, store.SetMeetingKeep(ctx, "noSuchMeeting", true), storage.ErrNoRows)
+
+	candidates, err := repo.evictionCandidates(ctx)
+	require.NoError(t, err)
+	ids := []string{}
+	for _, c := range candidates {
+		ids = append(ids, c.Id)
+	}
+	assert.Equal(t, []string{
+		"old_chat_file", // expired
+		"old_shared_screen_with_gallery_view",
+		"newer_shared_screen_with_gallery_view",
+		"newer_chat_file",
+		"watched_shared_screen_with_gallery_view",
+	}, ids)
+	assert.True(t, candidates[0].expired)
+	assert.False(t, candidates[1].expired)
+
+	// enough free space, only the expired record is evicted
+	deleted, err := repo.freeUpSpace(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	evicted, err := store.GetRecordsByStatus(ctx, model.StatusDeleted)
+	require.NoError(t, err)
+	require.Len(t, evicted, 1)
+	assert.Equal(t, "old_chat_file", evicted[0].Id)
+}
+
+// expired records are evicted by the retention job, without downloads
+func Test_RetentionJob(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir(), Retention: []config.RetentionRule{{Name: "old", MaxAge: 30}}}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/retention_job_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	repo := NewRepository(store, &testClient{}, cfg)
+
+	for id, daysAgo := range map[string]int{"expiredId": 60, "freshId": 10} {
+		start := time.Now().AddDate(0, 0, -daysAgo)
+		rec := model.Record{Id: id, MeetingId: id + "UUID", StartTime: start, FileExtension: "MP4", FileSize: 4, DateTime: start.Format(time.DateTime)}
+		require.NoError(t, store.SaveMeeting(ctx, model.Meeting{UUID: id + "UUID", StartTime: start, Records: []model.Record{rec}}))
+		recFolder, _ := rec.Paths(cfg.Storage.Repository)
+		require.NoError(t, os.MkdirAll(recFolder, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(recFolder, "rec.mp4"), []byte("test"), 0o644))
+		require.NoError(t, store.SetRecordDownloaded(ctx, id, "", filepath.Join(recFolder, "rec.mp4"), ""))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		repo.RetentionJob(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		evicted, err := store.GetRecordsByStatus(ctx, model.StatusDeleted)
+		return err == nil && len(evicted) == 1 && evicted[0].Id == "expiredId"
+	}, 5*time.Second, 10*time.Millisecond)
+	downloaded, err := store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	require.NoError(t, err)
+	require.Len(t, downloaded, 1)
+	assert.Equal(t, "freshId", downloaded[0].Id)
+
+	cancel()
+	<-done
+}
+
+// evicted records are moved to the archive, checked there and restored back
+func Test_Archive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir(), Archive: t.TempDir(),
+		Retention: []config.RetentionRule{{Name: "old", MaxAge: 30}}}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/archive_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	repo := NewRepository(store, &testClient{}, cfg)
+
+	start := time.Now().AddDate(0, 0, -60)
+	rec := model.Record{Id: "archivedId", MeetingId: "archiveUUID", StartTime: start, FileExtension: "MP4", FileSize: 4,
+		DateTime: start.Format(time.DateTime)}
+	require.NoError(t, store.SaveMeeting(ctx, model.Meeting{UUID: "archiveUUID", StartTime: start, Records: []model.Record{rec}}))
+	recFolder, dateFolder := rec.Paths(cfg.Storage.Repository)
+	require.NoError(t, os.MkdirAll(recFolder, 0o755))
+	filePath := filepath.Join(recFolder, "rec.mp4")
+	require.NoError(t, os.WriteFile(filePath, []byte("test"), 0o644))
+	require.NoError(t, store.SetRecordDownloaded(ctx, rec.Id, "", filePath, ""))
+
+	deleted, err := repo.freeUpSpace(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.NoDirExists(t, dateFolder)
+
+	archived, err := store.GetRecordsByStatus(ctx, model.StatusArchived)
+	require.NoError(t, err)
+	require.Len(t, archived, 1)
+	archFolder, _ := rec.Paths(cfg.Storage.Archive)
+	assert.Equal(t, filepath.Join(archFolder, "rec.mp4"), archived[0].FilePath)
+	assert.FileExists(t, archived[0].FilePath)
+
+	checked, err := repo.CheckConsistency(ctx, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, checked)
+	meetings, err := store.ListMeetings(ctx)
+	require.NoError(t, err)
+	assert.Len(t, meetings, 1)
+
+	assert.ErrorIs(t, repo.RestoreRecord(ctx, "noSuchId"), storage.ErrNoRows)
+	require.NoError(t, repo.RestoreRecord(ctx, rec.Id))
+	restored, err := store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	require.NoError(t, err)
+	require.Len(t, restored, 1)
+	assert.Equal(t, filePath, restored[0].FilePath)
+	assert.FileExists(t, filePath)
+	assert.NoDirExists(t, archFolder)
+	assert.ErrorContains(t, repo.RestoreRecord(ctx, rec.Id), "is downloaded, not archived")
+	meeting, err := store.GetMeeting(ctx, "archiveUUID")
+	require.NoError(t, err)
+	assert.NotEmpty(t, meeting.WatchedAt)
+
+	// the bucket archive is named "archive" by default, the config is not changed
+	s3cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir(), ArchiveS3: config.S3{Bucket: "bucket"}}}
+	s3repo := NewRepository(store, &testClient{}, s3cfg)
+	assert.Equal(t, "archive", s3repo.ArchiveRoot)
+	assert.Empty(t, s3cfg.Storage.Archive)
+}
+
+func Test_Roots(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	root1, root2 := t.TempDir(), t.TempDir()
+	cfg := &config.Parameters{Storage: config.Storage{Repositories: []string{root1, root2}, KeepFreeSpace: 1}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/roots_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	repo := NewRepository(store, &testClient{}, cfg)
+
+	// both roots are on the same drive, the space reserved on the first one moves the next download to the second
+	rec := &model.Record{Id: "rec1", FileExtension: "MP4", FileSize: 1 << 20, DateTime: "2024-01-10 10:00:00"}
+	root, err := repo.placeRecord(rec)
+	require.NoError(t, err)
+	assert.Equal(t, root1, root)
+	root, err = repo.placeRecord(&model.Record{Id: "rec2", FileExtension: "MP4", FileSize: 1 << 20, DateTime: "2024-01-10 10:00:00"})
+	require.NoError(t, err)
+	assert.Equal(t, root2, root)
+	repo.reserved[root1].Add(-int64(rec.FileSize))
+	repo.reserved[root2].Add(-int64(rec.FileSize))
+
+	// first_fit takes the first root with enough space
+	cfg.Storage.Placement = "first_fit"
+	repo.reserved[root1].Add(1 << 20)
+	root, err = repo.placeRecord(rec)
+	require.NoError(t, err)
+	assert.Equal(t, root1, root)
+	repo.reserved[root1].Add(-2 << 20)
+
+	// the root with the .part file of the previous attempt is reused
+	recFolder, _ := rec.Paths(root2)
+	require.NoError(t, os.MkdirAll(recFolder, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(recFolder, "rec1.mp4.part"), []byte("part"), 0o644))
+	root, err = repo.placeRecord(rec)
+	require.NoError(t, err)
+	assert.Equal(t, root2, root)
+	repo.reserved[root2].Add(-int64(rec.FileSize))
+	require.NoError(t, os.RemoveAll(recFolder))
+
+	// records of the root short of space are evicted, the other root is not touched
+	start := time.Now().AddDate(0, 0, -10)
+	m := model.Meeting{UUID: "meeting", Id: 1, Topic: "Roots", StartTime: start}
+	for i, root := range []string{root1, root2, root1, root2} {
+		m.Records = append(m.Records, model.Record{Id: fmt.Sprintf("rec%d", i), MeetingId: m.UUID, Type: model.SharedScreenWithGalleryView, StartTime: start, FileSize: 4, Root: root})
+	}
+	require.NoError(t, store.SaveMeeting(ctx, m))
+	for _, rec := range m.Records {
+		rec.DateTime = start.Format(time.DateTime)
+		recFolder, _ := rec.Paths(rec.Root)
+		require.NoError(t, os.MkdirAll(recFolder, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(recFolder, rec.Id), []byte("test"), 0o644))
+		require.NoError(t, store.SetRecordDownloaded(ctx, rec.Id, rec.Root, filepath.Join(recFolder, rec.Id), ""))
+	}
+	usage, err := repo.diskUsage(root1)
+	require.NoError(t, err)
+	repo.reserved[root1].Store(int64(usage.Free) + 1<<30)
+	deleted, err := repo.freeUpSpace(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	left, err := store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	require.NoError(t, err)
+	require.Len(t, left, 2)
+	for _, rec := range left {
+		assert.Equal(t, root2, rec.Root)
+		assert.NoError(t, repo.VerifyFile(ctx, rec, false))
+	}
+}
+
+func Test_RenderLayout(t *testing.T) {
+	rec := model.Record{Id: "rec1", MeetingId: "ab/cd==", Type: model.SharedScreenWithGalleryView, FileExtension: "MP4", DateTime: "2024-01-10 10:05:00"}
+
+	key, err := renderLayout("", rec, "", "GMT20240110-100500_Recording.mp4")
+	require.NoError(t, err)
+	assert.Equal(t, "2024-01-10/rec1/GMT20240110-100500_Recording.mp4", key)
+
+	key, err = renderLayout("{date}/{topic}/{start_time}_{type}.{ext}", rec, ` Weekly: sync / "Q1" ..`, "")
+	require.NoError(t, err)
+	assert.Equal(t, "2024-01-10/Weekly_ sync _ _Q1_/10-05-00_shared_screen_with_gallery_view.mp4", key)
+
+	key, err = renderLayout("{meeting}/{topic}/{id}.{ext}", rec, "..", "")
+	require.NoError(t, err)
+	assert.Equal(t, "ab_cd==/_/rec1.mp4", key)
+
+	key, err = renderLayout("{topic}/{id}", rec, strings.Repeat("ж", 100), "")
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("ж", 50)+"/rec1", key)
+
+	_, err = renderLayout("{date}/{host}/{id}", rec, "", "")
+	assert.Error(t, err)
+	_, err = renderLayout("/{date}/{id}", rec, "", "")
+	assert.Error(t, err)
+	_, err = renderLayout("{date}//{id}", rec, "", "")
+	assert.Error(t, err)
+
+	assert.NoError(t, CheckLayout(""))
+	assert.NoError(t, CheckLayout("{date}/{topic}/{start_time}_{type}.{ext}"))
+	assert.Error(t, CheckLayout("{date}/{host}/{id}"))
+	assert.Error(t, CheckLayout("../{id}"))
+}
+
+// records with the same layout path - the second download fails, the first file is kept
+func Test_DownloadRecordPathTaken(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	content := testMP4(60, 1024)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "rec.mp4", time.Now(), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir(), Layout: "{date}/{type}.{ext}"}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/taken_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	repo := NewRepository(store, &testClient{}, cfg)
+
+	start := time.Date(2024, 1, 10, 10, 5, 0, 0, time.Local)
+	for _, id := range []string{"first", "second"} {
+		require.NoError(t, store.SaveMeeting(ctx, model.Meeting{UUID: id + "UUID", StartTime: start, Duration: 60, Records: []model.Record{
+			{Id: id, MeetingId: id + "UUID", Type: model.SharedScreenWithGalleryView, StartTime: start, FileExtension: "MP4",
+				FileSize: model.FileSize(len(content)), DownloadURL: ts.URL + "/rec/download/" + id},
+		}}))
+	}
+
+	rec, err := store.ClaimQueuedRecord(ctx)
+	require.NoError(t, err)
+	require.NoError(t, repo.DownloadRecord(ctx, rec))
+	rec, err = store.ClaimQueuedRecord(ctx)
+	require.NoError(t, err)
+	assert.ErrorIs(t, repo.DownloadRecord(ctx, rec), ErrPathTaken)
+
+	downloaded, err := store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	require.NoError(t, err)
+	require.Len(t, downloaded, 1)
+	assert.Equal(t, filepath.Join(cfg.Storage.Repository, "2024-01-10", "shared_screen_with_gallery_view.mp4"), downloaded[0].FilePath)
+	assert.FileExists(t, downloaded[0].FilePath)
+}
+
+func Test_Relayout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir()}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/relayout_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	repo := NewRepository(store, &testClient{}, cfg)
+
+	start := time.Date(2024, 1, 10, 10, 5, 0, 0, time.Local)
+	m := model.Meeting{UUID: "meeting1", Id: 1, Topic: "Weekly sync", StartTime: start}
+	for _, tp := range []model.RecordType{model.SharedScreenWithGalleryView, model.AudioOnly, model.ChatFile} {
+		m.Records = append(m.Records, model.Record{Id: "rec_" + string(tp), MeetingId: m.UUID, Type: tp, FileExtension: "MP4", FileSize: 4, StartTime: start})
+	}
+	require.NoError(t, store.SaveMeeting(ctx, m))
+	for _, rec := range m.Records {
+		rec.DateTime = start.Format(time.DateTime)
+		recFolder, _ := rec.Paths(cfg.Storage.Repository)
+		require.NoError(t, os.MkdirAll(recFolder, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(recFolder, rec.Id+".mp4"), []byte("test"), 0o644))
+		require.NoError(t, store.SetRecordDownloaded(ctx, rec.Id, cfg.Storage.Repository, filepath.Join(recFolder, rec.Id+".mp4"), ""))
+	}
+
+	// default layout, nothing to move
+	moves, err := repo.Relayout(ctx, false)
+	require.NoError(t, err)
+	assert.Empty(t, moves)
+
+	// the chat file would take the path of the audio
+	cfg.Storage.Layout = "{date}/{topic}/{start_time}_{ext}"
+	moves, err = repo.Relayout(ctx, true)
+	assert.ErrorContains(t, err, "have the same path")
+	assert.Len(t, moves, 1)
+
+	cfg.Storage.Layout = "{date}/{topic}/{start_time}_{type}.{ext}"
+	moves, err = repo.Relayout(ctx, true)
+	require.NoError(t, err)
+	require.Len(t, moves, 3)
+	assert.FileExists(t, moves[0].From)
+	assert.NoFileExists(t, moves[0].To)
+
+	moves, err = repo.Relayout(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, moves, 3)
+	assert.FileExists(t, filepath.Join(cfg.Storage.Repository, "2024-01-10", "Weekly sync", "10-05-00_audio_only.mp4"))
+	assert.NoDirExists(t, filepath.Join(cfg.Storage.Repository, "2024-01-10", "rec_audio_only"))
+	recs, err := store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	require.NoError(t, err)
+	for _, rec := range recs {
+		assert.NoError(t, repo.VerifyFile(ctx, rec, false))
+	}
+
+	// and back to the default layout
+	cfg.Storage.Layout = ""
+	moves, err = repo.Relayout(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, moves, 3)
+	assert.FileExists(t, filepath.Join(cfg.Storage.Repository, "2024-01-10", "rec_audio_only", "10-05-00_audio_only.mp4"))
+	assert.NoDirExists(t, filepath.Join(cfg.Storage.Repository, "2024-01-10", "Weekly sync"))
+}
+
+func Test_RebuildDB(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir(), Archive: t.TempDir(), Layout: "{date}/{topic}/{type}.{ext}"}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/sidecar_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	repo := NewRepository(store, &testClient{}, cfg)
+
+	// two meetings with the same topic share the folder
+	start := time.Date(2024, 1, 10, 10, 0, 0, 0, time.Local)
+	for i, uuid := range []string{"meeting1", "meeting2"} {
+		m := model.Meeting{UUID: uuid, Id: uint64(i + 1), Topic: "Weekly", StartTime: start.Add(time.Duration(i) * time.Hour), Duration: 45, HostEmail: "host@example.com"}
+		for _, tp := range []model.RecordType{model.SharedScreenWithGalleryView, model.AudioOnly} {
+			m.Records = append(m.Records, model.Record{Id: uuid + "_" + string(tp), MeetingId: uuid, Type: tp, FileExtension: "MP4",
+				FileSize: model.FileSize(len(uuid) + 1<<30), StartTime: m.StartTime})
+		}
+		require.NoError(t, store.SaveMeeting(ctx, m))
+	}
+	recs, err := store.GetRecordsByStatus(ctx, model.StatusQueued)
+	require.NoError(t, err)
+	require.Len(t, recs, 4)
+	for i, rec := range recs {
+		// size of the file matches the size of the record, big files are sparse
+		key := fmt.Sprintf("2024-01-10/Weekly/%d.mp4", i)
+		filePath := filepath.Join(cfg.Storage.Repository, filepath.FromSlash(key))
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0o755))
+		f, err := os.Create(filePath)
+		require.NoError(t, err)
+		require.NoError(t, f.Truncate(int64(rec.FileSize)))
+		require.NoError(t, f.Close())
+		require.NoError(t, store.SetRecordDownloaded(ctx, rec.Id, cfg.Storage.Repository, filePath, "sum"+rec.Id))
+		rec.Sha256 = "sum" + rec.Id
+		require.NoError(t, repo.addToSidecar(ctx, repo.Files[cfg.Storage.Repository], key, rec))
+	}
+	require.NoError(t, repo.SetMeetingKeep(ctx, "meeting2", true))
+	assert.FileExists(t, filepath.Join(cfg.Storage.Repository, "2024-01-10", "Weekly", sidecarName))
+	assert.FileExists(t, filepath.Join(cfg.Storage.Repository, "2024-01-10", "Weekly", "2.mp4."+sidecarName))
+
+	// archived record moves to the sidecar in the archive
+	downloaded, err := store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	require.NoError(t, err)
+	require.NoError(t, repo.archiveRecord(ctx, downloaded[0]))
+
+	// the database is lost
+	fresh, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/rebuilt_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	rebuilt := NewRepository(fresh, &testClient{}, cfg)
+	meetings, records, err := rebuilt.RebuildDB(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, meetings)
+	assert.Equal(t, 4, records)
+
+	for _, status := range []model.RecordStatus{model.StatusDownloaded, model.StatusArchived} {
+		want, err := store.GetRecordsByStatus(ctx, status)
+		require.NoError(t, err)
+		got, err := fresh.GetRecordsByStatus(ctx, status)
+		require.NoError(t, err)
+		if status == model.StatusArchived {
+			// the root of the archived record is where it was downloaded to, it's not known from the archive
+			for i := range want {
+				want[i].Root = ""
+			}
+		}
+		assert.Equal(t, want, got, status)
+	}
+	m, err := fresh.GetMeeting(ctx, "meeting2")
+	require.NoError(t, err)
+	assert.True(t, m.Keep)
+	assert.Equal(t, "Weekly", m.Topic)
+	assert.Equal(t, uint64(2), m.Id)
+	assert.Equal(t, "host@example.com", m.HostEmail)
+	assert.Equal(t, "2024-01-10 11:00:00", m.DateTime)
+	assert.Equal(t, 45, m.Duration)
+
+	// nothing is added twice
+	meetings, records, err = rebuilt.RebuildDB(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, meetings)
+	assert.Equal(t, 0, records)
+}
+
+// concurrent updates of the sidecar of one folder don't lose records
+func Test_SidecarConcurrent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir()}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/sidecar_mx_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	repo := NewRepository(store, &testClient{}, cfg)
+	files := repo.Files[cfg.Storage.Repository]
+
+	m := model.Meeting{UUID: "meeting1", Topic: "Weekly", StartTime: time.Date(2024, 1, 10, 10, 0, 0, 0, time.Local)}
+	for i := 0; i < 20; i++ {
+		m.Records = append(m.Records, model.Record{Id: fmt.Sprintf("rec%d", i), MeetingId: m.UUID, FileExtension: "MP4", StartTime: m.StartTime})
+	}
+	require.NoError(t, store.SaveMeeting(ctx, m))
+
+	update := func(remove bool, recs []model.Record) {
+		var wg sync.WaitGroup
+		for _, rec := range recs {
+			wg.Add(1)
+			go func(rec model.Record) {
+				defer wg.Done()
+				key := "2024-01-10/" + rec.Id + ".mp4"
+				if remove {
+					assert.NoError(t, repo.removeFromSidecar(ctx, files, key, rec))
+					return
+				}
+				assert.NoError(t, repo.addToSidecar(ctx, files, key, rec))
+			}(rec)
+		}
+		wg.Wait()
+	}
+
+	update(false, m.Records)
+	sc, err := readSidecar(ctx, files, "2024-01-10/"+sidecarName)
+	require.NoError(t, err)
+	require.NotNil(t, sc)
+	assert.Len(t, sc.Records, 20)
+
+	update(true, m.Records[:10])
+	sc, err = readSidecar(ctx, files, "2024-01-10/"+sidecarName)
+	require.NoError(t, err)
+	require.NotNil(t, sc)
+	assert.Len(t, sc.Records, 10)
+}
+
+func Test_Import(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir(), Layout: "{date}/{topic}/{start_time}_{type}.{ext}"}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/import_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	repo := NewRepository(store, &testClient{}, cfg)
+
+	// old manual downloads of one meeting
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "video.mp4"), []byte("video"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "audio.M4A"), []byte("audio"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "notes.doc"), []byte("notes"), 0o644))
+	start := time.Date(2023, 5, 1, 9, 30, 0, 0, time.Local)
+
+	_, err = repo.Import(ctx, src, ImportMeta{StartTime: start})
+	assert.ErrorContains(t, err, "topic")
+	imported, err := repo.Import(ctx, src, ImportMeta{Topic: "Old meeting", StartTime: start})
+	require.NoError(t, err)
+	require.Len(t, imported, 2)
+	assert.Equal(t, model.AudioOnly, imported[0].Type)
+	assert.Equal(t, filepath.Join(cfg.Storage.Repository, "2023-05-01", "Old meeting", "09-30-00_audio_only.m4a"), imported[0].FilePath)
+	assert.FileExists(t, filepath.Join(src, "video.mp4"))
+	assert.FileExists(t, filepath.Join(cfg.Storage.Repository, "2023-05-01", "Old meeting", sidecarName))
+
+	meetings, err := store.ListMeetings(ctx)
+	require.NoError(t, err)
+	require.Len(t, meetings, 1)
+	assert.Equal(t, "Old meeting", meetings[0].Topic)
+	downloaded, err := store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	require.NoError(t, err)
+	require.Len(t, downloaded, 2)
+	for _, rec := range downloaded {
+		assert.NoError(t, repo.VerifyFile(ctx, rec, true))
+	}
+
+	// the same files are not imported twice
+	_, err = repo.Import(ctx, src, ImportMeta{Topic: "Old meeting", StartTime: start})
+	assert.ErrorContains(t, err, "already imported")
+
+	// untracked files in the repository are orphans, they can be imported to the existing meeting
+	orphan := filepath.Join(cfg.Storage.Repository, "manual", "chat.txt")
+	require.NoError(t, os.MkdirAll(filepath.Dir(orphan), 0o755))
+	require.NoError(t, os.WriteFile(orphan, []byte("chat"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(cfg.Storage.Repository, "manual", "x.mp4.part"), []byte("part"), 0o644))
+	orphans, err := repo.Orphans(ctx)
+	require.NoError(t, err)
+	require.Len(t, orphans, 1)
+	assert.Equal(t, orphan, orphans[0].Path)
+	assert.Equal(t, int64(4), orphans[0].Size)
+
+	imported, err = repo.Import(ctx, orphan, ImportMeta{MeetingId: meetings[0].UUID, Move: true})
+	require.NoError(t, err)
+	require.Len(t, imported, 1)
+	assert.Equal(t, model.ChatFile, imported[0].Type)
+	assert.NoFileExists(t, orphan)
+	orphans, err = repo.Orphans(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, orphans)
+
+	// uploaded file
+	imported, err = repo.ImportReader(ctx, "../upload.mp4", strings.NewReader("upload"), 100, ImportMeta{Topic: "Uploaded", StartTime: start})
+	require.NoError(t, err)
+	require.Len(t, imported, 1)
+	assert.Equal(t, filepath.Join(cfg.Storage.Repository, "2023-05-01", "Uploaded", "09-30-00_shared_screen_with_speaker_view.mp4"), imported[0].FilePath)
+	entries, err := os.ReadDir(cfg.Storage.Repository)
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.False(t, strings.HasPrefix(e.Name(), importPrefix))
+	}
+	assert.Equal(t, int64(0), repo.reserved[cfg.Storage.Repository].Load())
+
+	// upload is bigger than its size, size is unknown, not enough space
+	_, err = repo.ImportReader(ctx, "big.mp4", strings.NewReader("uploaded file"), 5, ImportMeta{Topic: "Big", StartTime: start})
+	assert.ErrorIs(t, err, ErrInvalidImport)
+	_, err = repo.ImportReader(ctx, "big.mp4", strings.NewReader("uploaded file"), -1, ImportMeta{Topic: "Big", StartTime: start})
+	assert.ErrorIs(t, err, ErrInvalidImport)
+	cfg.Storage.KeepFreeSpace = 1 << 62
+	_, err = repo.ImportReader(ctx, "big.mp4", strings.NewReader("uploaded file"), 100, ImportMeta{Topic: "Big", StartTime: start})
+	assert.ErrorIs(t, err, ErrNoSpace)
+	cfg.Storage.KeepFreeSpace = 0
+	entries, err = os.ReadDir(cfg.Storage.Repository)
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.False(t, strings.HasPrefix(e.Name(), importPrefix))
+	}
+	assert.Equal(t, int64(0), repo.reserved[cfg.Storage.Repository].Load())
+}
+
+// broken files are reported by the problem and repaired on request, folders without records are orphans
+func Test_Check(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir()}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/check_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	cl := &testClient{}
+	repo := NewRepository(store, cl, cfg)
+
+	src := t.TempDir()
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		require.NoError(t, os.WriteFile(filepath.Join(src, name+".mp4"), []byte("video "+name), 0o644))
+	}
+	imported, err := repo.Import(ctx, src, ImportMeta{Topic: "Checked", StartTime: time.Date(2023, 5, 1, 9, 30, 0, 0, time.Local)})
+	require.NoError(t, err)
+	require.Len(t, imported, 5)
+	missing, empty, size, hash := imported[0], imported[1], imported[2], imported[3]
+	require.NoError(t, os.Remove(missing.FilePath))
+	require.NoError(t, os.WriteFile(empty.FilePath, nil, 0o644))
+	require.NoError(t, os.WriteFile(size.FilePath, []byte("video c, longer"), 0o644))
+	require.NoError(t, os.WriteFile(hash.FilePath, []byte("video x"), 0o644))
+
+	emptyDir := filepath.Join(cfg.Storage.Repository, "2020-01-01")
+	require.NoError(t, os.MkdirAll(filepath.Join(emptyDir, "x"), 0o755))
+	manualDir := filepath.Join(cfg.Storage.Repository, "manual")
+	require.NoError(t, os.MkdirAll(manualDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(manualDir, "notes.txt"), []byte("notes"), 0o644))
+
+	problems := func(report *CheckReport) map[string]CheckItem {
+		res := map[string]CheckItem{}
+		for _, p := range report.Problems {
+			res[p.RecordId+p.Path] = p
+		}
+		return res
+	}
+
+	// report only, hash mismatch is found with VerifyHash
+	report, err := repo.Check(ctx, CheckOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 5, report.Checked)
+	assert.Len(t, report.Problems, 5)
+	report, err = repo.Check(ctx, CheckOptions{VerifyHash: true})
+	require.NoError(t, err)
+	assert.Equal(t, 6, report.Unrepaired())
+	found := problems(report)
+	assert.Equal(t, ProblemMissing, found[missing.Id+missing.FilePath].Problem)
+	assert.Equal(t, ProblemEmpty, found[empty.Id+empty.FilePath].Problem)
+	assert.Equal(t, ProblemSizeMismatch, found[size.Id+size.FilePath].Problem)
+	assert.Equal(t, ProblemHashMismatch, found[hash.Id+hash.FilePath].Problem)
+	assert.Equal(t, ProblemOrphanDir, found[emptyDir].Problem)
+	assert.Equal(t, ProblemOrphanDir, found[manualDir].Problem)
+	assert.Equal(t, model.StatusDownloaded, found[missing.Id+missing.FilePath].Status)
+
+	// missing and empty are still in the cloud, the others are not
+	cl.meeting = &model.Meeting{UUID: missing.MeetingId, Records: []model.Record{
+		{Id: missing.Id, DownloadURL: "http://cloud/missing", FileSize: missing.FileSize},
+		{Id: empty.Id, DownloadURL: "http://cloud/empty", FileSize: empty.FileSize},
+	}}
+	// the folder of the download in progress is empty until its .part file is created
+	start := time.Date(2021, 2, 2, 10, 0, 0, 0, time.Local)
+	downloading := model.Record{Id: "downloadingId", MeetingId: "downloadingUUID", StartTime: start, DateTime: start.Format(time.DateTime), FileExtension: "MP4", FileSize: 10}
+	require.NoError(t, store.SaveMeeting(ctx, model.Meeting{UUID: "downloadingUUID", Topic: "Weekly", StartTime: start, Records: []model.Record{downloading}}))
+	require.NoError(t, store.UpdateRecord(ctx, downloading.Id, model.StatusDownloading, ""))
+	downloadingDir, _ := downloading.Paths(cfg.Storage.Repository)
+	require.NoError(t, os.MkdirAll(downloadingDir, 0o755))
+	// and the folder of the layout, the file is saved there when the download is done
+	cfg.Storage.Layout = "{topic}/{date}/{id}.{ext}"
+	layoutDir := filepath.Join(cfg.Storage.Repository, "Weekly", "2021-02-02")
+	require.NoError(t, os.MkdirAll(layoutDir, 0o755))
+
+	report, err = repo.Check(ctx, CheckOptions{VerifyHash: true, Requeue: true, MarkUnrecoverable: true, RemoveEmptyDirs: true})
+	require.NoError(t, err)
+	cfg.Storage.Layout = ""
+	assert.DirExists(t, downloadingDir)
+	assert.DirExists(t, layoutDir)
+	require.NoError(t, os.RemoveAll(filepath.Join(cfg.Storage.Repository, "Weekly")))
+	assert.Equal(t, 2, report.Requeued)
+	assert.Equal(t, 2, report.Unrecoverable)
+	found = problems(report)
+	assert.Equal(t, RepairRequeued, found[missing.Id+missing.FilePath].Repair)
+	assert.Equal(t, RepairRequeued, found[empty.Id+empty.FilePath].Repair)
+	assert.Equal(t, RepairUnrecoverable, found[size.Id+size.FilePath].Repair)
+	assert.Equal(t, RepairUnrecoverable, found[hash.Id+hash.FilePath].Repair)
+	assert.Equal(t, RepairRemoved, found[emptyDir].Repair)
+	assert.Empty(t, found[manualDir].Repair)
+	assert.Equal(t, 1, report.Unrepaired())
+	assert.NoDirExists(t, emptyDir)
+	assert.NoFileExists(t, empty.FilePath)
+
+	queued, err := store.GetRecordsByStatus(ctx, model.StatusQueued)
+	require.NoError(t, err)
+	require.Len(t, queued, 2)
+	assert.Equal(t, "http://cloud/", queued[0].DownloadURL[:13])
+	unrecoverable, err := store.GetRecordsByStatus(ctx, model.StatusUnrecoverable)
+	require.NoError(t, err)
+	assert.Len(t, unrecoverable, 2)
+
+	// only the folder with the untracked file is left
+	report, err = repo.Check(ctx, CheckOptions{VerifyHash: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Checked)
+	require.Len(t, report.Problems, 1)
+	assert.Equal(t, manualDir, report.Problems[0].Path)
+	checked, err := repo.CheckConsistency(ctx, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, checked)
+}
+
+// hooks run after every downloaded record and the completed meeting, failed ones are retried and saved
+func Test_Hooks(t *testing.T) {
+	downloadQueuedPause = 10 * time.Millisecond
+	hookRetryDelay = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	content := testMP4(60, 1024)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "rec.mp4", time.Now(), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	out := t.TempDir()
+	t.Setenv("HOOK_OUT", out)
+	cfg := &config.Parameters{Storage: config.Storage{Repository: t.TempDir()}, Download: config.Download{Hooks: []config.Hook{
+		{Name: "env", Command: []string{"sh", "-c", `echo "$ZOOMRS_EVENT $ZOOMRS_RECORD_ID $ZOOMRS_FILE_SIZE $ZOOMRS_TOPIC" >> "$HOOK_OUT/env"; cat >> "$HOOK_OUT/stdin"`}},
+		{Name: "flaky", Retries: 1, Command: []string{"sh", "-c", `test -f "$HOOK_OUT/$ZOOMRS_RECORD_ID" || { touch "$HOOK_OUT/$ZOOMRS_RECORD_ID"; exit 1; }`}},
+		{Name: "verify", Event: HookEventMeeting, Step: "verify"},
+		{Name: "broken", Event: HookEventMeeting, Command: []string{"sh", "-c", `test -f "$HOOK_OUT/fixed" || { echo boom; exit 3; }`}},
+		{Name: "after", Event: HookEventMeeting, Command: []string{"sh", "-c", `echo "$ZOOMRS_FILE_PATHS" > "$HOOK_OUT/after"`}},
+	}}}
+	store, err := sqlite.NewStorage(ctx, "file:"+t.TempDir()+"/hooks_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+	repo := NewRepository(store, &testClient{}, cfg)
+
+	meeting := model.Meeting{UUID: "hooksUUID", Topic: "Hooked", StartTime: time.Now()}
+	for _, id := range []string{"h1", "h2"} {
+		meeting.Records = append(meeting.Records, model.Record{Id: id, MeetingId: meeting.UUID, StartTime: time.Now(),
+			FileExtension: "MP4", FileSize: model.FileSize(len(content)), DownloadURL: ts.URL + "/rec/download/" + id})
+	}
+	require.NoError(t, store.SaveMeeting(ctx, meeting))
+
+	dctx, cancelDownloads := context.WithTimeout(ctx, 10*time.Second)
+	defer cancelDownloads()
+	require.NoError(t, repo.DownloadQueued(dctx))
+
+	env, err := os.ReadFile(filepath.Join(out, "env"))
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(env)), "\n")
+	sort.Strings(lines)
+	assert.Equal(t, []string{"record h1 1024 Hooked", "record h2 1024 Hooked"}, lines)
+
+	stdin, err := os.ReadFile(filepath.Join(out, "stdin"))
+	require.NoError(t, err)
+	dec := json.NewDecoder(bytes.NewReader(stdin))
+	var ev HookEvent
+	require.NoError(t, dec.Decode(&ev))
+	assert.Equal(t, HookEventRecord, ev.Event)
+	assert.Equal(t, "hooksUUID", ev.UUID)
+	require.Len(t, ev.Records, 1)
+	assert.Equal(t, int64(1024), ev.Records[0].FileSize)
+	assert.Equal(t, 60, ev.Records[0].MediaDuration)
+	assert.FileExists(t, ev.Records[0].FilePath)
+
+	runs, err := store.GetHookRuns(ctx, "h1")
+	require.NoError(t, err)
+	require.Len(t, runs, 2)
+	assert.Equal(t, "flaky", runs[1].Hook)
+	assert.Equal(t, model.HookDone, runs[1].Status)
+	assert.Equal(t, 2, runs[1].Attempts)
+
+	// the meeting pipeline stopped at the broken hook
+	runs, err = store.GetHookRuns(ctx, "hooksUUID")
+	require.NoError(t, err)
+	require.Len(t, runs, 2)
+	assert.Equal(t, "broken", runs[0].Hook)
+	assert.Equal(t, model.HookFailed, runs[0].Status)
+	assert.Contains(t, runs[0].LastError, "boom")
+	assert.Equal(t, "verify", runs[1].Hook)
+	assert.Equal(t, model.HookDone, runs[1].Status)
+	assert.NoFileExists(t, filepath.Join(out, "after"))
+
+	// fixed hook is run again with the ones after it, done hooks are not
+	require.NoError(t, os.WriteFile(filepath.Join(out, "fixed"), nil, 0o644))
+	retried, err := repo.RunFailedHooks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, retried)
+	after, err := os.ReadFile(filepath.Join(out, "after"))
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(after)), "\n"), 2)
+	failed, err := store.GetHookRunsByStatus(ctx, model.HookFailed)
+	require.NoError(t, err)
+	assert.Empty(t, failed)
+	env, err = os.ReadFile(filepath.Join(out, "env"))
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(env)), "\n"), 2)
+
+	// hook is killed after the timeout
+	err = repo.runHook(ctx, config.Hook{Name: "slow", Timeout: 1, Command: []string{"sleep", "5"}}, ev)
+	assert.ErrorContains(t, err, "timed out")
+	err = repo.runHook(ctx, config.Hook{Name: "unknown", Step: "nope"}, ev)
+	assert.ErrorContains(t, err, "unknown hook step")
+	assert.ErrorContains(t, CheckHooks([]config.Hook{{Name: "unknown", Step: "nope"}}), `unknown step "nope"`)
+
+	// hooks run after the download is not in flight anymore
+	inFlight := -1
+	RegisterHookStep("inflight", func(ctx context.Context, r *Repository, ev HookEvent) error {
+		r.claimMx.Lock()
+		defer r.claimMx.Unlock()
+		inFlight = r.inFlight
+		return nil
+	})
+	defer delete(hookSteps, "inflight")
+	cfg.Download.Hooks = []config.Hook{{Name: "inflight", Step: "inflight"}, {Name: "verify", Step: "verify"}}
+	assert.NoError(t, CheckHooks(cfg.Download.Hooks))
+	require.NoError(t, store.SaveMeeting(ctx, model.Meeting{UUID: "inflightUUID", StartTime: time.Now(), Records: []model.Record{
+		{Id: "h3", MeetingId: "inflightUUID", StartTime: time.Now(), FileExtension: "MP4", FileSize: model.FileSize(len(content)), DownloadURL: ts.URL + "/rec/download/h3"},
+	}}))
+	require.NoError(t, repo.DownloadOnce(ctx))
+	assert.Equal(t, 0, inFlight)
+}
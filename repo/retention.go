@@ -0,0 +1,124 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/parMaster/zoomrs/config"
+	"github.com/parMaster/zoomrs/storage/model"
+)
+
+// retentionInterval is the interval of RetentionJob runs
+const retentionInterval = time.Hour
+
+// evictable is a downloaded record which can be evicted from the local storage
+type evictable struct {
+	model.Record
+	watched bool // the meeting was opened to watch at least once
+	expired bool // older than max_age of the retention rule, evicted even if there is enough free space
+}
+
+// retentionRule returns the first retention rule matching the record of the meeting, nil if none
+func (r *Repository) retentionRule(meeting model.Meeting, rec model.Record) *config.RetentionRule {
+	for i, rule := range r.cfg.Storage.Retention {
+		if rule.Topic != nil && !rule.Topic.MatchString(meeting.Topic) {
+			continue
+		}
+		if len(rule.MeetingIds) > 0 && !slices.Contains(rule.MeetingIds, meeting.UUID) &&
+			!slices.Contains(rule.MeetingIds, strconv.FormatUint(meeting.Id, 10)) {
+			continue
+		}
+		if len(rule.Types) > 0 && !slices.Contains(rule.Types, string(rec.Type)) {
+			continue
+		}
+		return &r.cfg.Storage.Retention[i]
+	}
+	return nil
+}
+
+// evictionCandidates returns downloaded records which can be evicted, in the order of eviction:
+// expired first, then never watched, then the oldest. Records of the meetings flagged 'keep',
+// pinned by the retention rules and younger than min_age of the rule are not returned
+func (r *Repository) evictionCandidates(ctx context.Context) ([]evictable, error) {
+	recs, err := r.store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get downloaded records %w", err)
+	}
+	meetings, err := r.store.GetMeetings(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get meetings %w", err)
+	}
+	byUUID := map[string]model.Meeting{}
+	for _, m := range meetings {
+		byUUID[m.UUID] = m
+	}
+
+	now := time.Now()
+	var candidates []evictable
+	for _, rec := range recs {
+		meeting, ok := byUUID[rec.MeetingId]
+		if !ok {
+			meeting = model.Meeting{UUID: rec.MeetingId}
+		}
+		if meeting.Keep {
+			continue
+		}
+		c := evictable{Record: rec, watched: meeting.WatchedAt != ""}
+
+		rule := r.retentionRule(meeting, rec)
+		if rule != nil {
+			if rule.Pin {
+				continue
+			}
+			recTime, err := time.ParseInLocation(time.DateTime, rec.DateTime, time.Local)
+			if err != nil {
+				log.Printf("[WARN] record %s has bad start time %q, %v", rec.Id, rec.DateTime, err)
+				continue
+			}
+			if rule.MinAge > 0 && recTime.AddDate(0, 0, rule.MinAge).After(now) {
+				continue
+			}
+			c.expired = rule.MaxAge > 0 && recTime.AddDate(0, 0, rule.MaxAge).Before(now)
+			if c.expired {
+				log.Printf("[DEBUG] record %s is older than %d days (rule %q)", rec.Id, rule.MaxAge, rule.Name)
+			}
+		}
+		candidates = append(candidates, c)
+	}
+
+	// records are ordered by start time already
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].expired != candidates[j].expired {
+			return candidates[i].expired
+		}
+		return !candidates[i].watched && candidates[j].watched
+	})
+	return candidates, nil
+}
+
+// RetentionJob is a long running job that applies the retention rules on a regular interval, so the
+// expired records are evicted and the free space is kept even if no downloads come
+func (r *Repository) RetentionJob(ctx context.Context) {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		deleted, err := r.freeUpSpace(ctx)
+		if err != nil {
+			log.Printf("[ERROR] failed to free up space, %v", err)
+		}
+		if deleted > 0 {
+			log.Printf("[INFO] retention job evicted %d records", deleted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
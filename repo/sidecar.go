@@ -0,0 +1,326 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parMaster/zoomrs/blob"
+	"github.com/parMaster/zoomrs/storage"
+	"github.com/parMaster/zoomrs/storage/model"
+)
+
+// sidecarName is the name of the metadata file written next to the downloaded recordings. Recordings of
+// another meeting in the same folder get their own "<file name>.meeting.json" sidecar
+const sidecarName = "meeting.json"
+
+// sidecar is the meeting with its recordings in the folder, enough to recreate the database rows
+type sidecar struct {
+	UUID      string          `json:"uuid"`
+	Id        uint64          `json:"id"`
+	Topic     string          `json:"topic"`
+	StartTime string          `json:"start_time"`         // time.DateTime, local time
+	Duration  int             `json:"duration,omitempty"` // minutes, used to validate the media duration of the downloads
+	HostId    string          `json:"host_id,omitempty"`
+	HostEmail string          `json:"host_email,omitempty"`
+	Keep      bool            `json:"keep,omitempty"`
+	Records   []sidecarRecord `json:"recording_files"`
+}
+
+type sidecarRecord struct {
+	Id            string           `json:"id"`
+	Type          model.RecordType `json:"recording_type"`
+	StartTime     string           `json:"start_time"` // time.DateTime, local time
+	FileExtension string           `json:"file_extension"`
+	FileSize      int64            `json:"file_size"` // bytes
+	File          string           `json:"file"`      // file name in the folder of the sidecar
+	Sha256        string           `json:"sha256,omitempty"`
+	DownloadURL   string           `json:"download_url,omitempty"`
+	PlayURL       string           `json:"play_url,omitempty"`
+	MediaDuration int              `json:"media_duration,omitempty"` // seconds
+	Resolution    string           `json:"resolution,omitempty"`
+}
+
+// sidecarLock is the key of the mutex of the sidecars in the folder of the store
+type sidecarLock struct {
+	store  blob.Store
+	folder string
+}
+
+// lockSidecars locks the sidecars in the folder of the file key, so concurrent updates of the recordings
+// of one folder don't overwrite each other. Returns the unlock function
+func (r *Repository) lockSidecars(store blob.Store, key string) func() {
+	mx, _ := r.sidecarMx.LoadOrStore(sidecarLock{store, path.Dir(key)}, &sync.Mutex{})
+	mx.(*sync.Mutex).Lock()
+	return mx.(*sync.Mutex).Unlock
+}
+
+// sidecarKeys returns the keys of the sidecar shared by the recordings in the folder of the file
+// and of the own sidecar of the file
+func sidecarKeys(key string) (shared, own string) {
+	return path.Join(path.Dir(key), sidecarName), key + "." + sidecarName
+}
+
+// isSidecar returns true if the key is the key of a sidecar
+func isSidecar(key string) bool {
+	base := path.Base(key)
+	return base == sidecarName || strings.HasSuffix(base, "."+sidecarName)
+}
+
+// readSidecar returns the sidecar with the key, nil if it doesn't exist
+func readSidecar(ctx context.Context, store blob.Store, key string) (*sidecar, error) {
+	rc, err := store.Open(ctx, key, 0, -1)
+	if err != nil {
+		if errors.Is(err, blob.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	sc := &sidecar{}
+	if err := json.Unmarshal(data, sc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", key, err)
+	}
+	return sc, nil
+}
+
+// writeSidecar saves the sidecar with the key, the sidecar without recordings is deleted
+func writeSidecar(ctx context.Context, store blob.Store, key string, sc *sidecar) error {
+	if len(sc.Records) == 0 {
+		if err := store.Delete(ctx, key); err != nil && !errors.Is(err, blob.ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(sc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, key, bytes.NewReader(data), int64(len(data)))
+}
+
+// addToSidecar adds the record with the file key to the sidecar of its folder, meeting details are
+// refreshed from the database
+func (r *Repository) addToSidecar(ctx context.Context, store blob.Store, key string, rec model.Record) error {
+	meeting, err := r.store.GetMeeting(ctx, rec.MeetingId)
+	if err != nil {
+		return fmt.Errorf("failed to get meeting %s: %w", rec.MeetingId, err)
+	}
+	defer r.lockSidecars(store, key)()
+	scKey, own := sidecarKeys(key)
+	sc, err := readSidecar(ctx, store, scKey)
+	if err != nil {
+		return err
+	}
+	if sc != nil && sc.UUID != meeting.UUID {
+		scKey = own
+		if sc, err = readSidecar(ctx, store, scKey); err != nil {
+			return err
+		}
+	}
+	if sc == nil {
+		sc = &sidecar{}
+	}
+	sc.UUID, sc.Id, sc.Topic, sc.StartTime, sc.Duration = meeting.UUID, meeting.Id, meeting.Topic, meeting.DateTime, meeting.Duration
+	sc.HostId, sc.HostEmail, sc.Keep = meeting.HostId, meeting.HostEmail, meeting.Keep
+
+	scRec := sidecarRecord{Id: rec.Id, Type: rec.Type, StartTime: rec.DateTime, FileExtension: rec.FileExtension,
+		FileSize: int64(rec.FileSize), File: path.Base(key), Sha256: rec.Sha256, DownloadURL: rec.DownloadURL, PlayURL: rec.PlayURL,
+		MediaDuration: rec.MediaDuration, Resolution: rec.Resolution}
+	records := []sidecarRecord{scRec}
+	for _, sr := range sc.Records {
+		if sr.Id != rec.Id {
+			records = append(records, sr)
+		}
+	}
+	sc.Records = records
+	return writeSidecar(ctx, store, scKey, sc)
+}
+
+// removeFromSidecar removes the record with the file key from the sidecar of its folder
+func (r *Repository) removeFromSidecar(ctx context.Context, store blob.Store, key string, rec model.Record) error {
+	defer r.lockSidecars(store, key)()
+	shared, own := sidecarKeys(key)
+	for _, scKey := range []string{shared, own} {
+		sc, err := readSidecar(ctx, store, scKey)
+		if err != nil {
+			return err
+		}
+		if sc == nil || sc.UUID != rec.MeetingId {
+			continue
+		}
+		records := []sidecarRecord{}
+		for _, sr := range sc.Records {
+			if sr.Id != rec.Id {
+				records = append(records, sr)
+			}
+		}
+		if len(records) == len(sc.Records) {
+			continue
+		}
+		sc.Records = records
+		return writeSidecar(ctx, store, scKey, sc)
+	}
+	return nil
+}
+
+// sidecarOwner returns the id of the record with the file key by the sidecars of its folder, empty if it's not there
+func sidecarOwner(ctx context.Context, store blob.Store, key string) (string, error) {
+	shared, own := sidecarKeys(key)
+	for _, scKey := range []string{shared, own} {
+		sc, err := readSidecar(ctx, store, scKey)
+		if err != nil {
+			return "", err
+		}
+		if sc == nil {
+			continue
+		}
+		for _, sr := range sc.Records {
+			if sr.File == path.Base(key) {
+				return sr.Id, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// SetMeetingKeep sets the keep flag of the meeting, sidecars of its recordings are updated
+func (r *Repository) SetMeetingKeep(ctx context.Context, UUID string, keep bool) error {
+	if err := r.store.SetMeetingKeep(ctx, UUID, keep); err != nil {
+		return err
+	}
+	recs, err := r.store.GetRecords(ctx, UUID)
+	if err != nil {
+		return fmt.Errorf("failed to get records of %s: %w", UUID, err)
+	}
+	for _, rec := range recs {
+		if rec.Status != model.StatusDownloaded && rec.Status != model.StatusArchived {
+			continue
+		}
+		store, key, err := r.fileKey(rec)
+		if err == nil {
+			err = r.addToSidecar(ctx, store, key, rec)
+		}
+		if err != nil {
+			log.Printf("[WARN] failed to update sidecar of %s, %v", rec.Id, err)
+		}
+	}
+	return nil
+}
+
+// RebuildDB scans the repository roots and the archive for sidecars and recreates the meetings
+// and records missing in the database. Records are added only if their files exist and have
+// the size from the sidecar. Returns the number of added meetings and records
+func (r *Repository) RebuildDB(ctx context.Context) (meetings, records int, result error) {
+	type source struct {
+		store  blob.Store
+		root   string                  // repository root, empty for the archive
+		status model.RecordStatus      // status of the found records
+		path   func(key string) string // file path of the record by its key
+	}
+	var sources []source
+	for _, root := range r.cfg.Storage.Roots() {
+		sources = append(sources, source{r.Files[root], root, model.StatusDownloaded,
+			func(key string) string { return filepath.Join(root, filepath.FromSlash(key)) }})
+	}
+	if r.Archive != nil {
+		sources = append(sources, source{r.Archive, "", model.StatusArchived,
+			func(key string) string { return path.Join(r.ArchiveRoot, key) }})
+	}
+
+	for _, src := range sources {
+		files, err := src.store.List(ctx, "")
+		if err != nil {
+			result = errors.Join(result, fmt.Errorf("failed to list files: %w", err))
+			continue
+		}
+		for _, f := range files {
+			if !isSidecar(f.Key) {
+				continue
+			}
+			sc, err := readSidecar(ctx, src.store, f.Key)
+			if err != nil {
+				result = errors.Join(result, fmt.Errorf("failed to read %s: %w", f.Key, err))
+				continue
+			}
+			if sc == nil {
+				continue
+			}
+
+			existing := map[string]bool{}
+			recs, err := r.store.GetRecords(ctx, sc.UUID)
+			if err != nil {
+				result = errors.Join(result, fmt.Errorf("failed to get records of %s: %w", sc.UUID, err))
+				continue
+			}
+			for _, rec := range recs {
+				existing[rec.Id] = true
+			}
+
+			var found []model.Record
+			for _, sr := range sc.Records {
+				if existing[sr.Id] {
+					continue
+				}
+				key := path.Join(path.Dir(f.Key), sr.File)
+				info, err := src.store.Stat(ctx, key)
+				if err != nil || info.Size != sr.FileSize {
+					log.Printf("[WARN] file %s of record %s is missing or has wrong size, skipping", key, sr.Id)
+					continue
+				}
+				startTime, _ := time.ParseInLocation(time.DateTime, sr.StartTime, time.Local)
+				found = append(found, model.Record{Id: sr.Id, MeetingId: sc.UUID, Type: sr.Type, StartTime: startTime,
+					FileExtension: sr.FileExtension, FileSize: model.FileSize(sr.FileSize), DownloadURL: sr.DownloadURL,
+					PlayURL: sr.PlayURL, Status: src.status, FilePath: src.path(key), Root: src.root, Sha256: sr.Sha256,
+					MediaDuration: sr.MediaDuration, Resolution: sr.Resolution})
+			}
+			if len(found) == 0 {
+				continue
+			}
+
+			_, err = r.store.GetMeeting(ctx, sc.UUID)
+			switch {
+			case errors.Is(err, storage.ErrNoRows):
+				startTime, _ := time.ParseInLocation(time.DateTime, sc.StartTime, time.Local)
+				meeting := model.Meeting{UUID: sc.UUID, Id: sc.Id, Topic: sc.Topic, StartTime: startTime, Duration: sc.Duration,
+					HostId: sc.HostId, HostEmail: sc.HostEmail, Records: found}
+				if err := r.store.SaveMeeting(ctx, meeting); err != nil {
+					result = errors.Join(result, fmt.Errorf("failed to save meeting %s: %w", sc.UUID, err))
+					continue
+				}
+				if sc.Keep {
+					if err := r.store.SetMeetingKeep(ctx, sc.UUID, true); err != nil {
+						result = errors.Join(result, fmt.Errorf("failed to keep meeting %s: %w", sc.UUID, err))
+					}
+				}
+				meetings++
+				records += len(found)
+			case err != nil:
+				result = errors.Join(result, fmt.Errorf("failed to get meeting %s: %w", sc.UUID, err))
+			default:
+				for _, rec := range found {
+					if err := r.store.SaveRecord(ctx, rec); err != nil {
+						result = errors.Join(result, fmt.Errorf("failed to save record %s: %w", rec.Id, err))
+						continue
+					}
+					records++
+				}
+			}
+		}
+	}
+	log.Printf("[INFO] Rebuilt %d meetings and %d records from sidecars", meetings, records)
+	return meetings, records, result
+}
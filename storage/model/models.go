@@ -17,6 +17,12 @@ const (
 	StatusDownloaded  RecordStatus = "downloaded"
 	StatusFailed      RecordStatus = "failed"
 	StatusDeleted     RecordStatus = "deleted"
+	StatusAbandoned   RecordStatus = "abandoned" // failed too many times, requeued manually only
+	StatusLost        RecordStatus = "lost"      // deleted from the cloud before it was downloaded
+	StatusArchived    RecordStatus = "archived"  // evicted from the repository to the cold archive
+
+	StatusUnrecoverable RecordStatus = "unrecoverable" // downloaded file is missing or broken, and the recording is not in the cloud anymore
+	StatusCorrupt       RecordStatus = "corrupt"       // downloaded MP4/M4A file is malformed, retried like failed
 )
 
 // RecordType describes the cloud recording types
@@ -54,6 +60,25 @@ type Meeting struct {
 	DateTime  string    `json:"date_time"`
 	Duration  int       `json:"duration"`
 	AccessKey string    `json:"access_key"`
+	HostId    string    `json:"host_id"`
+	HostEmail string    `json:"host_email"`
+	Keep      bool      `json:"keep,omitempty"`       // never evicted from the local storage
+	WatchedAt string    `json:"watched_at,omitempty"` // last time the meeting was opened to watch, time.DateTime
+}
+
+// Users - json response from zoom api users list
+type Users struct {
+	PageSize      int    `json:"page_size"`
+	TotalRecords  int    `json:"total_records"`
+	NextPageToken string `json:"next_page_token"`
+	Users         []User `json:"users"`
+}
+
+// User describes the Zoom user (meeting host)
+type User struct {
+	Id     string `json:"id"`
+	Email  string `json:"email"`
+	Status string `json:"status"`
 }
 
 // Record describes the records in recording_file array field
@@ -68,7 +93,79 @@ type Record struct {
 	DownloadURL   string       `json:"download_url"`
 	PlayURL       string       `json:"play_url"`
 	Status        RecordStatus `json:"-"`
-	FilePath      string       `json:"file_path"` // local file path
+	FilePath      string       `json:"file_path"`                 // local file path
+	Root          string       `json:"root,omitempty"`            // repository root folder of the downloaded file, empty - storage.repository
+	Sha256        string       `json:"sha256"`                    // hex encoded SHA-256 of the downloaded file
+	Attempts      int          `json:"attempts,omitempty"`        // failed download attempts
+	LastError     string       `json:"last_error,omitempty"`      // error of the last failed attempt
+	NextAttemptAt string       `json:"next_attempt_at,omitempty"` // failed record is not retried before this time, time.DateTime
+	MediaDuration int          `json:"media_duration,omitempty"`  // seconds, read from the downloaded MP4/M4A file
+	Resolution    string       `json:"resolution,omitempty"`      // "<width>x<height>" of the downloaded video
+	MediaURL      string       `json:"media_url,omitempty"`       // signed url of the file given to the watch page, not stored
+}
+
+// HookStatus describes the result of the post-download hook
+type HookStatus string
+
+const (
+	HookDone   HookStatus = "done"
+	HookFailed HookStatus = "failed" // failed after all retries, run again with cli 'hooks' cmd
+)
+
+// HookRun is the processing status of the hook for the record or the meeting
+type HookRun struct {
+	Hook      string     `json:"hook"`       // hook name
+	Id        string     `json:"id"`         // record id for 'record' hooks, meeting UUID for 'meeting' hooks
+	MeetingId string     `json:"meeting_id"` // meeting UUID
+	Event     string     `json:"event"`      // record or meeting
+	Status    HookStatus `json:"status"`
+	Attempts  int        `json:"attempts"`
+	LastError string     `json:"last_error,omitempty"`
+	UpdatedAt string     `json:"updated_at"` // time.DateTime
+}
+
+// Role is the access level of the web client user
+type Role string
+
+const (
+	RoleViewer  Role = "viewer"  // lists and watches the meetings
+	RoleManager Role = "manager" // shares the meetings, imports recordings, checks the repository
+	RoleAdmin   Role = "admin"   // repairs the repository, manages the roles of the users
+)
+
+// roleLevels orders the roles, every role has the permissions of the lower ones
+var roleLevels = map[Role]int{RoleViewer: 1, RoleManager: 2, RoleAdmin: 3}
+
+// Valid returns true for the known roles
+func (r Role) Valid() bool {
+	return roleLevels[r] > 0
+}
+
+// Allows returns true if the role has the permissions of the required role
+func (r Role) Allows(required Role) bool {
+	return r.Valid() && roleLevels[r] >= roleLevels[required]
+}
+
+// UserRole is the role of the user saved by the admin, overrides the roles of the config
+type UserRole struct {
+	Email     string `json:"email"` // lower case
+	Role      Role   `json:"role"`
+	UpdatedBy string `json:"updated_by"` // email of the admin
+	UpdatedAt string `json:"updated_at"` // time.DateTime
+}
+
+// ShareLink gives access to the meeting on the watch page by the random token. Only the hash of the token is stored
+type ShareLink struct {
+	Id          string `json:"id"`                   // hex encoded SHA-256 of the token
+	MeetingId   string `json:"meeting_id"`           // meeting UUID
+	CreatedBy   string `json:"created_by"`           // email of the manager created the link
+	CreatedAt   string `json:"created_at"`           // time.DateTime
+	ExpiresAt   string `json:"expires_at,omitempty"` // time.DateTime, empty - never expires
+	Password    string `json:"-"`                    // PBKDF2 hash of the password, empty - no password
+	HasPassword bool   `json:"has_password"`
+	MaxViews    int    `json:"max_views,omitempty"` // 0 - unlimited
+	Views       int    `json:"views"`
+	Revoked     bool   `json:"revoked"`
 }
 
 // returns absolute path to:
@@ -78,6 +175,21 @@ func (r Record) Paths(repositoryRoot string) (recFolder string, dateFolder strin
 	return fmt.Sprintf("%s/%s/%s", repositoryRoot, r.DateTime[:10], r.Id), fmt.Sprintf("%s/%s", repositoryRoot, r.DateTime[:10])
 }
 
+// WebhookEvent - json body of the Zoom event notification (webhook)
+type WebhookEvent struct {
+	Event   string         `json:"event"` // endpoint.url_validation, recording.completed, etc.
+	EventTs int64          `json:"event_ts"`
+	Payload WebhookPayload `json:"payload"`
+}
+
+// WebhookPayload describes the payload of the Zoom event notification.
+// PlainToken is set for endpoint.url_validation, Object - for recording.* events
+type WebhookPayload struct {
+	PlainToken string  `json:"plainToken"`
+	AccountId  string  `json:"account_id"`
+	Object     Meeting `json:"object"`
+}
+
 // CloudRecordingReport describes the cloud recording report
 type CloudRecordingReport struct {
 	From                  string                  `json:"from"`
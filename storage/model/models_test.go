@@ -36,3 +36,13 @@ func Test_CloudUsage(t *testing.T) {
 
 	assert.Equal(t, 7, cloud.UsagePercent) // 94.72 GB is 7% of 1.2 TB
 }
+
+func Test_Role(t *testing.T) {
+	assert.True(t, RoleAdmin.Allows(RoleManager))
+	assert.True(t, RoleManager.Allows(RoleManager))
+	assert.True(t, RoleViewer.Allows(RoleViewer))
+	assert.False(t, RoleViewer.Allows(RoleManager))
+	assert.False(t, RoleManager.Allows(RoleAdmin))
+	assert.False(t, Role("").Allows(RoleViewer))
+	assert.False(t, Role("root").Valid())
+}
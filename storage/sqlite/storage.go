@@ -3,7 +3,9 @@ package sqlite
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -17,6 +19,15 @@ type SQLiteStorage struct {
 
 // NewStorage creates new SQLite storage, creates tables if they don't exist
 func NewStorage(ctx context.Context, path string) (*SQLiteStorage, error) {
+	// concurrent download workers write to the database, wait for the lock instead of failing
+	if !strings.Contains(path, "_busy_timeout") {
+		if strings.Contains(path, "?") {
+			path += "&_busy_timeout=5000"
+		} else {
+			path += "?_busy_timeout=5000"
+		}
+	}
+
 	sqliteDatabase, err := sql.Open("sqlite3", path)
 	if err != nil {
 		return nil, err
@@ -50,35 +61,152 @@ func NewStorage(ctx context.Context, path string) (*SQLiteStorage, error) {
 		playUrl TEXT,
 		status TEXT,
 		path TEXT
+	);
+	CREATE TABLE IF NOT EXISTS cursors (
+		name TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS hook_runs (
+		hook TEXT NOT NULL,
+		id TEXT NOT NULL,
+		meetingId TEXT NOT NULL,
+		event TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		lastError TEXT NOT NULL DEFAULT '',
+		updatedAt TEXT NOT NULL,
+		PRIMARY KEY (hook, id)
+	);
+	CREATE TABLE IF NOT EXISTS share_links (
+		id TEXT PRIMARY KEY,
+		meetingId TEXT NOT NULL,
+		createdBy TEXT NOT NULL,
+		createdAt TEXT NOT NULL,
+		expiresAt TEXT NOT NULL DEFAULT '',
+		password TEXT NOT NULL DEFAULT '',
+		maxViews INTEGER NOT NULL DEFAULT 0,
+		views INTEGER NOT NULL DEFAULT 0,
+		revoked INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE IF NOT EXISTS user_roles (
+		email TEXT PRIMARY KEY,
+		role TEXT NOT NULL,
+		updatedBy TEXT NOT NULL DEFAULT '',
+		updatedAt TEXT NOT NULL
 	);`
 	_, err = sqliteDatabase.ExecContext(ctx, q)
 	if err != nil {
 		return nil, err
 	}
 
+	if err = migrate(ctx, sqliteDatabase); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
 	return &SQLiteStorage{DB: sqliteDatabase}, nil
 }
 
+// columns added after the initial schema, created in existing databases by migrate
+var migrations = []struct {
+	table, column, definition string
+}{
+	{"meetings", "hostId", "TEXT NOT NULL DEFAULT ''"},
+	{"meetings", "hostEmail", "TEXT NOT NULL DEFAULT ''"},
+	{"records", "sha256", "TEXT NOT NULL DEFAULT ''"},
+	{"records", "attempts", "INTEGER NOT NULL DEFAULT 0"},
+	{"records", "lastError", "TEXT NOT NULL DEFAULT ''"},
+	{"records", "nextAttemptAt", "TEXT NOT NULL DEFAULT ''"},
+	{"meetings", "keep", "INTEGER NOT NULL DEFAULT 0"},
+	{"meetings", "watchedAt", "TEXT NOT NULL DEFAULT ''"},
+	{"records", "root", "TEXT NOT NULL DEFAULT ''"},
+	{"records", "mediaDuration", "INTEGER NOT NULL DEFAULT 0"},
+	{"records", "resolution", "TEXT NOT NULL DEFAULT ''"},
+	{"meetings", "duration", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// migrate adds missing columns to the tables
+func migrate(ctx context.Context, db *sql.DB) error {
+	for _, m := range migrations {
+		var exists bool
+		q := "SELECT COUNT(*) > 0 FROM pragma_table_info($1) WHERE name = $2"
+		if err := db.QueryRowContext(ctx, q, m.table, m.column).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		log.Printf("[INFO] adding column %s.%s", m.table, m.column)
+		q = fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN %s %s", m.table, m.column, m.definition)
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// meetingColumns is the list of columns scanned by scanMeeting
+const meetingColumns = "uuid, id, topic, startTime, hostId, hostEmail, keep, watchedAt, duration"
+
+// scanner is implemented by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMeeting(row scanner) (model.Meeting, error) {
+	meeting := model.Meeting{}
+	err := row.Scan(&meeting.UUID, &meeting.Id, &meeting.Topic, &meeting.DateTime, &meeting.HostId, &meeting.HostEmail, &meeting.Keep, &meeting.WatchedAt, &meeting.Duration)
+	return meeting, err
+}
+
+// recordColumns is the list of columns scanned by scanRecord
+const recordColumns = "id, meetingId, type, startTime, fileExtension, fileSize, downUrl, playUrl, status, path, sha256, attempts, lastError, nextAttemptAt, root, mediaDuration, resolution"
+
+func scanRecord(row scanner) (model.Record, error) {
+	record := model.Record{}
+	err := row.Scan(
+		&record.Id,
+		&record.MeetingId,
+		&record.Type,
+		&record.DateTime,
+		&record.FileExtension,
+		&record.FileSize,
+		&record.DownloadURL,
+		&record.PlayURL,
+		&record.Status,
+		&record.FilePath,
+		&record.Sha256,
+		&record.Attempts,
+		&record.LastError,
+		&record.NextAttemptAt,
+		&record.Root,
+		&record.MediaDuration,
+		&record.Resolution)
+	return record, err
+}
+
 // SaveMeeting saves a meeting to the database
 func (s *SQLiteStorage) SaveMeeting(ctx context.Context, meeting model.Meeting) error {
 	// convert time to local
 	meeting.StartTime = meeting.StartTime.Local()
 
-	q := "INSERT INTO `meetings`(uuid, id, topic, startTime) VALUES ($1, $2, $3, $4)"
+	q := "INSERT INTO `meetings`(uuid, id, topic, startTime, hostId, hostEmail, duration) VALUES ($1, $2, $3, $4, $5, $6, $7)"
 	log.Printf("[DEBUG] Saving meeting: %v", meeting)
 
 	_, err := s.DB.ExecContext(ctx, q,
 		meeting.UUID,                            // uuid
 		meeting.Id,                              // id
 		meeting.Topic,                           // topic
-		meeting.StartTime.Format(time.DateTime)) // startTime
+		meeting.StartTime.Format(time.DateTime), // startTime
+		meeting.HostId,                          // hostId
+		meeting.HostEmail,                       // hostEmail
+		meeting.Duration)                        // duration
 
 	if err != nil {
 		return err
 	}
 
 	for _, r := range meeting.Records {
-		err := s.saveRecord(ctx, r)
+		err := s.SaveRecord(ctx, r)
 		if err != nil {
 			return err
 		}
@@ -86,8 +214,8 @@ func (s *SQLiteStorage) SaveMeeting(ctx context.Context, meeting model.Meeting)
 	return nil
 }
 
-// SaveRecord saves a record to the database
-func (s *SQLiteStorage) saveRecord(ctx context.Context, record model.Record) error {
+// SaveRecord saves a record of the existing meeting to the database
+func (s *SQLiteStorage) SaveRecord(ctx context.Context, record model.Record) error {
 	if record.Status == "" {
 		record.Status = model.StatusQueued
 	}
@@ -95,7 +223,7 @@ func (s *SQLiteStorage) saveRecord(ctx context.Context, record model.Record) err
 	// convert time to local
 	record.StartTime = record.StartTime.Local()
 
-	q := "INSERT INTO `records` VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)"
+	q := "INSERT INTO `records`(" + recordColumns + ") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)"
 	_, err := s.DB.ExecContext(ctx, q,
 		record.Id,                              // id
 		record.MeetingId,                       // meetingId
@@ -106,16 +234,22 @@ func (s *SQLiteStorage) saveRecord(ctx context.Context, record model.Record) err
 		record.DownloadURL,                     // downUrl
 		record.PlayURL,                         // playUrl
 		record.Status,                          // status
-		record.FilePath)                        // path
+		record.FilePath,                        // path
+		record.Sha256,                          // sha256
+		record.Attempts,                        // attempts
+		record.LastError,                       // lastError
+		record.NextAttemptAt,                   // nextAttemptAt
+		record.Root,                            // root
+		record.MediaDuration,                   // mediaDuration
+		record.Resolution)                      // resolution
 	return err
 }
 
 // GetMeeting returns a meeting from the database
 func (s *SQLiteStorage) GetMeeting(ctx context.Context, UUID string) (*model.Meeting, error) {
-	q := "SELECT * FROM `meetings` WHERE uuid = $1"
+	q := "SELECT " + meetingColumns + " FROM `meetings` WHERE uuid = $1"
 	row := s.DB.QueryRowContext(ctx, q, UUID)
-	meeting := model.Meeting{}
-	err := row.Scan(&meeting.UUID, &meeting.Id, &meeting.Topic, &meeting.DateTime)
+	meeting, err := scanMeeting(row)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, storage.ErrNoRows
@@ -125,9 +259,22 @@ func (s *SQLiteStorage) GetMeeting(ctx context.Context, UUID string) (*model.Mee
 	return &meeting, nil
 }
 
+// GetRecord returns the record by id, storage.ErrNoRows if there is no such record
+func (s *SQLiteStorage) GetRecord(ctx context.Context, Id string) (*model.Record, error) {
+	q := "SELECT " + recordColumns + " FROM `records` WHERE id = $1"
+	record, err := scanRecord(s.DB.QueryRowContext(ctx, q, Id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, storage.ErrNoRows
+		}
+		return nil, err
+	}
+	return &record, nil
+}
+
 // GetRecords returns records of specific meeting from the database
 func (s *SQLiteStorage) GetRecords(ctx context.Context, UUID string) ([]model.Record, error) {
-	q := "SELECT * FROM `records` WHERE meetingId = $1"
+	q := "SELECT " + recordColumns + " FROM `records` WHERE meetingId = $1"
 	rows, err := s.DB.QueryContext(ctx, q, UUID)
 	if err != nil {
 		return nil, err
@@ -140,18 +287,7 @@ func (s *SQLiteStorage) GetRecords(ctx context.Context, UUID string) ([]model.Re
 
 	var records []model.Record
 	for rows.Next() {
-		record := model.Record{}
-		err := rows.Scan(
-			&record.Id,
-			&record.MeetingId,
-			&record.Type,
-			&record.DateTime,
-			&record.FileExtension,
-			&record.FileSize,
-			&record.DownloadURL,
-			&record.PlayURL,
-			&record.Status,
-			&record.FilePath)
+		record, err := scanRecord(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -166,7 +302,7 @@ func (s *SQLiteStorage) GetRecords(ctx context.Context, UUID string) ([]model.Re
 
 // ListMeetings returns a list of meetings from the database
 func (s *SQLiteStorage) GetMeetings(ctx context.Context) ([]model.Meeting, error) {
-	q := "SELECT * FROM `meetings` ORDER BY startTime DESC"
+	q := "SELECT " + meetingColumns + " FROM `meetings` ORDER BY startTime DESC"
 	rows, err := s.DB.QueryContext(ctx, q)
 	if err != nil {
 		return nil, err
@@ -179,8 +315,7 @@ func (s *SQLiteStorage) GetMeetings(ctx context.Context) ([]model.Meeting, error
 
 	var meetings []model.Meeting
 	for rows.Next() {
-		meeting := model.Meeting{}
-		err := rows.Scan(&meeting.UUID, &meeting.Id, &meeting.Topic, &meeting.DateTime)
+		meeting, err := scanMeeting(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -194,18 +329,18 @@ func (s *SQLiteStorage) GetMeetings(ctx context.Context) ([]model.Meeting, error
 }
 
 // ListMeetings returns a list of meetings ready to be shown in the UI
-// Meeting must have at least one recording of type 'MP4' with status =='downloaded'
+// Meeting must have at least one recording of type 'MP4' with status 'downloaded' or 'archived'
 func (s *SQLiteStorage) ListMeetings(ctx context.Context) ([]model.Meeting, error) {
 	q := `
-		SELECT DISTINCT m.*
+		SELECT DISTINCT m.uuid, m.id, m.topic, m.startTime, m.hostId, m.hostEmail, m.keep, m.watchedAt, m.duration
 		FROM
 			meetings m JOIN
 			records r ON m.uuid = r.meetingId
 		WHERE
-			status = 'downloaded' AND
+			status IN ('downloaded', 'archived') AND
 			r.fileExtension = 'MP4'
 		ORDER BY
-			startTime DESC;
+			m.startTime DESC;
 		`
 	rows, err := s.DB.QueryContext(ctx, q)
 	if err != nil {
@@ -219,8 +354,7 @@ func (s *SQLiteStorage) ListMeetings(ctx context.Context) ([]model.Meeting, erro
 
 	var meetings []model.Meeting
 	for rows.Next() {
-		meeting := model.Meeting{}
-		err := rows.Scan(&meeting.UUID, &meeting.Id, &meeting.Topic, &meeting.DateTime)
+		meeting, err := scanMeeting(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -234,6 +368,14 @@ func (s *SQLiteStorage) ListMeetings(ctx context.Context) ([]model.Meeting, erro
 	return meetings, nil
 }
 
+// CountHostMeetings returns the number of the meetings hosted by the user with the email, case insensitive
+func (s *SQLiteStorage) CountHostMeetings(ctx context.Context, email string) (int, error) {
+	q := "SELECT COUNT(*) FROM `meetings` WHERE hostEmail != '' AND lower(hostEmail) = lower($1)"
+	var n int
+	err := s.DB.QueryRowContext(ctx, q, email).Scan(&n)
+	return n, err
+}
+
 // DeleteMeeting deletes a meeting with corresponding records from the database
 func (s *SQLiteStorage) DeleteMeeting(ctx context.Context, UUID string) error {
 	q := "DELETE FROM `records` WHERE meetingId = $1"
@@ -242,11 +384,37 @@ func (s *SQLiteStorage) DeleteMeeting(ctx context.Context, UUID string) error {
 		return err
 	}
 
+	q = "DELETE FROM `share_links` WHERE meetingId = $1"
+	_, err = s.DB.ExecContext(ctx, q, UUID)
+	if err != nil {
+		return err
+	}
+
 	q = "DELETE FROM `meetings` WHERE uuid = $1"
 	_, err = s.DB.ExecContext(ctx, q, UUID)
 	return err
 }
 
+// SetMeetingKeep sets or clears the keep flag of the meeting, storage.ErrNoRows if there is no such meeting
+func (s *SQLiteStorage) SetMeetingKeep(ctx context.Context, UUID string, keep bool) error {
+	q := "UPDATE `meetings` SET keep = $1 WHERE uuid = $2"
+	res, err := s.DB.ExecContext(ctx, q, keep, UUID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return storage.ErrNoRows
+	}
+	return nil
+}
+
+// SetMeetingWatched saves the time the meeting was watched
+func (s *SQLiteStorage) SetMeetingWatched(ctx context.Context, UUID string, watchedAt time.Time) error {
+	q := "UPDATE `meetings` SET watchedAt = $1 WHERE uuid = $2"
+	_, err := s.DB.ExecContext(ctx, q, watchedAt.Local().Format(time.DateTime), UUID)
+	return err
+}
+
 // UpdateRecord updates a record in the database
 func (s *SQLiteStorage) UpdateRecord(ctx context.Context, Id string, status model.RecordStatus, path string) error {
 	q := "UPDATE `records` SET status = $1, path = $2 WHERE id = $3"
@@ -254,31 +422,112 @@ func (s *SQLiteStorage) UpdateRecord(ctx context.Context, Id string, status mode
 	return err
 }
 
-// ResetFailedRecords resets all failed records to queued
+// SetRecordDownloaded marks the record as downloaded, saves its repository root, file path and SHA-256,
+// failed attempts are cleared
+func (s *SQLiteStorage) SetRecordDownloaded(ctx context.Context, Id string, root string, path string, sha256 string) error {
+	q := "UPDATE `records` SET status = $1, root = $2, path = $3, sha256 = $4, attempts = 0, lastError = '', nextAttemptAt = '' WHERE id = $5"
+	_, err := s.DB.ExecContext(ctx, q, model.StatusDownloaded, root, path, sha256, Id)
+	return err
+}
+
+// SetRecordMedia saves the duration (seconds) and the resolution read from the downloaded file
+func (s *SQLiteStorage) SetRecordMedia(ctx context.Context, Id string, duration int, resolution string) error {
+	q := "UPDATE `records` SET mediaDuration = $1, resolution = $2 WHERE id = $3"
+	res, err := s.DB.ExecContext(ctx, q, duration, resolution, Id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return storage.ErrNoRows
+	}
+	return nil
+}
+
+// UpdateRecordPaths sets the file paths of the records (id -> path) in one transaction,
+// nothing is updated if any of the records doesn't exist
+func (s *SQLiteStorage) UpdateRecordPaths(ctx context.Context, paths map[string]string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := "UPDATE `records` SET path = $1 WHERE id = $2"
+	for id, path := range paths {
+		res, err := tx.ExecContext(ctx, q, path, id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("record %s: %w", id, storage.ErrNoRows)
+		}
+	}
+	return tx.Commit()
+}
+
+// UpdateRecordAttempt saves the result of the failed download attempt
+func (s *SQLiteStorage) UpdateRecordAttempt(ctx context.Context, Id string, status model.RecordStatus, attempts int, lastError string, nextAttemptAt time.Time) error {
+	q := "UPDATE `records` SET status = $1, attempts = $2, lastError = $3, nextAttemptAt = $4 WHERE id = $5"
+	_, err := s.DB.ExecContext(ctx, q, status, attempts, lastError, nextAttemptAt.Local().Format(time.DateTime), Id)
+	return err
+}
+
+// UpdateRecordSource updates download url and file size of the record, refreshed from Zoom
+func (s *SQLiteStorage) UpdateRecordSource(ctx context.Context, Id string, downUrl string, fileSize model.FileSize) error {
+	q := "UPDATE `records` SET downUrl = $1, fileSize = $2 WHERE id = $3"
+	_, err := s.DB.ExecContext(ctx, q, downUrl, fileSize, Id)
+	return err
+}
+
+// ResetFailedRecords resets failed and corrupt records due for the next attempt to queued
 func (s *SQLiteStorage) ResetFailedRecords(ctx context.Context) error {
-	q := "UPDATE `records` SET status = 'queued' WHERE status IN ('failed', 'downloading')"
+	q := "UPDATE `records` SET status = 'queued' WHERE status IN ('failed', 'corrupt') AND nextAttemptAt <= $1"
+	_, err := s.DB.ExecContext(ctx, q, time.Now().Format(time.DateTime))
+	return err
+}
+
+// ResetDownloadingRecords resets the records left downloading by the interrupted downloads to queued
+func (s *SQLiteStorage) ResetDownloadingRecords(ctx context.Context) error {
+	q := "UPDATE `records` SET status = 'queued' WHERE status = 'downloading'"
 	_, err := s.DB.ExecContext(ctx, q)
 	return err
 }
 
+// RequeueAbandoned puts abandoned record (all of them if Id is empty) back to queue with attempts cleared.
+// Returns the number of requeued records
+func (s *SQLiteStorage) RequeueAbandoned(ctx context.Context, Id string) (int64, error) {
+	q := "UPDATE `records` SET status = 'queued', attempts = 0, lastError = '', nextAttemptAt = '' WHERE status = 'abandoned' AND ($1 = '' OR id = $1)"
+	res, err := s.DB.ExecContext(ctx, q, Id)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 // GetQueuedRecord returns a queued record from the database
 func (s *SQLiteStorage) GetQueuedRecord(ctx context.Context) (*model.Record, error) {
-	q := "SELECT * FROM `records` WHERE status = $1 ORDER BY startTime, id LIMIT 1"
+	q := "SELECT " + recordColumns + " FROM `records` WHERE status = $1 ORDER BY startTime, id LIMIT 1"
 
 	row := s.DB.QueryRowContext(ctx, q, model.StatusQueued)
-	record := model.Record{}
-	err := row.Scan(
-		&record.Id,
-		&record.MeetingId,
-		&record.Type,
-		&record.DateTime,
-		&record.FileExtension,
-		&record.FileSize,
-		&record.DownloadURL,
-		&record.PlayURL,
-		&record.Status,
-		&record.FilePath,
-	)
+	record, err := scanRecord(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, storage.ErrNoRows
+		}
+		return nil, err
+	}
+	return &record, nil
+}
+
+// ClaimQueuedRecord atomically marks the next queued record as downloading and returns it,
+// so concurrent download workers never get the same record
+func (s *SQLiteStorage) ClaimQueuedRecord(ctx context.Context) (*model.Record, error) {
+	q := `UPDATE records SET status = $1
+		WHERE id = (SELECT id FROM records WHERE status = $2 ORDER BY startTime, id LIMIT 1)
+		RETURNING ` + recordColumns
+
+	row := s.DB.QueryRowContext(ctx, q, model.StatusDownloading, model.StatusQueued)
+	record, err := scanRecord(row)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, storage.ErrNoRows
@@ -290,7 +539,7 @@ func (s *SQLiteStorage) GetQueuedRecord(ctx context.Context) (*model.Record, err
 
 // GetRecords returns records from the database
 func (s *SQLiteStorage) GetRecordsByStatus(ctx context.Context, status model.RecordStatus) ([]model.Record, error) {
-	q := "SELECT * FROM `records` WHERE status = $1 ORDER BY startTime"
+	q := "SELECT " + recordColumns + " FROM `records` WHERE status = $1 ORDER BY startTime"
 	rows, err := s.DB.QueryContext(ctx, q, status)
 	if err != nil {
 		return nil, err
@@ -303,19 +552,7 @@ func (s *SQLiteStorage) GetRecordsByStatus(ctx context.Context, status model.Rec
 	var records []model.Record
 
 	for rows.Next() {
-		record := model.Record{}
-		err := rows.Scan(
-			&record.Id,
-			&record.MeetingId,
-			&record.Type,
-			&record.DateTime,
-			&record.FileExtension,
-			&record.FileSize,
-			&record.DownloadURL,
-			&record.PlayURL,
-			&record.Status,
-			&record.FilePath,
-		)
+		record, err := scanRecord(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -369,6 +606,242 @@ func (s *SQLiteStorage) Stats(ctx context.Context) (map[model.RecordStatus]any,
 	return stats, nil
 }
 
+// GetCursor returns the value of the named cursor, storage.ErrNoRows if it's not set
+func (s *SQLiteStorage) GetCursor(ctx context.Context, name string) (string, error) {
+	q := "SELECT value FROM `cursors` WHERE name = $1"
+	var value string
+	err := s.DB.QueryRowContext(ctx, q, name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", storage.ErrNoRows
+	}
+	return value, err
+}
+
+// SetCursor sets the value of the named cursor
+func (s *SQLiteStorage) SetCursor(ctx context.Context, name string, value string) error {
+	q := "INSERT INTO `cursors`(name, value) VALUES ($1, $2) ON CONFLICT(name) DO UPDATE SET value = excluded.value"
+	_, err := s.DB.ExecContext(ctx, q, name, value)
+	return err
+}
+
+// DeleteCursor deletes the named cursor
+func (s *SQLiteStorage) DeleteCursor(ctx context.Context, name string) error {
+	q := "DELETE FROM `cursors` WHERE name = $1"
+	_, err := s.DB.ExecContext(ctx, q, name)
+	return err
+}
+
+// hookRunColumns is the list of columns scanned by scanHookRun
+const hookRunColumns = "hook, id, meetingId, event, status, attempts, lastError, updatedAt"
+
+func scanHookRun(row scanner) (model.HookRun, error) {
+	run := model.HookRun{}
+	err := row.Scan(&run.Hook, &run.Id, &run.MeetingId, &run.Event, &run.Status, &run.Attempts, &run.LastError, &run.UpdatedAt)
+	return run, err
+}
+
+// SaveHookRun saves the processing status of the hook for the record or the meeting, replacing the previous one
+func (s *SQLiteStorage) SaveHookRun(ctx context.Context, run model.HookRun) error {
+	if run.UpdatedAt == "" {
+		run.UpdatedAt = time.Now().Format(time.DateTime)
+	}
+	q := "INSERT INTO `hook_runs`(" + hookRunColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT(hook, id) DO UPDATE SET meetingId = excluded.meetingId, event = excluded.event, status = excluded.status,
+		attempts = excluded.attempts, lastError = excluded.lastError, updatedAt = excluded.updatedAt`
+	_, err := s.DB.ExecContext(ctx, q, run.Hook, run.Id, run.MeetingId, run.Event, run.Status, run.Attempts, run.LastError, run.UpdatedAt)
+	return err
+}
+
+// GetHookRuns returns the hook runs of the record or the meeting
+func (s *SQLiteStorage) GetHookRuns(ctx context.Context, Id string) ([]model.HookRun, error) {
+	q := "SELECT " + hookRunColumns + " FROM `hook_runs` WHERE id = $1 ORDER BY hook"
+	return s.queryHookRuns(ctx, q, Id)
+}
+
+// GetHookRunsByStatus returns the hook runs with the status, oldest first
+func (s *SQLiteStorage) GetHookRunsByStatus(ctx context.Context, status model.HookStatus) ([]model.HookRun, error) {
+	q := "SELECT " + hookRunColumns + " FROM `hook_runs` WHERE status = $1 ORDER BY updatedAt, id, hook"
+	return s.queryHookRuns(ctx, q, status)
+}
+
+func (s *SQLiteStorage) queryHookRuns(ctx context.Context, q string, arg any) ([]model.HookRun, error) {
+	rows, err := s.DB.QueryContext(ctx, q, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("[ERROR] failed to close rows: %v", err)
+		}
+	}()
+
+	runs := []model.HookRun{}
+	for rows.Next() {
+		run, err := scanHookRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// shareLinkColumns is the list of columns scanned by scanShareLink
+const shareLinkColumns = "id, meetingId, createdBy, createdAt, expiresAt, password, maxViews, views, revoked"
+
+func scanShareLink(row scanner) (model.ShareLink, error) {
+	link := model.ShareLink{}
+	err := row.Scan(&link.Id, &link.MeetingId, &link.CreatedBy, &link.CreatedAt, &link.ExpiresAt, &link.Password,
+		&link.MaxViews, &link.Views, &link.Revoked)
+	link.HasPassword = link.Password != ""
+	return link, err
+}
+
+// SaveShareLink saves the new share link
+func (s *SQLiteStorage) SaveShareLink(ctx context.Context, link model.ShareLink) error {
+	if link.CreatedAt == "" {
+		link.CreatedAt = time.Now().Format(time.DateTime)
+	}
+	q := "INSERT INTO `share_links`(" + shareLinkColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, err := s.DB.ExecContext(ctx, q, link.Id, link.MeetingId, link.CreatedBy, link.CreatedAt, link.ExpiresAt, link.Password,
+		link.MaxViews, link.Views, link.Revoked)
+	return err
+}
+
+// GetShareLink returns the share link by id, storage.ErrNoRows if there is no such link
+func (s *SQLiteStorage) GetShareLink(ctx context.Context, Id string) (*model.ShareLink, error) {
+	q := "SELECT " + shareLinkColumns + " FROM `share_links` WHERE id = $1"
+	link, err := scanShareLink(s.DB.QueryRowContext(ctx, q, Id))
+	if err == sql.ErrNoRows {
+		return nil, storage.ErrNoRows
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// ListShareLinks returns the share links of the meeting, all links if meetingId is empty. Newest first
+func (s *SQLiteStorage) ListShareLinks(ctx context.Context, meetingId string) ([]model.ShareLink, error) {
+	q := "SELECT " + shareLinkColumns + " FROM `share_links` WHERE $1 = '' OR meetingId = $1 ORDER BY createdAt DESC, id"
+	rows, err := s.DB.QueryContext(ctx, q, meetingId)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("[ERROR] failed to close rows: %v", err)
+		}
+	}()
+
+	links := []model.ShareLink{}
+	for rows.Next() {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// RevokeShareLink revokes the share link, storage.ErrNoRows if there is no such link
+func (s *SQLiteStorage) RevokeShareLink(ctx context.Context, Id string) error {
+	q := "UPDATE `share_links` SET revoked = 1 WHERE id = $1"
+	res, err := s.DB.ExecContext(ctx, q, Id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return storage.ErrNoRows
+	}
+	return nil
+}
+
+// AddShareLinkView counts the view of the share link. storage.ErrNoRows if there is no such link,
+// it's revoked or all the views are used
+func (s *SQLiteStorage) AddShareLinkView(ctx context.Context, Id string) error {
+	q := "UPDATE `share_links` SET views = views + 1 WHERE id = $1 AND revoked = 0 AND (maxViews = 0 OR views < maxViews)"
+	res, err := s.DB.ExecContext(ctx, q, Id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return storage.ErrNoRows
+	}
+	return nil
+}
+
+// userRoleColumns is the list of columns scanned by scanUserRole
+const userRoleColumns = "email, role, updatedBy, updatedAt"
+
+func scanUserRole(row scanner) (model.UserRole, error) {
+	ur := model.UserRole{}
+	err := row.Scan(&ur.Email, &ur.Role, &ur.UpdatedBy, &ur.UpdatedAt)
+	return ur, err
+}
+
+// SetUserRole saves the role of the user, replacing the previous one. Email is saved in lower case
+func (s *SQLiteStorage) SetUserRole(ctx context.Context, ur model.UserRole) error {
+	if ur.UpdatedAt == "" {
+		ur.UpdatedAt = time.Now().Format(time.DateTime)
+	}
+	q := "INSERT INTO `user_roles`(" + userRoleColumns + `) VALUES ($1, $2, $3, $4)
+		ON CONFLICT(email) DO UPDATE SET role = excluded.role, updatedBy = excluded.updatedBy, updatedAt = excluded.updatedAt`
+	_, err := s.DB.ExecContext(ctx, q, strings.ToLower(ur.Email), ur.Role, ur.UpdatedBy, ur.UpdatedAt)
+	return err
+}
+
+// GetUserRole returns the saved role of the user, storage.ErrNoRows if there is none
+func (s *SQLiteStorage) GetUserRole(ctx context.Context, email string) (*model.UserRole, error) {
+	q := "SELECT " + userRoleColumns + " FROM `user_roles` WHERE email = $1"
+	ur, err := scanUserRole(s.DB.QueryRowContext(ctx, q, strings.ToLower(email)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, storage.ErrNoRows
+		}
+		return nil, err
+	}
+	return &ur, nil
+}
+
+// ListUserRoles returns the saved roles of the users ordered by email
+func (s *SQLiteStorage) ListUserRoles(ctx context.Context) ([]model.UserRole, error) {
+	q := "SELECT " + userRoleColumns + " FROM `user_roles` ORDER BY email"
+	rows, err := s.DB.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("[ERROR] failed to close rows: %v", err)
+		}
+	}()
+
+	roles := []model.UserRole{}
+	for rows.Next() {
+		ur, err := scanUserRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, ur)
+	}
+	return roles, rows.Err()
+}
+
+// DeleteUserRole deletes the saved role of the user, storage.ErrNoRows if there is none
+func (s *SQLiteStorage) DeleteUserRole(ctx context.Context, email string) error {
+	q := "DELETE FROM `user_roles` WHERE email = $1"
+	res, err := s.DB.ExecContext(ctx, q, strings.ToLower(email))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return storage.ErrNoRows
+	}
+	return nil
+}
+
 // Cleanup deletes all meetings and records from the database, used for testing
 func (s *SQLiteStorage) Cleanup(ctx context.Context) error {
 	q := "DELETE FROM `meetings`"
@@ -2,7 +2,9 @@ package sqlite
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"sync"
 	"testing"
 	"time"
 
@@ -10,6 +12,7 @@ import (
 	"github.com/parMaster/zoomrs/storage"
 	"github.com/parMaster/zoomrs/storage/model"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_SqliteStorage(t *testing.T) {
@@ -76,6 +79,9 @@ func Test_SqliteStorage(t *testing.T) {
 		Topic:     "testTopic",
 		StartTime: timeNow,
 		Records:   testRecords,
+		HostId:    "testHostId",
+		HostEmail: "host@example.com",
+		Duration:  62,
 	}
 
 	// write a record
@@ -88,6 +94,15 @@ func Test_SqliteStorage(t *testing.T) {
 	assert.Equal(t, testMeeting.UUID, meeting.UUID)
 	assert.Equal(t, testMeeting.Id, meeting.Id)
 	assert.Equal(t, timeNow.Format(time.DateTime), meeting.DateTime)
+	assert.Equal(t, testMeeting.HostId, meeting.HostId)
+	assert.Equal(t, testMeeting.HostEmail, meeting.HostEmail)
+	n, err := store.CountHostMeetings(ctx, "Host@Example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = store.CountHostMeetings(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, testMeeting.Duration, meeting.Duration)
 
 	// read records
 	records, err := store.GetRecords(ctx, testMeeting.UUID)
@@ -96,6 +111,13 @@ func Test_SqliteStorage(t *testing.T) {
 	assert.Equal(t, timeNow.Format(time.DateTime), records[0].DateTime)
 	assert.Equal(t, timeNow.Format(time.DateTime), records[1].DateTime)
 
+	// record by id
+	record, err := store.GetRecord(ctx, records[0].Id)
+	require.NoError(t, err)
+	assert.Equal(t, records[0].MeetingId, record.MeetingId)
+	_, err = store.GetRecord(ctx, "noSuchId")
+	assert.ErrorIs(t, err, storage.ErrNoRows)
+
 	// no such meeting
 	meeting, err = store.GetMeeting(ctx, "noSuchUUID")
 	assert.NotNil(t, err)
@@ -125,9 +147,17 @@ func Test_SqliteStorage(t *testing.T) {
 	assert.ErrorIs(t, err, storage.ErrNoRows)
 	assert.Nil(t, q4)
 
-	// Reset failed records
+	// Reset failed records, the downloading one is left
 	err = store.ResetFailedRecords(ctx)
 	assert.NoError(t, err)
+	records, err = store.GetRecords(ctx, testMeeting.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, model.StatusDownloading, records[0].Status)
+	assert.Equal(t, model.StatusQueued, records[2].Status)
+
+	// Reset interrupted downloads
+	err = store.ResetDownloadingRecords(ctx)
+	assert.NoError(t, err)
 	// check that all records are queued
 	records, err = store.GetRecords(ctx, testMeeting.UUID)
 	assert.NoError(t, err)
@@ -136,6 +166,35 @@ func Test_SqliteStorage(t *testing.T) {
 	assert.Equal(t, model.StatusQueued, records[1].Status)
 	assert.Equal(t, model.StatusQueued, records[2].Status)
 
+	// Set record downloaded with hash
+	err = store.SetRecordDownloaded(ctx, "Id2", "/data/disk2", "testPath2", "testSha256")
+	assert.NoError(t, err)
+	downloaded, err := store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(downloaded))
+	assert.Equal(t, "Id2", downloaded[0].Id)
+	assert.Equal(t, "testPath2", downloaded[0].FilePath)
+	assert.Equal(t, "testSha256", downloaded[0].Sha256)
+	assert.Equal(t, "/data/disk2", downloaded[0].Root)
+
+	// Set media info of the downloaded file
+	assert.ErrorIs(t, store.SetRecordMedia(ctx, "noSuchId", 60, ""), storage.ErrNoRows)
+	assert.NoError(t, store.SetRecordMedia(ctx, "Id2", 3723, "1920x1080"))
+	downloaded, err = store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	assert.NoError(t, err)
+	assert.Equal(t, 3723, downloaded[0].MediaDuration)
+	assert.Equal(t, "1920x1080", downloaded[0].Resolution)
+
+	// Update paths, nothing is updated if any record doesn't exist
+	assert.ErrorIs(t, store.UpdateRecordPaths(ctx, map[string]string{"Id2": "newPath2", "noSuchId": "path"}), storage.ErrNoRows)
+	downloaded, err = store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	assert.NoError(t, err)
+	assert.Equal(t, "testPath2", downloaded[0].FilePath)
+	assert.NoError(t, store.UpdateRecordPaths(ctx, map[string]string{"Id2": "newPath2"}))
+	downloaded, err = store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	assert.NoError(t, err)
+	assert.Equal(t, "newPath2", downloaded[0].FilePath)
+
 	// List meetings
 	meetings, err := store.GetMeetings(ctx)
 	assert.NoError(t, err)
@@ -144,3 +203,258 @@ func Test_SqliteStorage(t *testing.T) {
 	assert.Equal(t, testMeeting.Id, meetings[0].Id)
 	assert.Equal(t, timeNow.Format(time.DateTime), meetings[0].DateTime)
 }
+
+// concurrent workers must never claim the same record
+func Test_ClaimQueuedRecord(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := NewStorage(ctx, "file:"+t.TempDir()+"/claim_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+
+	meeting := model.Meeting{UUID: "claimUUID", Id: 1, Topic: "claim", StartTime: time.Now()}
+	for i := range 20 {
+		meeting.Records = append(meeting.Records, model.Record{
+			Id:        fmt.Sprintf("claim%02d", i),
+			MeetingId: meeting.UUID,
+			StartTime: time.Now(),
+			Status:    model.StatusQueued,
+		})
+	}
+	require.NoError(t, store.SaveMeeting(ctx, meeting))
+
+	var mx sync.Mutex
+	claimed := map[string]int{}
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				rec, err := store.ClaimQueuedRecord(ctx)
+				if err == storage.ErrNoRows {
+					return
+				}
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, model.StatusDownloading, rec.Status)
+				mx.Lock()
+				claimed[rec.Id]++
+				mx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, claimed, 20)
+	for id, n := range claimed {
+		assert.Equal(t, 1, n, id)
+	}
+}
+
+func Test_RecordAttempts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := NewStorage(ctx, "file:"+t.TempDir()+"/attempts_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+
+	meeting := model.Meeting{UUID: "attemptsUUID", StartTime: time.Now(), Records: []model.Record{
+		{Id: "due", MeetingId: "attemptsUUID", StartTime: time.Now()},
+		{Id: "notDue", MeetingId: "attemptsUUID", StartTime: time.Now()},
+		{Id: "abandoned", MeetingId: "attemptsUUID", StartTime: time.Now()},
+		{Id: "corrupt", MeetingId: "attemptsUUID", StartTime: time.Now()},
+	}}
+	require.NoError(t, store.SaveMeeting(ctx, meeting))
+
+	require.NoError(t, store.UpdateRecordAttempt(ctx, "due", model.StatusFailed, 1, "err1", time.Now().Add(-time.Minute)))
+	require.NoError(t, store.UpdateRecordAttempt(ctx, "notDue", model.StatusFailed, 2, "err2", time.Now().Add(time.Hour)))
+	require.NoError(t, store.UpdateRecordAttempt(ctx, "abandoned", model.StatusAbandoned, 5, "err5", time.Now().Add(time.Hour)))
+	require.NoError(t, store.UpdateRecordAttempt(ctx, "corrupt", model.StatusCorrupt, 1, "corrupt", time.Now().Add(-time.Minute)))
+
+	// only the failed and corrupt records due for the next attempt are queued
+	require.NoError(t, store.ResetFailedRecords(ctx))
+	statuses := map[string]model.Record{}
+	records, err := store.GetRecords(ctx, meeting.UUID)
+	require.NoError(t, err)
+	for _, r := range records {
+		statuses[r.Id] = r
+	}
+	assert.Equal(t, model.StatusQueued, statuses["due"].Status)
+	assert.Equal(t, 1, statuses["due"].Attempts)
+	assert.Equal(t, model.StatusQueued, statuses["corrupt"].Status)
+	assert.Equal(t, model.StatusFailed, statuses["notDue"].Status)
+	assert.Equal(t, "err2", statuses["notDue"].LastError)
+	assert.Equal(t, model.StatusAbandoned, statuses["abandoned"].Status)
+	assert.Equal(t, 5, statuses["abandoned"].Attempts)
+	assert.NotEmpty(t, statuses["abandoned"].NextAttemptAt)
+
+	// requeue abandoned
+	n, err := store.RequeueAbandoned(ctx, "noSuchId")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	n, err = store.RequeueAbandoned(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	records, err = store.GetRecordsByStatus(ctx, model.StatusQueued)
+	require.NoError(t, err)
+	assert.Len(t, records, 3)
+	for _, r := range records {
+		if r.Id == "abandoned" {
+			assert.Equal(t, 0, r.Attempts)
+			assert.Empty(t, r.LastError)
+		}
+	}
+
+	// successful download clears attempts
+	require.NoError(t, store.SetRecordDownloaded(ctx, "due", "", "path", "sum"))
+	records, err = store.GetRecordsByStatus(ctx, model.StatusDownloaded)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, 0, records[0].Attempts)
+	assert.Empty(t, records[0].NextAttemptAt)
+}
+
+func Test_Cursors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := NewStorage(ctx, "file:"+t.TempDir()+"/cursors_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+
+	_, err = store.GetCursor(ctx, "sync")
+	assert.ErrorIs(t, err, storage.ErrNoRows)
+
+	require.NoError(t, store.SetCursor(ctx, "sync", "2024-01-01"))
+	require.NoError(t, store.SetCursor(ctx, "sync", "2024-01-02"))
+	value, err := store.GetCursor(ctx, "sync")
+	require.NoError(t, err)
+	assert.Equal(t, "2024-01-02", value)
+
+	require.NoError(t, store.DeleteCursor(ctx, "sync"))
+	_, err = store.GetCursor(ctx, "sync")
+	assert.ErrorIs(t, err, storage.ErrNoRows)
+}
+
+func Test_HookRuns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := NewStorage(ctx, "file:"+t.TempDir()+"/hooks_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+
+	runs, err := store.GetHookRuns(ctx, "rec1")
+	require.NoError(t, err)
+	assert.Empty(t, runs)
+
+	require.NoError(t, store.SaveHookRun(ctx, model.HookRun{Hook: "scan", Id: "rec1", MeetingId: "m1", Event: "record", Status: model.HookFailed, Attempts: 3, LastError: "exit status 1"}))
+	require.NoError(t, store.SaveHookRun(ctx, model.HookRun{Hook: "index", Id: "m1", MeetingId: "m1", Event: "meeting", Status: model.HookDone, Attempts: 1}))
+	failed, err := store.GetHookRunsByStatus(ctx, model.HookFailed)
+	require.NoError(t, err)
+	require.Len(t, failed, 1)
+	assert.Equal(t, "scan", failed[0].Hook)
+	assert.Equal(t, "m1", failed[0].MeetingId)
+	assert.Equal(t, 3, failed[0].Attempts)
+	assert.Equal(t, "exit status 1", failed[0].LastError)
+	assert.NotEmpty(t, failed[0].UpdatedAt)
+
+	// the next run replaces the previous one
+	require.NoError(t, store.SaveHookRun(ctx, model.HookRun{Hook: "scan", Id: "rec1", MeetingId: "m1", Event: "record", Status: model.HookDone, Attempts: 1}))
+	runs, err = store.GetHookRuns(ctx, "rec1")
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	assert.Equal(t, model.HookDone, runs[0].Status)
+	assert.Empty(t, runs[0].LastError)
+	failed, err = store.GetHookRunsByStatus(ctx, model.HookFailed)
+	require.NoError(t, err)
+	assert.Empty(t, failed)
+}
+
+func Test_ShareLinks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := NewStorage(ctx, "file:"+t.TempDir()+"/shares_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+
+	_, err = store.GetShareLink(ctx, "nope")
+	assert.ErrorIs(t, err, storage.ErrNoRows)
+	assert.ErrorIs(t, store.RevokeShareLink(ctx, "nope"), storage.ErrNoRows)
+
+	require.NoError(t, store.SaveShareLink(ctx, model.ShareLink{Id: "l1", MeetingId: "m1", CreatedBy: "manager@example.com", MaxViews: 2, Password: "hash"}))
+	require.NoError(t, store.SaveShareLink(ctx, model.ShareLink{Id: "l2", MeetingId: "m2", CreatedBy: "manager@example.com", ExpiresAt: "2030-01-01 00:00:00"}))
+	assert.Error(t, store.SaveShareLink(ctx, model.ShareLink{Id: "l1", MeetingId: "m1"}), "ids are unique")
+
+	link, err := store.GetShareLink(ctx, "l1")
+	require.NoError(t, err)
+	assert.Equal(t, "m1", link.MeetingId)
+	assert.Equal(t, "manager@example.com", link.CreatedBy)
+	assert.NotEmpty(t, link.CreatedAt)
+	assert.True(t, link.HasPassword)
+	assert.Equal(t, 2, link.MaxViews)
+
+	links, err := store.ListShareLinks(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, links, 2)
+	links, err = store.ListShareLinks(ctx, "m2")
+	require.NoError(t, err)
+	require.Len(t, links, 1)
+	assert.Equal(t, "2030-01-01 00:00:00", links[0].ExpiresAt)
+	assert.False(t, links[0].HasPassword)
+
+	// views are counted up to max_views
+	assert.NoError(t, store.AddShareLinkView(ctx, "l1"))
+	assert.NoError(t, store.AddShareLinkView(ctx, "l1"))
+	assert.ErrorIs(t, store.AddShareLinkView(ctx, "l1"), storage.ErrNoRows)
+	link, err = store.GetShareLink(ctx, "l1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, link.Views)
+
+	// revoked link is not viewed
+	assert.NoError(t, store.AddShareLinkView(ctx, "l2"))
+	require.NoError(t, store.RevokeShareLink(ctx, "l2"))
+	assert.ErrorIs(t, store.AddShareLinkView(ctx, "l2"), storage.ErrNoRows)
+	link, err = store.GetShareLink(ctx, "l2")
+	require.NoError(t, err)
+	assert.True(t, link.Revoked)
+	assert.Equal(t, 1, link.Views)
+
+	// links are deleted with the meeting
+	require.NoError(t, store.DeleteMeeting(ctx, "m2"))
+	_, err = store.GetShareLink(ctx, "l2")
+	assert.ErrorIs(t, err, storage.ErrNoRows)
+}
+
+func Test_UserRoles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := NewStorage(ctx, "file:"+t.TempDir()+"/roles_test.db?mode=rwc&_journal_mode=WAL")
+	require.NoError(t, err)
+
+	_, err = store.GetUserRole(ctx, "user@example.com")
+	assert.ErrorIs(t, err, storage.ErrNoRows)
+	assert.ErrorIs(t, store.DeleteUserRole(ctx, "user@example.com"), storage.ErrNoRows)
+
+	require.NoError(t, store.SetUserRole(ctx, model.UserRole{Email: "User@Example.com", Role: model.RoleViewer, UpdatedBy: "admin@example.com"}))
+	require.NoError(t, store.SetUserRole(ctx, model.UserRole{Email: "a@example.com", Role: model.RoleAdmin}))
+	ur, err := store.GetUserRole(ctx, "USER@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "user@example.com", ur.Email)
+	assert.Equal(t, model.RoleViewer, ur.Role)
+	assert.Equal(t, "admin@example.com", ur.UpdatedBy)
+	assert.NotEmpty(t, ur.UpdatedAt)
+
+	// the role is replaced
+	require.NoError(t, store.SetUserRole(ctx, model.UserRole{Email: "user@example.com", Role: model.RoleManager}))
+	roles, err := store.ListUserRoles(ctx)
+	require.NoError(t, err)
+	require.Len(t, roles, 2)
+	assert.Equal(t, "a@example.com", roles[0].Email)
+	assert.Equal(t, model.RoleManager, roles[1].Role)
+
+	require.NoError(t, store.DeleteUserRole(ctx, "user@example.com"))
+	_, err = store.GetUserRole(ctx, "user@example.com")
+	assert.ErrorIs(t, err, storage.ErrNoRows)
+}
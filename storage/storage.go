@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/parMaster/zoomrs/storage/model"
 )
@@ -15,14 +16,42 @@ var (
 
 type Storer interface {
 	SaveMeeting(ctx context.Context, meeting model.Meeting) error
+	SaveRecord(ctx context.Context, record model.Record) error
 	GetMeeting(ctx context.Context, UUID string) (*model.Meeting, error)
 	ListMeetings(ctx context.Context) ([]model.Meeting, error)
+	CountHostMeetings(ctx context.Context, email string) (int, error)
 	GetMeetings(ctx context.Context) ([]model.Meeting, error)
+	GetRecord(ctx context.Context, Id string) (*model.Record, error)
 	GetRecords(ctx context.Context, UUID string) ([]model.Record, error)
 	GetRecordsByStatus(ctx context.Context, rs model.RecordStatus) ([]model.Record, error)
 	DeleteMeeting(ctx context.Context, UUID string) error
+	SetMeetingKeep(ctx context.Context, UUID string, keep bool) error
+	SetMeetingWatched(ctx context.Context, UUID string, watchedAt time.Time) error
 	UpdateRecord(ctx context.Context, Id string, status model.RecordStatus, path string) error
+	SetRecordDownloaded(ctx context.Context, Id string, root string, path string, sha256 string) error
+	SetRecordMedia(ctx context.Context, Id string, duration int, resolution string) error
+	UpdateRecordPaths(ctx context.Context, paths map[string]string) error
+	UpdateRecordAttempt(ctx context.Context, Id string, status model.RecordStatus, attempts int, lastError string, nextAttemptAt time.Time) error
+	RequeueAbandoned(ctx context.Context, Id string) (int64, error)
+	UpdateRecordSource(ctx context.Context, Id string, downUrl string, fileSize model.FileSize) error
 	GetQueuedRecord(ctx context.Context) (*model.Record, error)
+	ClaimQueuedRecord(ctx context.Context) (*model.Record, error)
 	ResetFailedRecords(ctx context.Context) error
+	ResetDownloadingRecords(ctx context.Context) error
 	Stats(ctx context.Context) (map[model.RecordStatus]any, error)
+	GetCursor(ctx context.Context, name string) (string, error)
+	SetCursor(ctx context.Context, name string, value string) error
+	DeleteCursor(ctx context.Context, name string) error
+	SaveHookRun(ctx context.Context, run model.HookRun) error
+	GetHookRuns(ctx context.Context, Id string) ([]model.HookRun, error)
+	GetHookRunsByStatus(ctx context.Context, status model.HookStatus) ([]model.HookRun, error)
+	SaveShareLink(ctx context.Context, link model.ShareLink) error
+	GetShareLink(ctx context.Context, Id string) (*model.ShareLink, error)
+	ListShareLinks(ctx context.Context, meetingId string) ([]model.ShareLink, error)
+	RevokeShareLink(ctx context.Context, Id string) error
+	AddShareLinkView(ctx context.Context, Id string) error
+	SetUserRole(ctx context.Context, ur model.UserRole) error
+	GetUserRole(ctx context.Context, email string) (*model.UserRole, error)
+	ListUserRoles(ctx context.Context) ([]model.UserRole, error)
+	DeleteUserRole(ctx context.Context, email string) error
 }
@@ -1,8 +1,16 @@
 package webauth
 
 import (
+	"context"
 	"crypto/sha1"
-	"slices"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/go-pkgz/auth"
@@ -12,9 +20,25 @@ import (
 	"github.com/go-pkgz/lgr"
 	"github.com/parMaster/zoomrs/config"
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
 )
 
-func NewAuthService(cfg config.Server) (*auth.Service, error) {
+// LocalProvider is the name of the provider checking the passwords of server.dev_auth.users
+const LocalProvider = "local"
+
+// DevProvider is the name of the fake OAuth provider of server.dev_auth.enabled
+const DevProvider = "dev"
+
+// discoveryTimeout limits the request of the OpenID Connect configuration
+const discoveryTimeout = 10 * time.Second
+
+// NewAuthService creates the auth service with the providers enabled in the config: Google, generic OIDC,
+// GitHub, dev and local. Only the allowed users are let in. The dev provider is refused unless the domain
+// and its host are local, its OAuth server listens on all the interfaces
+func NewAuthService(cfg config.Server, allowed func(user token.User) bool) (*auth.Service, error) {
+	if cfg.DevAuth.Enabled && (!isLoopback(cfg.Domain) || (cfg.DevAuth.Host != "" && !isLoopback(cfg.DevAuth.Host))) {
+		return nil, fmt.Errorf("dev login provider is allowed on localhost only, domain is %q", cfg.Domain)
+	}
 	options := auth.Opts{
 		SecretReader: token.SecretFunc(func(id string) (string, error) { // secret key for JWT
 			return cfg.JWTSecret, nil
@@ -26,39 +50,220 @@ func NewAuthService(cfg config.Server) (*auth.Service, error) {
 		AvatarStore:       avatar.NewLocalFS("/tmp/zoomrs"),
 		AvatarResizeLimit: 200,
 		Validator: token.ValidatorFunc(func(_ string, claims token.Claims) bool {
-			// allow access to managers
-			return slices.Contains(cfg.Managers, claims.User.Email)
+			// allow access to the users with a role
+			return claims.User != nil && allowed(*claims.User)
 		}),
 		ClaimsUpd: token.ClaimsUpdFunc(func(claims token.Claims) token.Claims { // modify issued token
+			// local provider logs in by the email, it's the user name
+			if u := claims.User; u != nil && u.Email == "" && u.ID == LocalProvider+"_"+token.HashID(sha1.New(), u.Name) {
+				u.Email = strings.ToLower(u.Name)
+			}
+			// dev provider sets the id to the typed user name, it's hashed and prefixed like the ids of the other providers
+			if u := claims.User; u != nil && cfg.DevAuth.Enabled && u.ID != "" && u.ID == u.Name {
+				u.ID = DevProvider + "_" + token.HashID(sha1.New(), u.Name)
+			}
 			return claims
 		}),
 		Logger:      lgr.Std,
 		DisableXSRF: cfg.OAuthDisableXSRF,
 	}
+	if strings.HasPrefix(cfg.Domain, "http://") || strings.HasPrefix(cfg.Domain, "https://") {
+		options.URL = strings.TrimSuffix(cfg.Domain, "/") // like http://localhost:8099 for local testing
+	}
 
 	// create auth authService with providers
 	authService := auth.NewService(options)
 
-	c := auth.Client{
-		Cid:     cfg.OAuthClientId,
-		Csecret: cfg.OAuthClientSecret,
+	if cfg.OAuthClientId != "" {
+		c := auth.Client{
+			Cid:     cfg.OAuthClientId,
+			Csecret: cfg.OAuthClientSecret,
+		}
+
+		authService.AddCustomProvider("google", c, provider.CustomHandlerOpt{
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  "https://accounts.google.com/o/oauth2/auth",
+				TokenURL: "https://oauth2.googleapis.com/token",
+			},
+			InfoURL: "https://www.googleapis.com/oauth2/v2/userinfo",
+			MapUserFn: func(data provider.UserData, _ []byte) token.User {
+				userInfo := token.User{
+					ID:    "google_" + token.HashID(sha1.New(), data.Value("username")),
+					Name:  data.Value("nickname"),
+					Email: data.Value("email"),
+				}
+				return userInfo
+			},
+			Scopes: []string{"email"},
+		})
+	}
+
+	if cfg.OIDC.Issuer != "" {
+		if err := addOIDCProvider(authService, cfg.OIDC); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.GitHub.ClientId != "" {
+		c := auth.Client{
+			Cid:     cfg.GitHub.ClientId,
+			Csecret: cfg.GitHub.ClientSecret,
+		}
+		// built-in github provider doesn't map the email, the public email of the profile is used
+		authService.AddCustomProvider("github", c, provider.CustomHandlerOpt{
+			Endpoint: github.Endpoint,
+			InfoURL:  "https://api.github.com/user",
+			MapUserFn: func(data provider.UserData, _ []byte) token.User {
+				userInfo := token.User{
+					ID:      "github_" + token.HashID(sha1.New(), data.Value("login")),
+					Name:    data.Value("name"),
+					Picture: data.Value("avatar_url"),
+					Email:   data.Value("email"),
+				}
+				if userInfo.Name == "" {
+					userInfo.Name = data.Value("login")
+				}
+				return userInfo
+			},
+			Scopes: []string{"read:user", "user:email"},
+		})
+	}
+
+	if cfg.DevAuth.Enabled {
+		host := cfg.DevAuth.Host
+		if host == "" {
+			host = "localhost"
+		}
+		authService.AddDevProvider(host, cfg.DevAuth.Port)
+	}
+
+	if len(cfg.DevAuth.Users) > 0 {
+		users := map[string]string{}
+		for email, hash := range cfg.DevAuth.Users {
+			users[strings.ToLower(email)] = hash
+		}
+		authService.AddDirectProvider(LocalProvider, provider.CredCheckerFunc(func(user, password string) (bool, error) {
+			hash, ok := users[strings.ToLower(user)]
+			return ok && CheckPassword(hash, password), nil
+		}))
+	}
+
+	if len(authService.Providers()) == 0 {
+		log.Printf("[WARN] no login providers configured, web client login is disabled")
+	}
+	return authService, nil
+}
+
+// IsDevUser returns true for the user logged in by the dev provider, any email can be typed in its form
+func IsDevUser(u token.User) bool {
+	return strings.HasPrefix(u.ID, DevProvider+"_")
+}
+
+// isLoopback returns true if the host of the domain, with or without the scheme and port, is localhost or a loopback ip
+func isLoopback(domain string) bool {
+	if !strings.Contains(domain, "://") {
+		domain = "http://" + domain
 	}
+	u, err := url.Parse(domain)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
 
-	authService.AddCustomProvider("google", c, provider.CustomHandlerOpt{
+// RunDevAuth runs the fake OAuth server of the dev provider until the context is done.
+// The user name typed in its form is the email of the user
+func RunDevAuth(ctx context.Context, authService *auth.Service) error {
+	devAuth, err := authService.DevAuth()
+	if err != nil {
+		return err
+	}
+	devAuth.GetEmailFn = func(username string) string { return strings.ToLower(username) }
+	devAuth.Run(ctx)
+	return nil
+}
+
+// oidcConfiguration is the part of the OpenID Connect discovery document used to set up the provider
+type oidcConfiguration struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// addOIDCProvider adds the OpenID Connect provider with the endpoints discovered from the issuer
+func addOIDCProvider(authService *auth.Service, cfg config.OIDC) error {
+	oc, err := discoverOIDC(cfg.Issuer)
+	if err != nil {
+		return fmt.Errorf("failed to discover OIDC provider %s: %w", cfg.Issuer, err)
+	}
+	name := cfg.Name
+	if name == "" {
+		name = "oidc"
+	}
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+
+	c := auth.Client{
+		Cid:     cfg.ClientId,
+		Csecret: cfg.ClientSecret,
+	}
+	authService.AddCustomProvider(name, c, provider.CustomHandlerOpt{
 		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://accounts.google.com/o/oauth2/auth",
-			TokenURL: "https://oauth2.googleapis.com/token",
+			AuthURL:  oc.AuthorizationEndpoint,
+			TokenURL: oc.TokenEndpoint,
 		},
-		InfoURL: "https://www.googleapis.com/oauth2/v2/userinfo",
+		InfoURL: oc.UserinfoEndpoint,
 		MapUserFn: func(data provider.UserData, _ []byte) token.User {
 			userInfo := token.User{
-				ID:    "google_" + token.HashID(sha1.New(), data.Value("username")),
-				Name:  data.Value("nickname"),
-				Email: data.Value("email"),
+				ID:      name + "_" + token.HashID(sha1.New(), data.Value("sub")),
+				Name:    data.Value("name"),
+				Picture: data.Value("picture"),
+				Email:   data.Value("email"),
+			}
+			if userInfo.Name == "" {
+				userInfo.Name = data.Value("preferred_username")
+			}
+			// unverified email can be set by the user to anything
+			if verified, ok := data["email_verified"].(bool); ok && !verified {
+				userInfo.Email = ""
 			}
 			return userInfo
 		},
-		Scopes: []string{"email"},
+		Scopes: scopes,
 	})
-	return authService, nil
+	return nil
+}
+
+// discoverOIDC reads the OpenID Connect configuration of the issuer from <issuer>/.well-known/openid-configuration
+func discoverOIDC(issuer string) (*oidcConfiguration, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	client := http.Client{Timeout: discoveryTimeout}
+	resp, err := client.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	oc := oidcConfiguration{}
+	if err := json.NewDecoder(resp.Body).Decode(&oc); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if strings.TrimSuffix(oc.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("issuer mismatch, got %s", oc.Issuer)
+	}
+	if oc.AuthorizationEndpoint == "" || oc.TokenEndpoint == "" || oc.UserinfoEndpoint == "" {
+		return nil, errors.New("authorization, token or userinfo endpoint is missing")
+	}
+	return &oc, nil
 }
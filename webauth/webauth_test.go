@@ -0,0 +1,170 @@
+package webauth
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-pkgz/auth/token"
+	"github.com/parMaster/zoomrs/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Password(t *testing.T) {
+	hash, err := HashPassword("secret")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "pbkdf2-sha256$100000$"))
+	assert.True(t, CheckPassword(hash, "secret"))
+	assert.False(t, CheckPassword(hash, "Secret"))
+	assert.False(t, CheckPassword(hash, ""))
+	assert.False(t, CheckPassword("secret", "secret"))
+
+	other, err := HashPassword("secret")
+	require.NoError(t, err)
+	assert.NotEqual(t, hash, other, "salt is random")
+}
+
+// oidcServer serves the discovery document of the issuer, the issuer is the server url if empty
+func oidcServer(t *testing.T, issuer string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/openid-configuration" {
+			http.NotFound(rw, r)
+			return
+		}
+		iss := issuer
+		if iss == "" {
+			iss = "http://" + r.Host
+		}
+		json.NewEncoder(rw).Encode(map[string]string{
+			"issuer":                 iss,
+			"authorization_endpoint": iss + "/auth",
+			"token_endpoint":         iss + "/token",
+			"userinfo_endpoint":      iss + "/userinfo",
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func Test_DiscoverOIDC(t *testing.T) {
+	srv := oidcServer(t, "")
+	oc, err := discoverOIDC(srv.URL + "/")
+	require.NoError(t, err)
+	assert.Equal(t, srv.URL+"/auth", oc.AuthorizationEndpoint)
+	assert.Equal(t, srv.URL+"/token", oc.TokenEndpoint)
+	assert.Equal(t, srv.URL+"/userinfo", oc.UserinfoEndpoint)
+
+	_, err = discoverOIDC(srv.URL + "/realms/missing")
+	assert.ErrorContains(t, err, "404")
+
+	_, err = discoverOIDC(oidcServer(t, "https://evil.example.com").URL)
+	assert.ErrorContains(t, err, "issuer mismatch")
+}
+
+func Test_Providers(t *testing.T) {
+	hash, err := HashPassword("secret")
+	require.NoError(t, err)
+
+	cfg := config.Server{
+		Domain:           "http://localhost:8099",
+		JWTSecret:        "jwt secret",
+		OAuthDisableXSRF: true,
+		OIDC:             config.OIDC{Name: "keycloak", Issuer: oidcServer(t, "").URL, ClientId: "cid", ClientSecret: "csecret"},
+		GitHub:           config.GitHub{ClientId: "cid", ClientSecret: "csecret"},
+		DevAuth:          config.DevAuth{Enabled: true, Users: map[string]string{"User@Email.com": hash, "banned@email.com": hash}},
+	}
+	allowed := func(user token.User) bool { return user.Email == "user@email.com" }
+	authService, err := NewAuthService(cfg, allowed)
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, p := range authService.Providers() {
+		names = append(names, p.Name())
+	}
+	// google is not configured
+	assert.Equal(t, []string{"keycloak", "github", "dev", LocalProvider}, names)
+
+	// dev provider is refused on the public domain or host
+	_, err = NewAuthService(config.Server{Domain: "zoomrs.example.com", DevAuth: cfg.DevAuth}, allowed)
+	assert.ErrorContains(t, err, "localhost only")
+	_, err = NewAuthService(config.Server{Domain: "http://127.0.0.1:8099", DevAuth: config.DevAuth{Enabled: true, Host: "192.168.1.10"}}, allowed)
+	assert.ErrorContains(t, err, "localhost only")
+	_, err = NewAuthService(config.Server{Domain: "localhost:8099", DevAuth: config.DevAuth{Enabled: true, Host: "[::1]"}}, allowed)
+	assert.NoError(t, err)
+
+	// unavailable issuer fails the service
+	cfg.OIDC.Issuer = "http://127.0.0.1:1"
+	_, err = NewAuthService(cfg, allowed)
+	assert.ErrorContains(t, err, "failed to discover OIDC provider")
+	cfg.OIDC.Issuer = ""
+
+	authService, err = NewAuthService(cfg, allowed)
+	require.NoError(t, err)
+	authRoutes, _ := authService.Handlers()
+	mux := http.NewServeMux()
+	mux.Handle("/auth/", http.StripPrefix("/auth", authRoutes))
+	m := authService.Middleware()
+	mux.Handle("/private", m.Auth(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		userInfo, err := token.GetUserInfo(r)
+		require.NoError(t, err)
+		rw.Write([]byte(userInfo.Email))
+	})))
+
+	login := func(user, password string) *httptest.ResponseRecorder {
+		body := `{"user":"` + user + `","passwd":"` + password + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/auth/local/login", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	private := func(cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/private", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// the list of the login page
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/auth/list", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `["github", "dev", "local"]`, rr.Body.String())
+
+	assert.Equal(t, http.StatusForbidden, login("user@email.com", "wrong").Code)
+	assert.Equal(t, http.StatusForbidden, login("unknown@email.com", "secret").Code)
+
+	// the email is the user name, case insensitive
+	rr = login("USER@email.com", "secret")
+	require.Equal(t, http.StatusOK, rr.Code)
+	rr = private(rr.Result().Cookies())
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "user@email.com", rr.Body.String())
+
+	// the password is right, the validator rejects the email
+	rr = login("banned@email.com", "secret")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, http.StatusUnauthorized, private(rr.Result().Cookies()).Code)
+}
+
+func Test_IsDevUser(t *testing.T) {
+	assert.True(t, IsDevUser(token.User{ID: "dev_" + token.HashID(sha1.New(), "admin@email.com"), Email: "admin@email.com"}))
+	assert.False(t, IsDevUser(token.User{ID: "github_" + token.HashID(sha1.New(), "dev_user"), Name: "dev_user"}))
+	assert.False(t, IsDevUser(token.User{ID: "admin@email.com", Email: "admin@email.com"}))
+
+	assert.True(t, isLoopback("http://localhost:8099"))
+	assert.True(t, isLoopback("LocalHost"))
+	assert.True(t, isLoopback("127.0.0.1:8080"))
+	assert.True(t, isLoopback("http://[::1]:8099/"))
+	assert.False(t, isLoopback("https://zoomrs.example.com"))
+	assert.False(t, isLoopback("localhost.example.com"))
+	assert.False(t, isLoopback("0.0.0.0"))
+	assert.False(t, isLoopback(""))
+}